@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Address model.
+//
+// VTX1 addresses are 18-trit values, stored in 36 bits. What one address
+// names is selected by the addressing unit:
+//
+//   - byte: one address per byte of the output image, so an instruction
+//     advances the location counter by 4 and a bundle by 12. .DB takes one
+//     address per item, .DW two and .DT four. This is the default.
+//   - word: one address per 32-bit slot, as the CPU counts TC (TC+1 per
+//     instruction, TC+3 per bundle). .DB and .DW data is packed four bytes
+//     or two halves to a word, and every directive pads to a whole word.
+//   - tritword: one address per 36-bit (18-trit) machine word. Instructions
+//     count as in the word unit, and every .DB or .DW item fills a word.
+//
+// A .DT item is an 18-trit word and always takes the addresses of one slot.
+//
+// Labels, .ORG, .SPACE, branch targets and memory displacements are all
+// counted in the selected unit.
+
+// Addr is a location in the 18-trit address space, counted in addressing
+// units.
+type Addr int64
+
+// AddrUnit selects what one address names.
+type AddrUnit int
+
+const (
+	UnitByte     AddrUnit = iota // One address per byte of the image
+	UnitWord                     // One address per 32-bit instruction slot
+	UnitTritWord                 // One address per 36-bit machine word
+)
+
+var addrUnitNames = []string{"byte", "word", "tritword"}
+
+func (u AddrUnit) String() string {
+	if int(u) < len(addrUnitNames) {
+		return addrUnitNames[u]
+	}
+	return fmt.Sprintf("AddrUnit(%d)", int(u))
+}
+
+// ParseAddrUnit converts the value of the -addrunit flag.
+func ParseAddrUnit(s string) (AddrUnit, error) {
+	for u, name := range addrUnitNames {
+		if strings.EqualFold(s, name) {
+			return AddrUnit(u), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported addressing unit: %s (use byte, word or tritword)", s)
+}
+
+// plural names the unit in diagnostics, e.g. "12 words from TC".
+func (u AddrUnit) plural() string {
+	if u == UnitByte {
+		return "bytes"
+	}
+	return "words"
+}
+
+// slotSize returns the number of addresses one instruction slot occupies.
+func (u AddrUnit) slotSize() Addr {
+	if u == UnitByte {
+		return InstrSlotBytes
+	}
+	return 1
+}
+
+// unitBytes returns the number of image bytes one address covers.
+func (u AddrUnit) unitBytes() int {
+	if u == UnitByte {
+		return 1
+	}
+	return InstrSlotBytes
+}
+
+// dataSize returns the number of addresses n data items of width bytes
+// occupy. Width 0 is an 18-trit .DT word, which takes the addresses of an
+// instruction slot.
+func (u AddrUnit) dataSize(width int, n int64) Addr {
+	switch {
+	case width == 0:
+		return u.slotSize() * Addr(n)
+	case u == UnitWord:
+		return Addr((int64(width)*n + InstrSlotBytes - 1) / InstrSlotBytes)
+	case u == UnitTritWord:
+		return Addr(n)
+	}
+	return Addr(int64(width) * n)
+}
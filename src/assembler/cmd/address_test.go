@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestAddressingUnits(t *testing.T) {
+	src := `start:
+        ADD T0, T0, 1
+        [ADD T1, T1, 1] [ADD T2, T2, 1]
+        BNE T0, T1, start
+data:
+        .DB 1, 2, 3
+words:
+        .DW 0x1234
+        .SPACE 2
+end:
+        LD T3, data
+        HALT
+`
+	for _, c := range []struct {
+		unit        AddrUnit
+		data, words Addr
+		end         Addr
+		size        int
+	}{
+		{UnitByte, 20, 23, 27, 35},
+		{UnitWord, 5, 6, 9, 44},
+		{UnitTritWord, 5, 8, 11, 52},
+	} {
+		ctx := parseSource(t, src)
+		cg := NewCodeGenerator(ctx.SymbolTable)
+		cg.AddrUnit = c.unit
+		if err := cg.Generate(ctx.AST); err != nil {
+			t.Errorf("%s: Generate: %v", c.unit, err)
+			continue
+		}
+		want := map[string]Addr{"start": 0, "data": c.data, "words": c.words, "end": c.end}
+		for name, addr := range want {
+			if cg.Labels[name] != addr {
+				t.Errorf("%s: %s = %d, want %d", c.unit, name, cg.Labels[name], addr)
+			}
+		}
+		if len(cg.Output) != c.size {
+			t.Errorf("%s: %d bytes of output, want %d", c.unit, len(cg.Output), c.size)
+		}
+		if bne := slotWords(cg.Output[16:20])[0]; bne.Imm != -4 {
+			t.Errorf("%s: BNE offset field = %d, want -4 slots", c.unit, bne.Imm)
+		}
+		ld := UnpackInstrWord(binary.LittleEndian.Uint32(cg.Output[c.size-8:]))
+		if disp := int64(c.data - c.end); ld.Imm != int32(disp)&memDispMask {
+			t.Errorf("%s: LD displacement field = 0x%X, want %d", c.unit, ld.Imm, disp)
+		}
+	}
+}
+
+func TestAddressingUnitData(t *testing.T) {
+	ctx := parseSource(t, ".DB 1, 2, 3, 4, 5\n.DW 0x1234\n")
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.AddrUnit = UnitWord
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := []byte{1, 2, 3, 4, 5, 0, 0, 0, 0x12, 0x34, 0, 0}
+	if string(cg.Output) != string(want) || cg.CurrentAddr != 3 {
+		t.Errorf("word data = % X ending at %d, want % X ending at 3", cg.Output, cg.CurrentAddr, want)
+	}
+
+	ctx = parseSource(t, ".DB 0t-, 7\n")
+	cg = NewCodeGenerator(ctx.SymbolTable)
+	cg.AddrUnit = UnitTritWord
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want = []byte{0xFF, 0xFF, 0xFF, 0xFF, 7, 0, 0, 0}
+	if string(cg.Output) != string(want) || cg.CurrentAddr != 2 {
+		t.Errorf("trit-word data = % X ending at %d, want % X ending at 2", cg.Output, cg.CurrentAddr, want)
+	}
+
+	for _, name := range []string{"byte", "Word", "tritword"} {
+		if u, err := ParseAddrUnit(name); err != nil || u.String() != addrUnitNames[u] {
+			t.Errorf("ParseAddrUnit(%q) = %v, %v", name, u, err)
+		}
+	}
+	if _, err := ParseAddrUnit("nibble"); err == nil {
+		t.Error("ParseAddrUnit accepted an unknown unit")
+	}
+}
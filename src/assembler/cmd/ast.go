@@ -19,6 +19,8 @@ type LineNode struct {
 	Comment   string
 	Line      int
 	Column    int
+	File      string // Included file the line comes from, "" for the source file
+	Expansion int    // Macro expansion the line is part of, 0 outside macros
 }
 
 // StatementNode is an interface for all statement types
@@ -63,6 +65,7 @@ type VLIWInstructionNode struct {
 	Instructions []*InstructionNode
 	Line         int
 	Column       int
+	Auto         bool // Formed by the automatic bundler rather than written in the source
 }
 
 func (VLIWInstructionNode) isStatement() {}
@@ -93,9 +96,10 @@ func (ImmediateNode) isOperand() {}
 // MemoryOperandNode represents a memory operand
 // e.g., [T0+T1] or [T0+0x10]
 type MemoryOperandNode struct {
-	Base   string // Register name
-	Index  string // Optional index register
-	Offset string // Optional offset (immediate)
+	Base   string    // Register name
+	Index  string    // Optional index register
+	Offset string    // Optional offset (immediate)
+	Disp   *ExprNode // Offset when it is an expression
 	Line   int
 	Column int
 }
@@ -111,11 +115,14 @@ type IdentifierNode struct {
 
 func (IdentifierNode) isOperand() {}
 
-// Add BinaryOpNode definition here for use by ASTBuilder and codegen
-type BinaryOpNode struct {
-	Left   OperandNode
-	Op     string
-	Right  OperandNode
+// ExprNode represents a constant expression operand
+// e.g., table+2*4 or HIGH($)
+type ExprNode struct {
+	Text   string // The expression as written
 	Line   int
 	Column int
+
+	expr expr // Parsed form, see parsed
 }
+
+func (ExprNode) isOperand() {}
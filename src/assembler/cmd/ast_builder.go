@@ -29,7 +29,37 @@ func BuildAST(tree antlr.ParseTree) *AST {
 	return nil
 }
 
+// Visit dispatches to the matching Visit* method. The generated parser was
+// built without -visitor, so the contexts have no Accept methods of their own.
 func (b *ASTBuilder) Visit(tree antlr.ParseTree) interface{} {
+	switch ctx := tree.(type) {
+	case *parser.ProgramContext:
+		return b.VisitProgram(ctx)
+	case *parser.LineContext:
+		return b.VisitLine(ctx)
+	case *parser.LabelContext:
+		return b.VisitLabel(ctx)
+	case *parser.InstructionContext:
+		return b.VisitInstruction(ctx)
+	case *parser.DirectiveContext:
+		return b.VisitDirective(ctx)
+	case *parser.LabelledDirectiveContext:
+		return b.VisitLabelledDirective(ctx)
+	case *parser.VliwInstructionContext:
+		return b.VisitVliwInstruction(ctx)
+	case *parser.OperandContext:
+		return b.VisitOperand(ctx)
+	case *parser.RegisterContext:
+		return b.VisitRegister(ctx)
+	case *parser.ImmediateContext:
+		return b.VisitImmediate(ctx)
+	case *parser.MemoryOperandContext:
+		return b.VisitMemoryOperand(ctx)
+	case *parser.DataListContext:
+		return b.VisitDataList(ctx)
+	case *parser.DataItemContext:
+		return b.VisitDataItem(ctx)
+	}
 	return tree.Accept(b)
 }
 
@@ -71,7 +101,13 @@ func (b *ASTBuilder) VisitLine(ctx *parser.LineContext) interface{} {
 			statement = s.(*VLIWInstructionNode)
 		}
 	} else if ctx.LabelledDirective() != nil {
-		if s := b.Visit(ctx.LabelledDirective()); s != nil {
+		ld := ctx.LabelledDirective().(*parser.LabelledDirectiveContext)
+		label = &LabelNode{
+			Name:   ld.IDENTIFIER().GetText(),
+			Line:   ld.IDENTIFIER().GetSymbol().GetLine(),
+			Column: ld.IDENTIFIER().GetSymbol().GetColumn(),
+		}
+		if s := b.Visit(ld); s != nil {
 			statement = s.(*DirectiveNode)
 		}
 	}
@@ -113,14 +149,9 @@ func (b *ASTBuilder) VisitInstruction(ctx *parser.InstructionContext) interface{
 }
 
 func (b *ASTBuilder) VisitDirective(ctx *parser.DirectiveContext) interface{} {
-	name := ctx.GetText()
+	name := ctx.GetStart().GetText()
 	params := []OperandNode{}
-	if ctx.Immediate() != nil {
-		params = append(params, b.Visit(ctx.Immediate()).(OperandNode))
-	}
-	if ctx.DataList() != nil {
-		params = append(params, b.Visit(ctx.DataList()).([]OperandNode)...)
-	}
+	// The identifier comes first so that .EQU yields [name, value]
 	if ctx.IDENTIFIER() != nil {
 		params = append(params, &IdentifierNode{
 			Name:   ctx.IDENTIFIER().GetText(),
@@ -128,6 +159,12 @@ func (b *ASTBuilder) VisitDirective(ctx *parser.DirectiveContext) interface{} {
 			Column: ctx.IDENTIFIER().GetSymbol().GetColumn(),
 		})
 	}
+	if ctx.Immediate() != nil {
+		params = append(params, b.Visit(ctx.Immediate()).(OperandNode))
+	}
+	if ctx.DataList() != nil {
+		params = append(params, b.Visit(ctx.DataList()).([]OperandNode)...)
+	}
 	if ctx.STRING() != nil {
 		params = append(params, &ImmediateNode{
 			Value:  ctx.STRING().GetText(),
@@ -143,6 +180,12 @@ func (b *ASTBuilder) VisitDirective(ctx *parser.DirectiveContext) interface{} {
 	}
 }
 
+// VisitLabelledDirective returns the directive of a "name: .DW ..." line.
+// The label itself is picked up by VisitLine.
+func (b *ASTBuilder) VisitLabelledDirective(ctx *parser.LabelledDirectiveContext) interface{} {
+	return b.Visit(ctx.Directive())
+}
+
 func (b *ASTBuilder) VisitVliwInstruction(ctx *parser.VliwInstructionContext) interface{} {
 	instructions := []*InstructionNode{}
 	for _, instrCtx := range ctx.AllInstruction() {
@@ -173,43 +216,11 @@ func (b *ASTBuilder) VisitOperand(ctx *parser.OperandContext) interface{} {
 			Column: ctx.IDENTIFIER(0).GetSymbol().GetColumn(),
 		}
 	}
-	// Handle binary operations
+	// "a+b" forms; rewriteExpressions normally turns these into
+	// expressions before parsing
 	if ctx.PLUS() != nil {
-		var left OperandNode
-		var right OperandNode
-		if len(ctx.AllIDENTIFIER()) > 0 {
-			left = &IdentifierNode{
-				Name:   ctx.IDENTIFIER(0).GetText(),
-				Line:   ctx.IDENTIFIER(0).GetSymbol().GetLine(),
-				Column: ctx.IDENTIFIER(0).GetSymbol().GetColumn(),
-			}
-		} else if len(ctx.AllImmediate()) > 0 {
-			left = b.Visit(ctx.Immediate(0)).(OperandNode)
-		}
-		if len(ctx.AllIDENTIFIER()) > 1 {
-			right = &IdentifierNode{
-				Name:   ctx.IDENTIFIER(1).GetText(),
-				Line:   ctx.IDENTIFIER(1).GetSymbol().GetLine(),
-				Column: ctx.IDENTIFIER(1).GetSymbol().GetColumn(),
-			}
-		} else if len(ctx.AllImmediate()) > 1 {
-			right = b.Visit(ctx.Immediate(1)).(OperandNode)
-		} else if len(ctx.AllImmediate()) > 0 && len(ctx.AllIDENTIFIER()) > 0 {
-			if left == nil {
-				left = b.Visit(ctx.Immediate(0)).(OperandNode)
-			}
-			if right == nil {
-				right = &IdentifierNode{
-					Name:   ctx.IDENTIFIER(0).GetText(),
-					Line:   ctx.IDENTIFIER(0).GetSymbol().GetLine(),
-					Column: ctx.IDENTIFIER(0).GetSymbol().GetColumn(),
-				}
-			}
-		}
-		return &BinaryOpNode{
-			Left:   left,
-			Op:     "+",
-			Right:  right,
+		return &ExprNode{
+			Text:   ctx.GetText(),
 			Line:   ctx.GetStart().GetLine(),
 			Column: ctx.GetStart().GetColumn(),
 		}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Automatic VLIW bundling.
+//
+// Inside a packing region (the whole program with the -autopack flag, or the
+// lines between .AUTOPACK and .ENDPACK) runs of plain instructions are packed
+// into bundles. A run ends at a label, a directive, a hand-written bundle, a
+// line carrying a pragma, and after a control operation, so that no
+// instruction moves across a branch target or a branch.
+//
+// Within a run the packer fills one bundle at a time, starting with the
+// oldest unpacked instruction and trying the following ones in order. An
+// instruction may join the bundle ahead of instructions it skips only if it
+// has no register dependency (read-after-write, write-after-read or
+// write-after-write) on them, is not a memory operation passing another one,
+// and is not a control operation. The bundle itself must pass checkBundle.
+// Groups of one instruction stay plain instructions.
+//
+// Jumps and conditional branches placed in a bundle are moved out of it again
+// by layout if they need relaxing, since long branches do not fit a slot.
+
+// PackStats reports the result of packing one region.
+type PackStats struct {
+	StartLine    int
+	EndLine      int
+	Instructions int // Plain instructions in the region
+	Bundles      int // Bundles formed
+	Singles      int // Instructions left unbundled
+}
+
+// Issues is the number of issue cycles the region takes: one per bundle or
+// single instruction.
+func (s PackStats) Issues() int { return s.Bundles + s.Singles }
+
+// Utilization is the fraction of issued slots that hold an instruction.
+func (s PackStats) Utilization() float64 {
+	if s.Issues() == 0 {
+		return 0
+	}
+	return float64(s.Instructions) / float64(s.Issues()*VLIWSlots)
+}
+
+func (s PackStats) String() string {
+	return fmt.Sprintf("lines %d-%d: %d instructions in %d bundles and %d single slots, %d/%d issue slots used (%.1f%%)",
+		s.StartLine, s.EndLine, s.Instructions, s.Bundles, s.Singles, s.Instructions, s.Issues()*VLIWSlots, 100*s.Utilization())
+}
+
+// packItem is an instruction considered by the packer.
+type packItem struct {
+	line *LineNode
+	slot bundleSlot
+}
+
+// conflicts reports whether later may not be moved ahead of earlier.
+func (later packItem) conflicts(earlier packItem) bool {
+	if isControlOp(later.slot.desc, later.slot.writes) || isControlOp(earlier.slot.desc, earlier.slot.writes) {
+		return true
+	}
+	if isMemoryOp(later.slot.desc) && isMemoryOp(earlier.slot.desc) {
+		return true
+	}
+	return overlaps(later.slot.reads, earlier.slot.writes) ||
+		overlaps(later.slot.writes, earlier.slot.reads) ||
+		overlaps(later.slot.writes, earlier.slot.writes)
+}
+
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// autoPack returns a copy of ast in which the instructions of packing
+// regions are grouped into bundles. The statistics of every region are
+// recorded in cg.Packing.
+func (cg *CodeGenerator) autoPack(ast *AST) (*AST, error) {
+	cg.Packing = nil
+	out := &AST{Program: &ProgramNode{}}
+	var (
+		run      []packItem
+		pending  []*LineNode // comment lines inside the current run
+		region   *PackStats
+		explicit bool
+	)
+	flush := func() {
+		out.Program.Lines = append(out.Program.Lines, pending...)
+		pending = nil
+		for _, group := range packRun(run) {
+			if len(group) == 1 {
+				out.Program.Lines = append(out.Program.Lines, group[0].line)
+				region.Singles++
+				continue
+			}
+			first := group[0].line
+			vliw := &VLIWInstructionNode{Line: first.Line, Column: first.Column, Auto: true}
+			for _, it := range group {
+				vliw.Instructions = append(vliw.Instructions, it.line.Statement.(*InstructionNode))
+			}
+			out.Program.Lines = append(out.Program.Lines, &LineNode{Statement: vliw, Line: first.Line, Column: first.Column})
+			region.Bundles++
+		}
+		run = nil
+	}
+	open := func(line int) {
+		region = &PackStats{StartLine: line}
+	}
+	closeRegion := func(line int) {
+		flush()
+		region.EndLine = line
+		cg.Packing = append(cg.Packing, *region)
+		region = nil
+	}
+	if cg.AutoPack {
+		open(1)
+	}
+	last := 0
+	for _, line := range ast.Program.Lines {
+		last = line.Line
+		p, isPragma := parsePragma(line)
+		switch {
+		case isPragma && p.Name == "autopack":
+			if explicit {
+				return nil, fmt.Errorf(".AUTOPACK at line %d: already inside a packing region", line.Line)
+			}
+			explicit = true
+			if region == nil {
+				open(line.Line)
+			}
+			continue
+		case isPragma && p.Name == "endpack":
+			if !explicit {
+				return nil, fmt.Errorf(".ENDPACK at line %d without .AUTOPACK", line.Line)
+			}
+			explicit = false
+			if !cg.AutoPack {
+				closeRegion(line.Line)
+			}
+			continue
+		}
+		if region == nil {
+			out.Program.Lines = append(out.Program.Lines, line)
+			continue
+		}
+		instr, ok := line.Statement.(*InstructionNode)
+		if line.Statement == nil && line.Label == nil && !isPragma {
+			pending = append(pending, line) // comment or blank line
+			continue
+		}
+		if !ok || line.Label != nil || isPragma {
+			flush()
+			out.Program.Lines = append(out.Program.Lines, line)
+			continue
+		}
+		region.Instructions++
+		desc, known := LookupInstr(instr.Mnemonic)
+		if !known || len(instr.Operands) != len(desc.Operands) {
+			// Left alone for the encoder to diagnose.
+			flush()
+			out.Program.Lines = append(out.Program.Lines, line)
+			region.Singles++
+			continue
+		}
+		reads, writes := registerEffects(instr, desc)
+		item := packItem{line: line, slot: bundleSlot{instr: instr, desc: desc, reads: reads, writes: writes}}
+		run = append(run, item)
+		if isControlOp(desc, writes) {
+			flush()
+		}
+	}
+	if explicit && !cg.AutoPack {
+		return nil, fmt.Errorf(".AUTOPACK at line %d is never closed by .ENDPACK", region.StartLine)
+	}
+	if region != nil {
+		closeRegion(last)
+	}
+	return out, nil
+}
+
+// packRun splits a run of instructions into bundles.
+func packRun(run []packItem) [][]packItem {
+	var groups [][]packItem
+	done := make([]bool, len(run))
+	for first := 0; first < len(run); first++ {
+		if done[first] {
+			continue
+		}
+		group := []packItem{run[first]}
+		done[first] = true
+	candidates:
+		for c := first + 1; c < len(run) && len(group) < VLIWSlots; c++ {
+			if done[c] {
+				continue
+			}
+			for p := first + 1; p < c; p++ {
+				if !done[p] && run[c].conflicts(run[p]) {
+					continue candidates
+				}
+			}
+			slots := make([]bundleSlot, 0, len(group)+1)
+			for _, it := range group {
+				slots = append(slots, it.slot)
+			}
+			slots = append(slots, run[c].slot)
+			if checkBundle(&VLIWInstructionNode{Line: run[first].line.Line}, slots) != nil {
+				continue
+			}
+			group = append(group, run[c])
+			done[c] = true
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// splitPackedRelaxable moves a jump, branch or memory access that needs
+// relaxing out of an automatically formed bundle. A branch goes on its own
+// line after the rest of the bundle, a memory access before it; the packer
+// only bundles independent operations, so neither order changes the result.
+// It reports whether the program changed.
+func (cg *CodeGenerator) splitPackedRelaxable(ast *AST, i int) bool {
+	vliw, ok := ast.Program.Lines[i].Statement.(*VLIWInstructionNode)
+	if !ok || !vliw.Auto {
+		return false
+	}
+	k := -1
+	for j, instr := range vliw.Instructions {
+		if isRelaxable(instr) && !cg.relaxFits(instr, cg.Layout[i].Addr) {
+			k = j
+			break
+		}
+	}
+	if k < 0 {
+		return false
+	}
+	moved := vliw.Instructions[k]
+	rest := append(vliw.Instructions[:k:k], vliw.Instructions[k+1:]...)
+	var head StatementNode = &VLIWInstructionNode{Instructions: rest, Line: vliw.Line, Column: vliw.Column, Auto: true}
+	if len(rest) == 1 {
+		head = rest[0]
+	}
+	restLine := &LineNode{Statement: head, Line: vliw.Line, Column: vliw.Column}
+	movedLine := &LineNode{Statement: moved, Line: moved.Line, Column: moved.Column}
+	split := []*LineNode{restLine, movedLine}
+	if isFarCandidate(moved) {
+		split = []*LineNode{movedLine, restLine}
+	}
+	lines := ast.Program.Lines
+	lines = append(lines[:i:i], append(split, lines[i+1:]...)...)
+	ast.Program.Lines = lines
+	for j := range cg.Packing {
+		if s := &cg.Packing[j]; moved.Line >= s.StartLine && moved.Line <= s.EndLine {
+			if len(rest) == 1 {
+				s.Bundles--
+				s.Singles += 2
+			} else {
+				s.Singles++
+			}
+		}
+	}
+	return true
+}
+
+// formatPacking renders the packing statistics for verbose output and listings.
+func formatPacking(stats []PackStats) string {
+	var sb strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&sb, "  %s\n", s)
+	}
+	return sb.String()
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAutoPackRegion(t *testing.T) {
+	src := `.AUTOPACK
+ADD T0, T1, T2
+SUB T3, T0, T4
+ADD T5, T5, 1
+LD T6, [TB]
+ST T3, [TB+4]
+ADD T0, T0, 1
+JMP done
+.ENDPACK
+done:
+HALT
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	// ADD T5 and LD are hoisted over SUB, which reads the first ADD's result;
+	// ADD T0 may share SUB's bundle since SUB reads T0 before it is written;
+	// JMP waits for ST, the last instruction it may not pass.
+	want := [][]string{
+		{"ADD T0, T1, T2", "ADD T5, T5, 1", "LD T6, [TB]"},
+		{"SUB T3, T0, T4", "ADD T0, T0, 1", "NOP"},
+		{"ST T3, [TB+4]", "JMP +3", "NOP"},
+		{"HALT"},
+	}
+	words := slotWords(cg.Output)
+	i := 0
+	for b, bundle := range want {
+		for s, text := range bundle {
+			if i >= len(words) {
+				t.Fatalf("output ends at bundle %d slot %d", b, s)
+			}
+			got, err := Disassemble(words[i])
+			if err != nil || got != text {
+				t.Errorf("bundle %d slot %d = %q (%v), want %q", b, s, got, err, text)
+			}
+			i++
+		}
+	}
+	if i != len(words) {
+		t.Errorf("got %d slots, want %d", len(words), i)
+	}
+	if len(cg.Packing) != 1 {
+		t.Fatalf("got %d packing regions, want 1", len(cg.Packing))
+	}
+	st := cg.Packing[0]
+	if st.StartLine != 1 || st.EndLine != 9 || st.Instructions != 7 || st.Bundles != 3 || st.Singles != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+	if s := st.String(); !strings.Contains(s, "7/9 issue slots used (77.8%)") {
+		t.Errorf("stats text = %q", s)
+	}
+}
+
+func TestAutoPackProgram(t *testing.T) {
+	src := `ADD T0, T1, T2
+loop:
+ADD T3, T4, T5
+; counting down
+ADD T6, T6, 1
+BNE T1, 0, loop
+.DW 7
+`
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.AutoPack = true
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	// The label keeps the first ADD out of the loop bundle.
+	if got, want := len(cg.Output), InstrSlotBytes+VLIWSlots*InstrSlotBytes+2; got != want {
+		t.Fatalf("output is %d bytes, want %d", got, want)
+	}
+	if cg.Labels["loop"] != InstrSlotBytes {
+		t.Errorf("loop = 0x%X, want 0x4", cg.Labels["loop"])
+	}
+	if len(cg.Packing) != 1 || cg.Packing[0].Bundles != 1 || cg.Packing[0].Singles != 1 {
+		t.Errorf("stats = %+v", cg.Packing)
+	}
+}
+
+func TestAutoPackRelaxedBranch(t *testing.T) {
+	src := `.AUTOPACK
+ADD T0, T1, T2
+BEQ T3, 0, far
+.ENDPACK
+.SPACE 4200
+far:
+HALT
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 1 {
+		t.Fatalf("got %d relaxations, want 1", len(cg.Relaxations))
+	}
+	if st := cg.Packing[0]; st.Bundles != 0 || st.Singles != 2 {
+		t.Errorf("stats = %+v, want the branch split out of its bundle", st)
+	}
+	if cg.Labels["far"] != 4*InstrSlotBytes+4200 {
+		t.Errorf("far = 0x%X", cg.Labels["far"])
+	}
+}
+
+func TestAutoPackStackOps(t *testing.T) {
+	src := `.AUTOPACK
+PUSH T1
+CALL sub
+POP T1
+RET
+.ENDPACK
+sub:
+HALT
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	// CALL and RET push and pop through TB like PUSH and POP, so no two of
+	// them may share a bundle.
+	if st := cg.Packing[0]; st.Bundles != 0 || st.Singles != 4 {
+		t.Errorf("stats = %+v, want every stack operation in a bundle of its own", st)
+	}
+}
+
+func TestAutoPackFarAccess(t *testing.T) {
+	src := `.AUTOPACK
+ADD T0, T1, T2
+LD T3, far
+.ENDPACK
+.SPACE 1024
+far: .DW 1
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 1 || !cg.Relaxations[0].Far || cg.Relaxations[0].Addr != 0 {
+		t.Fatalf("relaxations = %v, want one far access at 0x0", cg.Relaxations)
+	}
+	if st := cg.Packing[0]; st.Bundles != 0 || st.Singles != 2 {
+		t.Errorf("stats = %+v, want the access split out of its bundle", st)
+	}
+	if w := slotWords(cg.Output)[4]; w.Opcode != 0x01 || w.Rd != 0 || w.Type != OpTypeALU {
+		t.Errorf("slot after the far access = %+v, want ADD T0, T1, T2", w)
+	}
+}
+
+func TestAutoPackErrors(t *testing.T) {
+	for _, c := range []struct{ src, wantErr string }{
+		{"NOP\n.ENDPACK\n", ".ENDPACK at line 2 without .AUTOPACK"},
+		{".AUTOPACK\nNOP\n", ".AUTOPACK at line 1 is never closed"},
+		{".AUTOPACK\n.AUTOPACK\n.ENDPACK\n", ".AUTOPACK at line 2: already inside a packing region"},
+	} {
+		if _, err := assembleSource(t, c.src); err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/antlr4-go/antlr/v4"
 	parser "github.com/kvany/vtx1/assembler/grammar"
@@ -22,12 +24,34 @@ func ShowUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  vtx1asm [options] input.asm")
 	fmt.Println("\nOptions:")
-	fmt.Println("  --wordsize=8|36|108|ternary   Output word size/format (default: 8-bit bytes)")
+	fmt.Println("  --wordsize=8|36|36be|108      Output word size/format (default: 8-bit bytes)")
+	fmt.Println("  --autopack                    Pack sequential instructions into VLIW bundles")
+	fmt.Println("  --hazards=warn|nop|error      Handling of pipeline hazards (default: warn)")
+	fmt.Println("  --wcet                        Report the worst-case execution time of every routine")
+	fmt.Println("  --addrunit=byte|word|tritword What one address names (default: byte)")
+	fmt.Println("  --arith=binary|ternary        Arithmetic of constant expressions (default: binary)")
+	fmt.Println("  -I DIR                        Search DIR for .INCLUDE files (repeatable)")
+	fmt.Println("  --deps=FILE                   Write the output's dependencies on source files as a make rule")
+	fmt.Println("  -D NAME[=VALUE]               Predefine a constant for .IF and .IFDEF (repeatable, default value 1)")
 	// The actual flag.PrintDefaults() should be called from main
 }
 
+// Options holds the assembler settings that select optional processing.
+type Options struct {
+	AutoPack bool       // Pack the whole program into VLIW bundles (-autopack)
+	Hazards  HazardMode // Handling of pipeline hazards (-hazards)
+	WCET     bool       // Run the worst-case execution time analysis (-wcet)
+	AddrUnit AddrUnit   // What one address names (-addrunit)
+	Arith    ArithMode  // Arithmetic of constant expressions (-arith)
+
+	IncludePaths []string // Directories searched for .INCLUDE files (-I)
+	DepsFile     string   // Write the build dependencies here (-deps)
+
+	Defines map[string]int64 // Constants predefined with -D
+}
+
 // RunAssembler is the main entry point for assembling a file
-func RunAssembler(inputFile, outputFile, listingFile, format string, verbose bool, errorsFile string, wordSize string) error {
+func RunAssembler(inputFile, outputFile, listingFile, format string, verbose bool, errorsFile string, wordSize string, opts Options) error {
 	// Default output file is input file with .bin extension
 	if outputFile == "" {
 		baseName := filepath.Base(inputFile)
@@ -35,7 +59,7 @@ func RunAssembler(inputFile, outputFile, listingFile, format string, verbose boo
 		nameWithoutExt := baseName[:len(baseName)-len(ext)]
 		outputFile = nameWithoutExt + ".bin"
 	}
-	return assembleFile(inputFile, outputFile, listingFile, format, verbose, errorsFile, wordSize)
+	return assembleFile(inputFile, outputFile, listingFile, format, verbose, errorsFile, wordSize, opts)
 }
 
 // CompilationContext holds state and outputs from each compilation stage
@@ -44,10 +68,12 @@ type CompilationContext struct {
 	SourceCode   string // Source code content
 	Verbose      bool   // Verbose output enabled
 	OutputFormat string // Output format
+	Options      Options
 
 	// Error handling
 	ErrorManager *ErrorManager     // Centralized error management system
 	SourceMap    map[string]string // Maps filenames to source content for error reporting
+	Includes     []string          // Files included by the source, in the order first included
 
 	// ANTLR-generated lexer and parser
 	Tree antlr.ParseTree // Parse tree from ANTLR
@@ -59,8 +85,17 @@ type CompilationContext struct {
 	SymbolTable *SymbolTable
 
 	// Code generation outputs
-	MachineCode []byte            // Generated machine code
-	Symbols     map[string]uint32 // Symbol table for debugging
+	MachineCode []byte          // Generated machine code
+	Memory      *MemoryImage    // Generated code and data by segment
+	Image       []MachineWord   // Generated program as 36-bit words
+	ImageErr    error           // Why Image does not match the addresses, if it does not
+	Symbols     map[string]Addr // Symbol table for debugging
+	Listing     []ListingLine   // Per-line addresses and bytes for the listing
+	Relaxations []Relaxation    // Branches emitted in their long form
+	Packing     []PackStats     // Automatic bundling statistics per region
+	Pipelines   []PipelineStats // Software-pipelined loops
+	Hazards     []Hazard        // Pipeline hazards found
+	Timing      []RoutineTiming // Worst-case execution time per routine
 }
 
 // Minimal stub for ErrorManager
@@ -103,15 +138,25 @@ func (em *ErrorManager) HasWarnings() bool {
 // PrintErrorWithSource prints an error message with the offending source line and a caret under the error column, if possible.
 func PrintErrorWithSource(err error, ctx *CompilationContext) {
 	errStr := err.Error()
+	// Errors in included files start with the file name
+	file, msg := "", errStr
+	if ctx != nil {
+		file = ctx.SourceFile
+		for _, inc := range ctx.Includes {
+			if strings.HasPrefix(errStr, inc+": ") {
+				file, msg = inc, strings.TrimPrefix(errStr, inc+": ")
+			}
+		}
+	}
 	// Try to extract line and column from error string (format: ... at line X:Y ...)
 	var line, col int
 	found := false
-	_, _ = fmt.Sscanf(errStr, "%*[^l]line %d:%d", &line, &col)
+	_, _ = fmt.Sscanf(msg, "%*[^l]line %d:%d", &line, &col)
 	if line > 0 {
 		found = true
 	}
 	if found && ctx != nil && ctx.SourceMap != nil {
-		src, ok := ctx.SourceMap[ctx.SourceFile]
+		src, ok := ctx.SourceMap[file]
 		if ok {
 			lines := splitLines(src)
 			if line-1 >= 0 && line-1 < len(lines) {
@@ -157,7 +202,7 @@ func splitLines(s string) []string {
 }
 
 // assembleFile processes the input file and generates the output binary
-func assembleFile(inputFile, outputFile, listingFile, format string, verbose bool, errorsFile string, wordSize string) error {
+func assembleFile(inputFile, outputFile, listingFile, format string, verbose bool, errorsFile string, wordSize string, opts Options) error {
 	fmt.Println("[DEBUG] Entered assembleFile")
 	// Read the source file
 	source, err := ioutil.ReadFile(inputFile)
@@ -183,6 +228,7 @@ func assembleFile(inputFile, outputFile, listingFile, format string, verbose boo
 		SourceCode:   string(source),
 		Verbose:      verbose,
 		OutputFormat: format,
+		Options:      opts,
 		ErrorManager: errorManager,
 		SourceMap:    sourceMap,
 		SymbolTable:  NewSymbolTable(),
@@ -216,30 +262,13 @@ func assembleFile(inputFile, outputFile, listingFile, format string, verbose boo
 	}
 	fmt.Println("[DEBUG] Parsing complete.")
 
-	// Stage 2.5: Symbol Table Population (First Pass)
-	if verbose {
-		fmt.Println("Stage 2.5: Symbol Table Population")
-	}
-	fmt.Println("[DEBUG] Starting symbol pass...")
-	if err := runSymbolPass(ctx); err != nil {
-		PrintErrorWithSource(err, ctx)
-		fmt.Println("[DEBUG] Symbol pass failed.")
-		return fmt.Errorf("symbol resolution failed: %v", err)
-	}
-	fmt.Println("[DEBUG] Symbol pass complete.")
-
-	// After all passes, check for unused labels and add warnings
-	for _, sym := range ctx.SymbolTable.UnusedLabels() {
-		msg := fmt.Sprintf("warning: label '%s' defined at %s:%d:%d is never used", sym.Name, sym.File, sym.Line, sym.Column)
-		errorManager.Warnings = append(errorManager.Warnings, fmt.Errorf(msg))
-	}
-
 	// Print warnings with source lines if any
 	if errorManager.HasWarnings() {
 		for _, warn := range errorManager.Warnings {
 			PrintErrorWithSource(warn, ctx)
 		}
 	}
+	printedWarnings := len(errorManager.Warnings)
 
 	// Stage 3: Code Generation
 	if verbose {
@@ -253,15 +282,31 @@ func assembleFile(inputFile, outputFile, listingFile, format string, verbose boo
 	}
 	fmt.Println("[DEBUG] Code generation complete.")
 
+	// After all passes, check for unused labels and add warnings
+	for _, sym := range ctx.SymbolTable.UnusedLabels() {
+		errorManager.Warnings = append(errorManager.Warnings, fmt.Errorf("warning: label '%s' defined at %s:%d:%d is never used", sym.Name, sym.File, sym.Line, sym.Column))
+	}
+
+	// Print the warnings raised during code generation and symbol checks
+	for _, warn := range errorManager.Warnings[printedWarnings:] {
+		PrintErrorWithSource(warn, ctx)
+	}
+
 	// Write output based on format
 	fmt.Printf("[DEBUG] MachineCode length before writeOutput: %d bytes\n", len(ctx.MachineCode))
-	if err := writeOutput(ctx.MachineCode, outputFile, format, wordSize); err != nil {
+	if err := writeOutput(ctx, outputFile, format, wordSize); err != nil {
 		return fmt.Errorf("failed to write output: %v", err)
 	}
 
+	if opts.DepsFile != "" {
+		if err := writeDeps(ctx, outputFile, opts.DepsFile); err != nil {
+			return fmt.Errorf("failed to write dependencies: %v", err)
+		}
+	}
+
 	// Generate a listing file if requested
 	if listingFile != "" {
-		if err := generateListing(source, ctx.Tree, ctx.MachineCode, listingFile); err != nil {
+		if err := generateListing(source, ctx, listingFile); err != nil {
 			return fmt.Errorf("failed to generate listing: %v", err)
 		}
 
@@ -281,14 +326,30 @@ func runLexicalAnalysis(ctx *CompilationContext) error {
 
 // runParsing parses the source code and builds the parse tree
 func runParsing(ctx *CompilationContext) error {
-	input := antlr.NewInputStream(ctx.SourceCode)
+	src, source, err := expandIncludes(ctx)
+	var cond *conditions
+	if err == nil {
+		src, source, cond, err = expandConditionals(src, source, ctx.Options)
+	}
+	if err == nil {
+		src, source, err = expandMacros(src, source, cond)
+	}
+	if err != nil {
+		ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
+		return err
+	}
+	src, locals := rewriteLocalLabels(rewritePragmaDirectives(src), source)
+	src, exprs := rewriteExpressions(src)
+	input := antlr.NewInputStream(src)
 	lexer := parser.Newvtx1_grammarLexer(input)
 	tokens := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
 	p := parser.Newvtx1_grammarParser(tokens)
 
 	// Remove default error listener and add our custom one
 	p.RemoveErrorListeners()
-	p.AddErrorListener(NewCustomErrorListener(ctx.ErrorManager))
+	listener := NewCustomErrorListener(ctx.ErrorManager)
+	listener.Source = source
+	p.AddErrorListener(listener)
 
 	ctx.Tree = p.Program()
 
@@ -318,67 +379,13 @@ func runParsing(ctx *CompilationContext) error {
 		ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
 		return err
 	}
-	return nil
-}
-
-// runSymbolPass performs the first pass of assembly: populating the symbol table.
-func runSymbolPass(ctx *CompilationContext) error {
-	var currentAddress uint32 = 0 // Start at address 0, can be changed by .ORG
-
-	for _, line := range ctx.AST.Program.Lines {
-		// If there's a label, define it in the symbol table with the current address.
-		if line.Label != nil {
-			_, err := ctx.SymbolTable.Define(line.Label.Name, currentAddress, ctx.SourceFile, line.Label.Line, line.Label.Column)
-			if err != nil {
-				// Add the detailed error to the ErrorManager
-				ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
-			}
-		}
-
-		// Advance the address based on the statement type.
-		if line.Statement != nil {
-			switch s := line.Statement.(type) {
-			case *InstructionNode:
-				// Standard instructions are 1 word (e.g., 4 bytes in a 32-bit model)
-				// This is a placeholder size.
-				currentAddress += 4
-			case *VLIWInstructionNode:
-				// VLIW are larger, e.g., 12 bytes. Placeholder size.
-				currentAddress += 12
-			case *DirectiveNode:
-				// Handle directives that affect the address counter.
-				switch s.Name {
-				case ".ORG":
-					// Placeholder: need to parse immediate value
-					// val, _ := parseImmediate(s.Params[0])
-					// currentAddress = val
-				case ".DB", ".DW", ".DT":
-					// Placeholder: need to calculate size of data
-					// currentAddress += calculateDataSize(s)
-				case ".SPACE":
-					// Placeholder: need to parse immediate value
-					// val, _ := parseImmediate(s.Params[0])
-					// currentAddress += val
-				}
-			}
-		}
-	}
-
-	// After the pass, check for any undefined symbols that were referenced.
-	// Note: References aren't tracked yet, this is just a check for definition.
-	undefinedSymbols := ctx.SymbolTable.AllUndefined()
-	if len(undefinedSymbols) > 0 {
-		for _, s := range undefinedSymbols {
-			// This error should be more specific, with line numbers of references.
-			err := fmt.Errorf("undefined symbol: %s", s.Name)
-			ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
-		}
-	}
-
-	if ctx.ErrorManager.HasErrors() {
-		return fmt.Errorf("errors found during symbol pass")
+	attachExpressions(ctx.AST, exprs)
+	qualifyLabels(ctx.AST, locals)
+	remapLines(ctx.AST, source)
+	if err := checkExpressions(ctx.AST); err != nil {
+		ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
+		return err
 	}
-
 	return nil
 }
 
@@ -391,50 +398,91 @@ func runCodeGeneration(ctx *CompilationContext) error {
 	fmt.Printf("[DEBUG] AST before code generation: %+v\n", ctx.AST)
 
 	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.AutoPack = ctx.Options.AutoPack
+	cg.Hazards = ctx.Options.Hazards
+	cg.WCET = ctx.Options.WCET
+	cg.AddrUnit = ctx.Options.AddrUnit
+	cg.Arith = ctx.Options.Arith
+	cg.Defines = ctx.Options.Defines
+	cg.File = ctx.SourceFile
 	if err := cg.Generate(ctx.AST); err != nil {
 		ctx.ErrorManager.Errors = append(ctx.ErrorManager.Errors, err)
 		return fmt.Errorf("code generation failed: %v", err)
 	}
 	ctx.MachineCode = cg.Output
+	ctx.Listing = cg.Listing
+	ctx.Image, ctx.ImageErr = cg.Image, cg.ImageErr
+	ctx.Memory = cg.Memory
+	ctx.Symbols = cg.Labels
+	ctx.Relaxations = cg.Relaxations
+	ctx.Packing = cg.Packing
+	ctx.Pipelines = cg.Pipelines
+	ctx.Hazards = cg.HazardReport
+	ctx.Timing = cg.Timing
 
 	if ctx.Verbose {
 		fmt.Printf("Generated %d bytes of machine code.\n", len(ctx.MachineCode))
+		for _, r := range ctx.Relaxations {
+			fmt.Printf("Relaxed: %s\n", r)
+		}
+		if len(ctx.Packing) > 0 {
+			fmt.Print("Automatic bundling:\n" + formatPacking(ctx.Packing))
+		}
+		if len(ctx.Pipelines) > 0 {
+			fmt.Print("Software pipelining:\n" + formatPipelines(ctx.Pipelines))
+		}
+		if len(ctx.Hazards) > 0 {
+			fmt.Print("Pipeline hazards:\n" + formatHazards(ctx.Hazards, ctx.Options.Hazards))
+		}
+	}
+	if ctx.Options.WCET {
+		fmt.Print("Worst-case execution time:\n" + formatTiming(ctx.Timing))
 	}
 
 	return nil
 }
 
-// writeOutput writes the generated binary to the specified file
-func writeOutput(binary []byte, outputFile, format, wordSize string) error {
+// writeOutput writes the generated program to the specified file. Word size 8
+// writes the byte stream; 36, 36be and 108 serialize the word image.
+// "ternary" is the former name of 36be.
+func writeOutput(ctx *CompilationContext, outputFile, format, wordSize string) error {
+	var pack func([]MachineWord) []byte
 	switch wordSize {
 	case "8":
-		fmt.Printf("[DEBUG] writeOutput: writing %d bytes (8-bit)\n", len(binary))
-		return writeOutput8(binary, outputFile, format)
+		fmt.Printf("[DEBUG] writeOutput: writing %d bytes (8-bit)\n", len(ctx.MachineCode))
+		return writeOutput8(ctx.MachineCode, hexSegments(ctx.Memory), outputFile, format)
 	case "36":
-		packed := pack36BitWords(binary)
-		fmt.Printf("[DEBUG] writeOutput: writing %d bytes (36-bit packed)\n", len(packed))
-		return writeOutput8(packed, outputFile, format)
+		pack = pack36BitWords
+	case "36be", "ternary":
+		pack = pack36BitWordsBE
 	case "108":
-		packed := pack108BitWords(binary)
-		fmt.Printf("[DEBUG] writeOutput: writing %d bytes (108-bit packed)\n", len(packed))
-		return writeOutput8(packed, outputFile, format)
-	case "ternary":
-		packed := packTernary(binary)
-		fmt.Printf("[DEBUG] writeOutput: writing %d bytes (ternary packed)\n", len(packed))
-		return writeOutput8(packed, outputFile, format)
 	default:
 		return fmt.Errorf("unsupported word size: %s", wordSize)
 	}
+	if ctx.ImageErr != nil {
+		return fmt.Errorf("cannot write %s words: %v", wordSize, ctx.ImageErr)
+	}
+	var packed []byte
+	var blocks []hexBlock
+	if pack != nil {
+		packed, blocks = pack(ctx.Image), wordHexSegments(ctx.Memory, ctx.Image, pack)
+	} else {
+		var unitOf []int
+		packed, unitOf = pack108BitWords(ctx.Image, ctx.Memory.UnitStarts())
+		blocks = unitHexSegments(ctx.Memory, packed, unitOf)
+	}
+	fmt.Printf("[DEBUG] writeOutput: writing %d bytes (%d words, %s)\n", len(packed), len(ctx.Image), wordSize)
+	return writeOutput8(packed, blocks, outputFile, format)
 }
 
-// writeOutput8 is the existing logic for 8-bit output
-func writeOutput8(binary []byte, outputFile, format string) error {
+// writeOutput8 writes bytes in the requested format; Intel HEX places blocks
+// at their addresses, the other formats write binary.
+func writeOutput8(binary []byte, blocks []hexBlock, outputFile, format string) error {
 	switch format {
 	case "binary":
 		return ioutil.WriteFile(outputFile, binary, 0644)
 	case "hex":
-		// TODO: Implement real Intel HEX output. Current implementation is a placeholder.
-		hexData := formatAsHex(binary)
+		hexData := formatAsHex(blocks)
 		return ioutil.WriteFile(outputFile, []byte(hexData), 0644)
 	case "objdump":
 		// TODO: Implement real objdump output. Current implementation is a placeholder.
@@ -445,130 +493,96 @@ func writeOutput8(binary []byte, outputFile, format string) error {
 	}
 }
 
-// pack36BitWords packs every 36 bits into 5 bytes (last 4 bits zeroed if needed)
-func pack36BitWords(data []byte) []byte {
-	var out []byte
-	for i := 0; i+4 < len(data); i += 4 {
-		// Take 4 bytes (32 bits)
-		b0 := data[i]
-		b1 := data[i+1]
-		b2 := data[i+2]
-		b3 := data[i+3]
-		var b4 byte = 0
-		if i+4 < len(data) {
-			b4 = data[i+4] & 0x0F // Only lower 4 bits for 36th-39th bits
-		}
-		out = append(out, b0, b1, b2, b3, b4)
-	}
-	// Handle trailing bytes (if any)
-	rest := len(data) % 4
-	if rest > 0 {
-		start := len(data) - rest
-		chunk := make([]byte, 5)
-		copy(chunk, data[start:])
-		out = append(out, chunk...)
-	}
-	return out
+// TODO: Add CLI flag for symbol/debug output (e.g., --symbols)
+// Stub for writing symbol table/debug info
+func writeSymbols(symbols map[string]Addr, outputFile string) error {
+	// TODO: Implement symbol table/debug info output
+	return fmt.Errorf("symbol table/debug info output not implemented yet")
 }
 
-// pack108BitWords packs every 108 bits into 14 bytes
-func pack108BitWords(data []byte) []byte {
-	var out []byte
-	for i := 0; i+12 < len(data); i += 12 {
-		// 12 bytes = 96 bits, need 12 more bits (1.5 bytes)
-		chunk := make([]byte, 14)
-		copy(chunk, data[i:i+12])
-		if i+13 < len(data) {
-			chunk[12] = data[i+12]
-		}
-		if i+14 < len(data) {
-			chunk[13] = data[i+13] & 0x0F // Only lower 4 bits for last nibble
-		}
-		out = append(out, chunk...)
+// hexBlock is a run of bytes at a byte address.
+type hexBlock struct {
+	Addr uint32
+	Data []byte
+}
+
+// hexSegments returns the segments of m as blocks at their byte addresses.
+func hexSegments(m *MemoryImage) []hexBlock {
+	if m == nil {
+		return nil
 	}
-	// Handle trailing bytes (if any)
-	rest := len(data) % 12
-	if rest > 0 {
-		start := len(data) - rest
-		chunk := make([]byte, 14)
-		copy(chunk, data[start:])
-		out = append(out, chunk...)
+	var blocks []hexBlock
+	for _, s := range m.sorted() {
+		blocks = append(blocks, hexBlock{Addr: uint32(s.Addr) * uint32(m.Unit.unitBytes()), Data: s.Data})
 	}
-	return out
+	return blocks
 }
 
-// packTernary packs trits as 2 bits each using VTX1 encoding
-// Each 36-bit word = 18 trits, each trit encoded as 2 bits:
-// 00 = -1, 01 = 0, 10 = +1, 11 = undefined
-func packTernary(data []byte) []byte {
-	var out []byte
-	for i := 0; i+4 < len(data); i += 4 {
-		// Treat 4 bytes as a 32-bit integer, pad with 0 if needed
-		var word uint32 = 0
-		for j := 0; j < 4 && i+j < len(data); j++ {
-			word |= uint32(data[i+j]) << (8 * (3 - j))
-		}
-		// Convert to 18 trits (balanced ternary)
-		trits := intToBalancedTrits(word, 18)
-		// Encode trits as 2 bits each
-		packed := encodeTritsToBytes(trits)
-		out = append(out, packed...)
+// wordHexSegments returns the segments of the word image as blocks packed
+// by pack, 5 bytes per word: every segment at its word address times 5.
+func wordHexSegments(m *MemoryImage, words []MachineWord, pack func([]MachineWord) []byte) []hexBlock {
+	if m == nil {
+		return []hexBlock{{Data: pack(words)}}
+	}
+	var blocks []hexBlock
+	for _, s := range m.sorted() {
+		first := m.wordIndex(s)
+		blocks = append(blocks, hexBlock{Addr: 5 * uint32(m.wordAddr(s)), Data: pack(words[first : first+len(s.Words)])})
 	}
-	return out
+	return blocks
 }
 
-// intToBalancedTrits converts an integer to a slice of n balanced trits (-1,0,+1)
-func intToBalancedTrits(val uint32, n int) []int {
-	trits := make([]int, n)
-	v := int(val)
-	for i := n - 1; i >= 0; i-- {
-		rem := v % 3
-		v /= 3
-		if rem == 2 {
-			trits[i] = -1
-			v += 1
-		} else {
-			trits[i] = rem
-		}
-	}
-	return trits
+// unitHexSegments returns the segments of the 108-bit container packed with
+// the unit of each word in unitOf as blocks of whole units. Units are
+// numbered from the one holding the lowest word address, its word address
+// divided by 3, and every segment is placed at its first unit times 14.
+func unitHexSegments(m *MemoryImage, packed []byte, unitOf []int) []hexBlock {
+	if m == nil {
+		return []hexBlock{{Data: packed}}
+	}
+	segs := m.sorted()
+	if len(segs) == 0 {
+		return nil
+	}
+	base := m.wordAddr(segs[0]) / VLIWSlots
+	var blocks []hexBlock
+	for _, s := range segs {
+		first := m.wordIndex(s)
+		from, to := unitOf[first], unitOf[first+len(s.Words)-1]+1
+		blocks = append(blocks, hexBlock{Addr: unitBytes * uint32(base+from), Data: packed[unitBytes*from : unitBytes*to]})
+	}
+	return blocks
 }
 
-// encodeTritsToBytes encodes 18 trits (-1,0,+1) as 36 bits (5 bytes)
-func encodeTritsToBytes(trits []int) []byte {
-	var bits uint64 = 0
-	for i, t := range trits {
-		var enc uint64
-		switch t {
-		case -1:
-			enc = 0b00
-		case 0:
-			enc = 0b01
-		case 1:
-			enc = 0b10
-		default:
-			enc = 0b11 // undefined
+// formatAsHex formats blocks as Intel HEX: data records of up to 16 bytes,
+// an extended linear address record whenever the upper 16 address bits
+// change, and the end-of-file record.
+func formatAsHex(blocks []hexBlock) string {
+	var sb strings.Builder
+	upper := uint32(0)
+	for _, b := range blocks {
+		for off := 0; off < len(b.Data); {
+			addr := b.Addr + uint32(off)
+			if hi := addr >> 16; hi != upper {
+				hexRecord(&sb, 0, 0x04, []byte{byte(hi >> 8), byte(hi)})
+				upper = hi
+			}
+			n := min(16, len(b.Data)-off, 0x10000-int(addr&0xFFFF))
+			hexRecord(&sb, uint16(addr), 0x00, b.Data[off:off+n])
+			off += n
 		}
-		bits |= (enc << (2 * (17 - i)))
-	}
-	out := make([]byte, 5)
-	for i := 0; i < 5; i++ {
-		out[i] = byte((bits >> (8 * (4 - i))) & 0xFF)
 	}
-	return out
-}
-
-// TODO: Add CLI flag for symbol/debug output (e.g., --symbols)
-// Stub for writing symbol table/debug info
-func writeSymbols(symbols map[string]uint32, outputFile string) error {
-	// TODO: Implement symbol table/debug info output
-	return fmt.Errorf("symbol table/debug info output not implemented yet")
+	hexRecord(&sb, 0, 0x01, nil)
+	return sb.String()
 }
 
-// formatAsHex formats binary data as Intel HEX format
-func formatAsHex(data []byte) string {
-	// Dummy implementation
-	return fmt.Sprintf(":%X\n", data)
+// hexRecord writes one Intel HEX record with its checksum.
+func hexRecord(sb *strings.Builder, addr uint16, typ byte, data []byte) {
+	sum := byte(len(data)) + byte(addr>>8) + byte(addr) + typ
+	for _, c := range data {
+		sum += c
+	}
+	fmt.Fprintf(sb, ":%02X%04X%02X%X%02X\n", len(data), addr, typ, data, -sum)
 }
 
 // formatAsObjDump formats binary data as a simple objdump-like output
@@ -577,8 +591,113 @@ func formatAsObjDump(data []byte) string {
 	return fmt.Sprintf("OBJ DUMP: %X\n", data)
 }
 
+// listingBytesPerRow is the number of code bytes shown on one listing row;
+// longer data is elided after listingMaxRows rows.
+const (
+	listingBytesPerRow = 12
+	listingMaxRows     = 4
+)
+
 // generateListing creates an assembly listing file
-func generateListing(source []byte, tree antlr.ParseTree, binary []byte, listingFile string) error {
-	// Dummy implementation
-	return ioutil.WriteFile(listingFile, []byte("Listing not implemented\n"), 0644)
+func generateListing(source []byte, ctx *CompilationContext, listingFile string) error {
+	lines := strings.Split(strings.ReplaceAll(string(source), "\r\n", "\n"), "\n")
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "VTX1 Assembler v%s listing: %s\n\n", Version, ctx.SourceFile)
+	fmt.Fprintf(&sb, "%-8s  %-36s  %5s  %s\n", "ADDR", "CODE", "LINE", "SOURCE")
+	// Lines of included files are numbered n:line, for the n-th file of the
+	// "Included files" list at the end.
+	files, fileNums := map[string][]string{"": lines}, make(map[string]int)
+	for i, inc := range ctx.Includes {
+		files[inc] = strings.Split(strings.ReplaceAll(ctx.SourceMap[inc], "\r\n", "\n"), "\n")
+		fileNums[inc] = i + 1
+	}
+	for _, l := range ctx.Listing {
+		text := ""
+		if src := files[l.File]; l.Line > 0 && l.Line <= len(src) {
+			text = strings.TrimRight(src[l.Line-1], " \t")
+		}
+		lineNum := fmt.Sprint(l.Line)
+		if l.File != "" {
+			lineNum = fmt.Sprintf("%d:%d", fileNums[l.File], l.Line)
+		}
+		code := l.Code
+		for row := 0; row == 0 || len(code) > 0; row++ {
+			n := len(code)
+			if n > listingBytesPerRow {
+				n = listingBytesPerRow
+			}
+			hex := formatListingBytes(code[:n])
+			addr := l.Addr + Addr(row*listingBytesPerRow/ctx.Options.AddrUnit.unitBytes())
+			if row == 0 {
+				fmt.Fprintf(&sb, "%08X  %-36s  %5s  %s\n", addr, hex, lineNum, text)
+			} else {
+				fmt.Fprintf(&sb, "%08X  %s\n", addr, hex)
+			}
+			code = code[n:]
+			if row+1 == listingMaxRows && len(code) > 0 {
+				fmt.Fprintf(&sb, "%8s  ... %d more bytes\n", "", len(code))
+				break
+			}
+		}
+	}
+	if len(ctx.Symbols) > 0 {
+		sb.WriteString("\nSymbols:\n" + formatSymbols(ctx.Symbols))
+	}
+	if len(ctx.Includes) > 0 {
+		sb.WriteString("\nIncluded files:\n")
+		for i, inc := range ctx.Includes {
+			fmt.Fprintf(&sb, "  %d  %s\n", i+1, inc)
+		}
+	}
+	if len(ctx.Relaxations) > 0 {
+		sb.WriteString("\nRelaxation:\n")
+		for _, r := range ctx.Relaxations {
+			fmt.Fprintf(&sb, "  %s\n", r)
+		}
+	}
+	if len(ctx.Packing) > 0 {
+		sb.WriteString("\nAutomatic bundling:\n" + formatPacking(ctx.Packing))
+	}
+	if len(ctx.Pipelines) > 0 {
+		sb.WriteString("\nSoftware pipelining:\n" + formatPipelines(ctx.Pipelines))
+	}
+	if len(ctx.Hazards) > 0 {
+		sb.WriteString("\nPipeline hazards:\n" + formatHazards(ctx.Hazards, ctx.Options.Hazards))
+	}
+	if len(ctx.Timing) > 0 {
+		sb.WriteString("\nWorst-case execution time:\n" + formatTiming(ctx.Timing))
+	}
+	return ioutil.WriteFile(listingFile, []byte(sb.String()), 0644)
+}
+
+// formatSymbols renders the labels by address for the listing.
+func formatSymbols(symbols map[string]Addr) string {
+	names := make([]string, 0, len(symbols))
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if symbols[names[a]] != symbols[names[b]] {
+			return symbols[names[a]] < symbols[names[b]]
+		}
+		return names[a] < names[b]
+	})
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "  %08X  %s\n", symbols[name], name)
+	}
+	return sb.String()
+}
+
+// formatListingBytes renders code bytes in groups of one instruction slot.
+func formatListingBytes(code []byte) string {
+	var parts []string
+	for i := 0; i < len(code); i += InstrSlotBytes {
+		end := i + InstrSlotBytes
+		if end > len(code) {
+			end = len(code)
+		}
+		parts = append(parts, fmt.Sprintf("%X", code[i:end]))
+	}
+	return strings.Join(parts, " ")
 }
@@ -6,15 +6,56 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/kvany/vtx1/assembler/pkg/ternary"
 )
 
 // CodeGenerator is responsible for traversing the AST and emitting machine code.
 type CodeGenerator struct {
-	Output      []byte
+	Output      []byte       // The memory image flattened from its lowest address
+	Memory      *MemoryImage // Code and data by segment
 	SymbolTable *SymbolTable
-	CurrentAddr uint32
-	Labels      map[string]uint32
-	Equs        map[string]uint32
+	CurrentAddr Addr
+	Labels      map[string]Addr
+	Equs        map[string]int64
+	Listing     []ListingLine // Address and bytes emitted for each source line
+	Relaxations []Relaxation  // Branches and accesses rewritten because their target was out of range
+	AddrUnit    AddrUnit      // What one address names: a byte, a slot or a machine word
+	Image       []MachineWord // The program as 36-bit machine words
+	ImageErr    error         // Why Image cannot hold the program at its addresses, if it cannot
+	Layout      []LinePlace   // Address and size of each AST line, from the final layout pass
+	File        string        // Source file name, recorded with the labels in the symbol table
+
+	AutoPack bool        // Pack the whole program into VLIW bundles, not only .AUTOPACK regions
+	Packing  []PackStats // Result of automatic bundling, one entry per region
+
+	Pipelines []PipelineStats // Schedules of the software-pipelined loops
+
+	Hazards      HazardMode // What to do about pipeline hazards
+	HazardReport []Hazard   // Pipeline hazards found, one entry per waiting operation
+
+	WCET   bool            // Run the worst-case execution time analysis
+	Timing []RoutineTiming // WCET of every routine, by address
+
+	Arith   ArithMode        // Arithmetic of constant expressions
+	Defines map[string]int64 // Constants predefined with -D
+
+	relaxed     map[*InstructionNode]bool // Branches and accesses emitted in their long form
+	fill        int64                     // Value of unwritten addresses, set by .FILL
+	here        Addr                      // Address of the line being laid out or emitted, the value of $
+	sizes       map[string]Addr           // SIZEOF of each label
+	provisional bool                      // Layout pass that may meet symbols defined further down
+	unresolved  bool                      // A provisional evaluation used a symbol not yet defined
+	overflow    bool                      // The expression being folded left the 18-trit range
+	warned      map[string]bool           // Expression warnings already reported
+}
+
+// ListingLine records what a source line assembled to.
+type ListingLine struct {
+	Line int
+	File string // Included file, "" for the source file
+	Addr Addr
+	Code []byte
 }
 
 // NewCodeGenerator creates a new code generator with the given symbol table.
@@ -23,141 +64,121 @@ func NewCodeGenerator(symbolTable *SymbolTable) *CodeGenerator {
 		Output:      make([]byte, 0),
 		SymbolTable: symbolTable,
 		CurrentAddr: 0,
-		Labels:      make(map[string]uint32),
-		Equs:        make(map[string]uint32),
+		Labels:      make(map[string]Addr),
+		Equs:        make(map[string]int64),
 	}
 }
 
-// Pass 1: Collect labels and .EQUs, handle .ORG/.SPACE for address tracking
-func (cg *CodeGenerator) collectSymbols(ast *AST) error {
-	addr := uint32(0)
-	for _, line := range ast.Program.Lines {
-		if line.Label != nil {
-			cg.Labels[line.Label.Name] = addr
-		}
-		if line.Statement == nil {
-			continue
-		}
-		switch stmt := line.Statement.(type) {
-		case *InstructionNode:
-			addr += 4
-		case *VLIWInstructionNode:
-			addr += 12
-		case *DirectiveNode:
-			name := strings.ToUpper(stmt.Name)
-			switch name {
-			case ".ORG":
-				if len(stmt.Params) > 0 {
-					imm, _ := parseImmediateOperand(stmt.Params[0])
-					addr = uint32(imm)
-				}
-			case ".SPACE":
-				if len(stmt.Params) > 0 {
-					imm, _ := parseImmediateOperand(stmt.Params[0])
-					addr += uint32(imm)
-				}
-			case ".DW":
-				addr += 2 * uint32(len(stmt.Params))
-			case ".DB":
-				addr += uint32(len(stmt.Params))
-			case ".EQU":
-				if len(stmt.Params) == 2 {
-					if id, ok := stmt.Params[0].(*IdentifierNode); ok {
-						imm, _ := parseImmediateOperand(stmt.Params[1])
-						cg.Equs[id.Name] = uint32(imm)
-					}
-				}
-			}
-		}
-	}
-	return nil
-}
-
-// Pass 2: Emit code/data, resolving symbols
+// Generate lays out the program and emits its code and data at the places
+// layout gave every line.
 func (cg *CodeGenerator) Generate(ast *AST) error {
 	fmt.Println("[DEBUG] CodeGenerator.Generate called")
 	cg.Output = make([]byte, 0)
+	cg.Memory = NewMemoryImage(cg.AddrUnit)
 	cg.CurrentAddr = 0
-	cg.Labels = make(map[string]uint32)
-	cg.Equs = make(map[string]uint32)
-	if err := cg.collectSymbols(ast); err != nil {
+	cg.Labels = make(map[string]Addr)
+	cg.Equs = make(map[string]int64)
+	for name, v := range cg.Defines {
+		cg.Equs[name] = v
+	}
+	cg.sizes = make(map[string]Addr)
+	cg.warned = nil
+	cg.Listing = nil
+	cg.Relaxations = nil
+	cg.Image, cg.ImageErr = nil, nil
+	ast, err := cg.pipelineLoops(ast)
+	if err != nil {
+		return err
+	}
+	if ast, err = cg.autoPack(ast); err != nil {
+		return err
+	}
+	if ast, err = cg.checkHazards(ast); err != nil {
+		return err
+	}
+	if err := cg.layout(ast); err != nil {
 		return err
 	}
 	cg.CurrentAddr = 0
+	cg.fill = 0
 	for i, line := range ast.Program.Lines {
-		if line.Statement == nil {
-			continue
-		}
-		typeName := reflect.TypeOf(line.Statement)
-		fmt.Printf("[DEBUG] Generate: line %d, reflect.TypeOf=%v, type=%T, label=%v, statement=%#v\n", i, typeName, line.Statement, line.Label, line.Statement)
-		switch stmt := line.Statement.(type) {
-		case *InstructionNode:
-			fmt.Printf("[DEBUG] emitInstruction called: %+v\n", stmt)
-			if err := cg.emitInstruction(stmt); err != nil {
-				return err
-			}
-		case *VLIWInstructionNode:
-			fmt.Printf("[DEBUG] emitVLIWInstruction called: %+v\n", stmt)
-			if err := cg.emitVLIWInstruction(stmt); err != nil {
-				return err
-			}
-		case *DirectiveNode:
-			fmt.Printf("[DEBUG] emitDirective called: %+v\n", stmt)
-			if err := cg.emitDirective(stmt); err != nil {
-				return err
-			}
-		default:
-			fmt.Printf("[DEBUG] Generate: unhandled node type %T\n", stmt)
+		if err := cg.emitLine(i, line); err != nil {
+			return fileError(line.File, err)
 		}
 	}
+	if err := cg.Memory.finish(); err != nil {
+		return err
+	}
+	cg.Output = cg.Memory.Bytes()
+	cg.Image, cg.ImageErr = cg.Memory.Words()
 	fmt.Printf("[DEBUG] CodeGenerator output length: %d bytes\n", len(cg.Output))
+	if cg.WCET {
+		if cg.Timing, err = cg.analyzeTiming(ast); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// --- Instruction Encoding ---
-var opcodeMap = map[string]byte{
-	// ALU
-	"NOP": 0x00, "ADD": 0x01, "SUB": 0x02, "MUL": 0x03, "AND": 0x04, "OR": 0x05, "NOT": 0x06, "XOR": 0x07,
-	"SHL": 0x08, "SHR": 0x09, "ROL": 0x0A, "ROR": 0x0B, "CMP": 0x0C, "TEST": 0x0D, "INC": 0x0E, "DEC": 0x0F, "NEG": 0x10,
-	// MEM
-	"LD": 0x20, "ST": 0x21, "VLD": 0x22, "VST": 0x23, "FLD": 0x24, "FST": 0x25, "LEA": 0x26, "PUSH": 0x27, "POP": 0x28,
-	// CTRL
-	"JMP": 0x30, "JAL": 0x31, "JR": 0x32, "JALR": 0x33, "BEQ": 0x34, "BNE": 0x35, "BLT": 0x36, "BGE": 0x37, "BLTU": 0x38, "BGEU": 0x39, "BGT": 0x3A, "BLE": 0x3B, "CALL": 0x3C, "RET": 0x3D,
-	// VEC
-	"VADD": 0x40, "VSUB": 0x41, "VMUL": 0x42, "VAND": 0x43, "VOR": 0x44, "VNOT": 0x45, "VSHL": 0x46, "VSHR": 0x47,
-	// FP
-	"FADD": 0x50, "FSUB": 0x51, "FMUL": 0x52, "FCMP": 0x53, "FMOV": 0x54, "FNEG": 0x55,
-	// SYS
-	"WFI": 0x60,
-	// COMPLEX
-	"DIV": 0x70, "MOD": 0x71, "UDIV": 0x72, "UMOD": 0x73, "SQRT": 0x74, "ABS": 0x75, "SIN": 0x76, "COS": 0x77, "TAN": 0x78, "ASIN": 0x79, "ACOS": 0x7A, "ATAN": 0x7B, "EXP": 0x7C, "LOG": 0x7D,
-	// COMPLEX_VEC
-	"VDOT": 0x80, "VREDUCE": 0x81, "VMAX": 0x82, "VMIN": 0x83, "VSUM": 0x84, "VPERM": 0x85,
-	// COMPLEX_MEM
-	"CACHE": 0x90, "FLUSH": 0x91, "MEMBAR": 0x92,
-	// COMPLEX_SYS
-	"SYSCALL": 0xA0, "BREAK": 0xA1, "HALT": 0xA2,
-}
-
-func regNum(name string) (byte, error) {
-	if name == "TB" {
-		return 7, nil
+// emitLine emits line i of the program at the place layout gave it.
+func (cg *CodeGenerator) emitLine(i int, line *LineNode) error {
+	if err := cg.fillPragma(line); err != nil {
+		return err
 	}
-	if name == "TA" {
-		return 8, nil
+	if line.Statement == nil {
+		return nil
 	}
-	if name == "TC" {
-		return 9, nil
+	place := cg.Layout[i]
+	cg.CurrentAddr, cg.here = place.Addr, place.Addr
+	cg.Memory.line = line.Line
+	seg, startLen := cg.Memory.mark()
+	par, err := cg.parPragma(line)
+	if err != nil {
+		return err
 	}
-	if name == "TS" {
-		return 10, nil
+	typeName := reflect.TypeOf(line.Statement)
+	fmt.Printf("[DEBUG] Generate: line %d, reflect.TypeOf=%v, type=%T, label=%v, statement=%#v\n", i, typeName, line.Statement, line.Label, line.Statement)
+	switch stmt := line.Statement.(type) {
+	case *InstructionNode:
+		fmt.Printf("[DEBUG] emitInstruction called: %+v\n", stmt)
+		if err := cg.emitInstruction(stmt, par); err != nil {
+			return err
+		}
+	case *VLIWInstructionNode:
+		fmt.Printf("[DEBUG] emitVLIWInstruction called: %+v\n", stmt)
+		if err := cg.emitVLIWInstruction(stmt, par); err != nil {
+			return err
+		}
+	case *DirectiveNode:
+		fmt.Printf("[DEBUG] emitDirective called: %+v\n", stmt)
+		if par != nil {
+			return fmt.Errorf("@par at line %d applies to instructions, not to %s", line.Line, stmt.Name)
+		}
+		if err := cg.emitDirective(stmt, place.Size); err != nil {
+			return err
+		}
+	default:
+		fmt.Printf("[DEBUG] Generate: unhandled node type %T\n", stmt)
 	}
-	if name == "TI" {
-		return 11, nil
+	if cg.CurrentAddr != place.End() {
+		return fmt.Errorf("internal error: line %d ends at 0x%X, layout placed its end at 0x%X", line.Line, cg.CurrentAddr, place.End())
 	}
-	if name == "T0" || name == "T1" || name == "T2" || name == "T3" || name == "T4" || name == "T5" || name == "T6" {
+	cg.Listing = append(cg.Listing, ListingLine{Line: line.Line, File: line.File, Addr: place.Addr, Code: cg.Memory.since(seg, startLen)})
+	return nil
+}
+
+// --- Instruction Encoding ---
+
+// regNum returns the register number of a general or special register:
+// 0-6 for T0-T6, specialBase+context selector for TA, TB, TC, TS, TI,
+// VA, VT and VB.
+func regNum(name string) (byte, error) {
+	if len(name) == 2 && name[0] == 'T' && name[1] >= '0' && name[1] <= '6' {
 		return name[1] - '0', nil
 	}
+	if ctx, ok := specialContexts[name]; ok {
+		return specialBase + ctx, nil
+	}
 	return 0, fmt.Errorf("unknown register: %s", name)
 }
 
@@ -176,450 +197,351 @@ func AttachCodegenWarnings(w *[]error) {
 	codegenWarnings = w
 }
 
-func (cg *CodeGenerator) emitInstruction(instr *InstructionNode) error {
+// parPragma returns the explicit Par values given on line, or nil.
+func (cg *CodeGenerator) parPragma(line *LineNode) ([]int, error) {
+	p, ok := parsePragma(line)
+	if !ok || p.Name != "par" {
+		return nil, nil
+	}
+	return parseParPragma(p)
+}
+
+func (cg *CodeGenerator) emitInstruction(instr *InstructionNode, par []int) error {
 	fmt.Printf("[DEBUG] In emitInstruction: %+v\n", instr)
 	if deprecatedMnemonics[strings.ToUpper(instr.Mnemonic)] && codegenWarnings != nil {
 		*codegenWarnings = append(*codegenWarnings, fmt.Errorf("warning: instruction '%s' at line %d is deprecated", instr.Mnemonic, instr.Line))
 	}
-	opc, ok := opcodeMap[strings.ToUpper(instr.Mnemonic)]
-	if !ok {
-		return fmt.Errorf("unsupported instruction: %s at line %d", instr.Mnemonic, instr.Line)
-	}
-	var out [4]byte
-	out[0] = opc
-	// Encoding: opcode | dst | src1 | src2/imm
-	switch opc {
-	case 0x00: // NOP
-		// nothing more
-	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x07: // ADD, SUB, MUL, AND, OR, XOR
-		if len(instr.Operands) != 3 {
-			return fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
+	if cg.relaxed[instr] {
+		if isFarCandidate(instr) {
+			return cg.emitFarAccess(instr)
 		}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			rn, err := regNum(reg.Name)
-			if err != nil {
-				return err
-			}
-			out[i+1] = rn
-		}
-	case 0x06: // NOT
-		if len(instr.Operands) != 2 {
-			return fmt.Errorf("NOT requires 2 operands at line %d", instr.Line)
-		}
-		for i := 0; i < 2; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return fmt.Errorf("NOT operand %d is not a register at line %d", i+1, instr.Line)
-			}
-			rn, err := regNum(reg.Name)
-			if err != nil {
-				return err
-			}
-			out[i+1] = rn
-		}
-	case 0x10: // LD
-		if len(instr.Operands) != 2 {
-			return fmt.Errorf("LD requires 2 operands at line %d", instr.Line)
-		}
-		dst, ok := instr.Operands[0].(*RegisterNode)
-		if !ok {
-			return fmt.Errorf("LD dst must be register")
-		}
-		out[1], _ = regNum(dst.Name)
-		// src can be ImmediateNode, IdentifierNode, or MemoryOperandNode
-		switch src := instr.Operands[1].(type) {
-		case *ImmediateNode:
-			imm, _ := parseImmediateOperand(src)
-			binary.BigEndian.PutUint16(out[2:], uint16(imm))
-		case *IdentifierNode:
-			addr := cg.resolveSymbol(src.Name)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		case *MemoryOperandNode:
-			addr := cg.resolveMemOperand(src)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		default:
-			return fmt.Errorf("LD src must be immediate, label, or memory")
-		}
-	case 0x11: // ST
-		if len(instr.Operands) != 2 {
-			return fmt.Errorf("ST requires 2 operands at line %d", instr.Line)
-		}
-		src, ok := instr.Operands[0].(*RegisterNode)
-		if !ok {
-			return fmt.Errorf("ST src must be register")
+		return cg.emitLongBranch(instr)
+	}
+	w, desc, err := cg.encodeInstruction(instr)
+	if err != nil {
+		return err
+	}
+	if par != nil {
+		flags := []uint8{ParSerial}
+		if err := applyParOverrides(flags, []bundleSlot{{instr: instr, desc: desc}}, par, instr.Line); err != nil {
+			return err
 		}
-		out[1], _ = regNum(src.Name)
-		switch dst := instr.Operands[1].(type) {
-		case *ImmediateNode:
-			imm, _ := parseImmediateOperand(dst)
-			binary.BigEndian.PutUint16(out[2:], uint16(imm))
-		case *IdentifierNode:
-			addr := cg.resolveSymbol(dst.Name)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		case *MemoryOperandNode:
-			addr := cg.resolveMemOperand(dst)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		default:
-			return fmt.Errorf("ST dst must be immediate, label, or memory")
+		w.Par = flags[0]
+	}
+	enc := w.Bytes()
+	cg.Memory.writeWord(enc[:], MachineWord(w.Pack()))
+	cg.CurrentAddr += cg.AddrUnit.slotSize()
+	fmt.Printf("[DEBUG] emitInstruction: appended %d bytes, word=%08X, addr=0x%X\n", len(enc), w.Pack(), cg.CurrentAddr)
+	return nil
+}
+
+func (cg *CodeGenerator) emitVLIWInstruction(vliw *VLIWInstructionNode, par []int) error {
+	fmt.Printf("[DEBUG] In emitVLIWInstruction: %+v\n", vliw)
+	slots := make([]bundleSlot, 0, VLIWSlots)
+	encoded := make([]InstrWord, 0, VLIWSlots)
+	for _, instr := range vliw.Instructions {
+		enc, desc, err := cg.encodeInstruction(instr)
+		if err != nil {
+			return fmt.Errorf("VLIW error at line %d: %v", instr.Line, err)
 		}
-	case 0x20: // JMP
-		if len(instr.Operands) != 1 {
-			return fmt.Errorf("JMP requires 1 operand at line %d", instr.Line)
+		reads, writes := registerEffects(instr, desc)
+		slots = append(slots, bundleSlot{instr: instr, desc: desc, reads: reads, writes: writes})
+		encoded = append(encoded, enc)
+	}
+	if err := checkBundle(vliw, slots); err != nil {
+		return err
+	}
+	for len(encoded) < VLIWSlots {
+		nop := &InstructionNode{Mnemonic: "NOP", Line: vliw.Line}
+		enc, desc, err := cg.encodeInstruction(nop)
+		if err != nil {
+			return err
 		}
-		addr := cg.resolveOperandAddr(instr.Operands[0])
-		binary.BigEndian.PutUint16(out[2:], uint16(addr))
-	case 0x21, 0x22, 0x23, 0x24: // BEQ, BNE, BLT, BGT
-		if len(instr.Operands) != 3 {
-			return fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
+		slots = append(slots, bundleSlot{instr: nop, desc: desc})
+		encoded = append(encoded, enc)
+	}
+	flags := deriveParFlags(slots)
+	if err := applyParOverrides(flags, slots, par, vliw.Line); err != nil {
+		return err
+	}
+	cg.Memory.startBundle()
+	for i, enc := range encoded {
+		enc.Par = flags[i]
+		slot := enc.Bytes()
+		cg.Memory.writeWord(slot[:], MachineWord(enc.Pack()))
+	}
+	cg.CurrentAddr += VLIWSlots * cg.AddrUnit.slotSize()
+	return nil
+}
+
+// encodeInstruction validates the operands of instr against its ISA
+// descriptor and packs them into a slot. It is shared by plain and VLIW
+// instructions so that both encode identically.
+func (cg *CodeGenerator) encodeInstruction(instr *InstructionNode) (InstrWord, *InstrDesc, error) {
+	desc, ok := LookupInstr(instr.Mnemonic)
+	if !ok {
+		return InstrWord{}, nil, fmt.Errorf("unsupported instruction: %s at line %d", instr.Mnemonic, instr.Line)
+	}
+	w := InstrWord{Opcode: desc.Opcode, Type: desc.Type}
+	if len(instr.Operands) != len(desc.Operands) {
+		if len(desc.Operands) == 0 {
+			return w, desc, fmt.Errorf("%s does not take any operands at line %d", desc.Mnemonic, instr.Line)
 		}
-		for i := 0; i < 2; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
+		return w, desc, fmt.Errorf("%s requires %d operands (%s) at line %d", desc.Mnemonic, len(desc.Operands), desc.Signature(), instr.Line)
+	}
+	for i, spec := range desc.Operands {
+		op := instr.Operands[i]
+		if isRegisterKind(spec.Kind) {
+			reg, ok := op.(*RegisterNode)
 			if !ok {
-				return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+				if desc.Type == OpTypeALU && spec.Field == FieldRs2 {
+					return w, desc, fmt.Errorf("%s has no immediate form, load operand %d into a register (immediates are accepted by %s) at line %d", desc.Mnemonic, i+1, strings.Join(immMnemonics(), ", "), instr.Line)
+				}
+				return w, desc, fmt.Errorf("%s operand %d is not a register at line %d", desc.Mnemonic, i+1, instr.Line)
 			}
-			rn, err := regNum(reg.Name)
+			code, err := gprOperandCode(desc, spec, reg.Name)
 			if err != nil {
-				return err
+				return w, desc, fmt.Errorf("%v at line %d", err, instr.Line)
 			}
-			out[i+1] = rn
-		}
-		addr := cg.resolveOperandAddr(instr.Operands[2])
-		binary.BigEndian.PutUint16(out[2:], uint16(addr))
-	case 0x30: // WFI
-		// nothing more
-	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47: // VEC
-		if len(instr.Operands) != 3 {
-			return fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		vecRegs := map[string]byte{"VA": 0, "VT": 1, "VB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			vn, ok := vecRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a vector register (VA/VT/VB) at line %d", instr.Mnemonic, i+1, instr.Line)
+			if err := checkRegisterOperand(desc, spec, reg.Name, code); err != nil {
+				return w, desc, fmt.Errorf("%v at line %d", err, instr.Line)
 			}
-			out[i+1] = vn
-		}
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55: // FP
-		if len(instr.Operands) != 3 {
-			return fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
+			w.setReg(int(spec.Field), code)
+			continue
 		}
-		fpRegs := map[string]byte{"FA": 0, "FT": 1, "FB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			fn, ok := fpRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a floating point register (FA/FT/FB) at line %d", instr.Mnemonic, i+1, instr.Line)
+		switch spec.Kind {
+		case KindImm:
+			switch op.(type) {
+			case *ImmediateNode, *IdentifierNode, *ExprNode:
+				val, err := cg.operandValue(op, instr.Line)
+				if err != nil {
+					return w, desc, err
+				}
+				if err := checkRange(desc.Mnemonic+" immediate", op, val, imm11Range, instr.Line); err != nil {
+					return w, desc, err
+				}
+				w.Imm = int32(val)
+			default:
+				return w, desc, fmt.Errorf("%s operand %d must be an immediate at line %d", desc.Mnemonic, i+1, instr.Line)
 			}
-			out[i+1] = fn
-		}
-	case 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0x7B, 0x7C, 0x7D: // COMPLEX
-		// Most are binary, some unary (e.g., SQRT, ABS, SIN, COS, TAN, ASIN, ACOS, ATAN, EXP, LOG)
-		unaryOps := map[string]bool{"SQRT": true, "ABS": true, "SIN": true, "COS": true, "TAN": true, "ASIN": true, "ACOS": true, "ATAN": true, "EXP": true, "LOG": true}
-		if unaryOps[strings.ToUpper(instr.Mnemonic)] {
-			if len(instr.Operands) != 2 {
-				return fmt.Errorf("%s requires 2 operands (dst, src) at line %d", instr.Mnemonic, instr.Line)
+		case KindMem:
+			if err := cg.encodeMemOperand(&w, desc, op, instr.Line); err != nil {
+				return w, desc, err
 			}
-			for i := 0; i < 2; i++ {
-				reg, ok := instr.Operands[i].(*RegisterNode)
+		case KindCmp:
+			switch v := op.(type) {
+			case *RegisterNode:
+				kind, code, ok := registerClass(v.Name)
 				if !ok {
-					return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+					return w, desc, fmt.Errorf("unknown register: %s at line %d", v.Name, instr.Line)
+				}
+				if kind != KindGPR || code > 6 {
+					return w, desc, fmt.Errorf("%s operand %d must be T0-T6 or an immediate, got %s at line %d", desc.Mnemonic, i+1, v.Name, instr.Line)
 				}
-				rn, err := regNum(reg.Name)
+				w.setReg(int(spec.Field), code)
+			case *ImmediateNode, *IdentifierNode, *ExprNode:
+				val, err := cg.operandValue(v, instr.Line)
 				if err != nil {
-					return err
+					return w, desc, err
 				}
-				out[i+1] = rn
-			}
-			out[3] = 0 // unused
-		} else {
-			if len(instr.Operands) != 3 {
-				return fmt.Errorf("%s requires 3 operands (dst, src1, src2) at line %d", instr.Mnemonic, instr.Line)
+				if err := checkRange(desc.Mnemonic+" comparand", v, val, cmpImmRange, instr.Line); err != nil {
+					return w, desc, fmt.Errorf("%v; load larger constants into a register", err)
+				}
+				w.Opcode = desc.ImmOpcode
+				w.setReg(int(spec.Field), uint8(val)&cmpImmMask)
+			default:
+				return w, desc, fmt.Errorf("%s operand %d must be a register or immediate at line %d", desc.Mnemonic, i+1, instr.Line)
 			}
-			for i := 0; i < 3; i++ {
-				reg, ok := instr.Operands[i].(*RegisterNode)
-				if !ok {
-					return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+		case KindSrc, KindShift:
+			switch v := op.(type) {
+			case *RegisterNode:
+				code, err := gprOperandCode(desc, OperandSpec{KindGPR, spec.Field}, v.Name)
+				if err != nil {
+					return w, desc, fmt.Errorf("%s operand %d must be a general register or an immediate, got %s at line %d", desc.Mnemonic, i+1, v.Name, instr.Line)
 				}
-				rn, err := regNum(reg.Name)
+				w.setReg(int(spec.Field), code)
+			case *ImmediateNode, *IdentifierNode, *ExprNode:
+				val, err := cg.operandValue(v, instr.Line)
 				if err != nil {
-					return err
+					return w, desc, err
+				}
+				r := imm11Range
+				if spec.Kind == KindShift {
+					r = shiftRange
 				}
-				out[i+1] = rn
+				if err := checkRange(desc.Mnemonic+" immediate", v, val, r, instr.Line); err != nil {
+					return w, desc, err
+				}
+				w.Opcode = desc.ImmOpcode
+				w.Imm = int32(val)
+			default:
+				return w, desc, fmt.Errorf("%s operand %d must be a register or immediate at line %d", desc.Mnemonic, i+1, instr.Line)
 			}
-		}
-	case 0x80, 0x81, 0x82, 0x83, 0x84, 0x85: // COMPLEX_VEC
-		if len(instr.Operands) != 3 {
-			return fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		vecRegs := map[string]byte{"VA": 0, "VT": 1, "VB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+		case KindTarget:
+			off, err := cg.branchOffset(desc, op, instr.Line)
+			if err != nil {
+				return w, desc, err
 			}
-			vn, ok := vecRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return fmt.Errorf("%s operand %d is not a vector register (VA/VT/VB) at line %d", instr.Mnemonic, i+1, instr.Line)
+			if err := checkRange(desc.Mnemonic+" target offset", op, off, ctrlOffsetRange, instr.Line); err != nil {
+				return w, desc, err
 			}
-			out[i+1] = vn
-		}
-	case 0x90, 0x91, 0x92: // COMPLEX_MEM
-		if len(instr.Operands) != 0 {
-			return fmt.Errorf("%s does not take any operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		// All bytes except opcode are zero
-		// No further action needed
-	case 0xA0, 0xA1, 0xA2: // COMPLEX_SYS
-		if len(instr.Operands) != 0 {
-			return fmt.Errorf("%s does not take any operands at line %d", instr.Mnemonic, instr.Line)
+			w.Imm = int32(off)
 		}
-		// All bytes except opcode are zero
-		// No further action needed
-	default:
-		return fmt.Errorf("unsupported opcode: %02X", opc)
 	}
-	cg.Output = append(cg.Output, out[:]...)
-	cg.CurrentAddr += 4
-	fmt.Printf("[DEBUG] emitInstruction: appended %d bytes, opcode=%02X, addr=0x%X\n", len(out), out[0], cg.CurrentAddr)
-	return nil
+	if err := placeContexts(&w, desc); err != nil {
+		return w, desc, fmt.Errorf("%v at line %d", err, instr.Line)
+	}
+	if err := checkStackOperand(desc, instr); err != nil {
+		return w, desc, err
+	}
+	return w, desc, nil
 }
 
-func (cg *CodeGenerator) emitVLIWInstruction(vliw *VLIWInstructionNode) error {
-	fmt.Printf("[DEBUG] In emitVLIWInstruction: %+v\n", vliw)
-	const vliwWordSize = 12
-	var word [vliwWordSize]byte
-	usedDestRegs := make(map[byte]bool)
-	for i := 0; i < 3; i++ {
-		var instr *InstructionNode
-		if i < len(vliw.Instructions) {
-			instr = vliw.Instructions[i]
-		} else {
-			instr = &InstructionNode{Mnemonic: "NOP", Operands: nil, Line: vliw.Line}
-		}
-		enc, destReg, err := cg.encodeVLIWSubInstr(instr)
-		if err != nil {
-			return fmt.Errorf("VLIW error at line %d: %v", instr.Line, err)
-		}
-		if destReg != 0xFF {
-			if usedDestRegs[destReg] {
-				return fmt.Errorf("VLIW resource conflict: destination register T%d written by more than one instruction in the same VLIW word (line %d)", destReg, instr.Line)
-			}
-			usedDestRegs[destReg] = true
-		}
-		copy(word[i*4:(i+1)*4], enc[:])
+// gprOperandCode returns the register number for a register operand. Vector
+// registers named where a general register is read are encoded through the
+// special context.
+func gprOperandCode(desc *InstrDesc, spec OperandSpec, name string) (byte, error) {
+	kind, code, ok := registerClass(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown register: %s", name)
 	}
-	cg.Output = append(cg.Output, word[:]...)
-	cg.CurrentAddr += vliwWordSize
-	return nil
+	if kind == spec.Kind {
+		return code, nil
+	}
+	if spec.Kind == KindGPR && kind == KindVec {
+		return specialBase + CtxVA + code, nil
+	}
+	return 0, fmt.Errorf("%s operand must be a %s, got %s", desc.Mnemonic, spec.Kind, name)
 }
 
-func (cg *CodeGenerator) encodeVLIWSubInstr(instr *InstructionNode) ([4]byte, byte, error) {
-	var out [4]byte
-	opc, ok := opcodeMap[strings.ToUpper(instr.Mnemonic)]
-	if !ok {
-		return out, 0xFF, fmt.Errorf("unsupported instruction: %s at line %d", instr.Mnemonic, instr.Line)
-	}
-	out[0] = opc
-	var destReg byte = 0xFF
-	switch opc {
-	case 0x00: // NOP
-		// nothing more
-	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x07: // ADD, SUB, MUL, AND, OR, XOR
-		if len(instr.Operands) != 3 {
-			return out, 0xFF, fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			rn, err := regNum(reg.Name)
-			if err != nil {
-				return out, 0xFF, err
-			}
-			out[i+1] = rn
-		}
-		destReg = out[1]
-	case 0x10: // LD
-		if len(instr.Operands) != 2 {
-			return out, 0xFF, fmt.Errorf("LD requires 2 operands at line %d", instr.Line)
-		}
-		dst, ok := instr.Operands[0].(*RegisterNode)
-		if !ok {
-			return out, 0xFF, fmt.Errorf("LD dst must be register")
-		}
-		out[1], _ = regNum(dst.Name)
-		destReg = out[1]
-		// src can be ImmediateNode, IdentifierNode, or MemoryOperandNode
-		switch src := instr.Operands[1].(type) {
-		case *ImmediateNode:
-			imm, _ := parseImmediateOperand(src)
-			binary.BigEndian.PutUint16(out[2:], uint16(imm))
-		case *IdentifierNode:
-			addr := cg.resolveSymbol(src.Name)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		case *MemoryOperandNode:
-			addr := cg.resolveMemOperand(src)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		default:
-			return out, 0xFF, fmt.Errorf("LD src must be immediate, label, or memory")
-		}
-	case 0x11: // ST
-		if len(instr.Operands) != 2 {
-			return out, 0xFF, fmt.Errorf("ST requires 2 operands at line %d", instr.Line)
-		}
-		src, ok := instr.Operands[0].(*RegisterNode)
-		if !ok {
-			return out, 0xFF, fmt.Errorf("ST src must be register")
-		}
-		out[1], _ = regNum(src.Name)
-		// dst can be ImmediateNode, IdentifierNode, or MemoryOperandNode
-		switch dst := instr.Operands[1].(type) {
-		case *ImmediateNode:
-			imm, _ := parseImmediateOperand(dst)
-			binary.BigEndian.PutUint16(out[2:], uint16(imm))
-		case *IdentifierNode:
-			addr := cg.resolveSymbol(dst.Name)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		case *MemoryOperandNode:
-			addr := cg.resolveMemOperand(dst)
-			binary.BigEndian.PutUint16(out[2:], uint16(addr))
-		default:
-			return out, 0xFF, fmt.Errorf("ST dst must be immediate, label, or memory")
-		}
-	case 0x20: // JMP
-		if len(instr.Operands) != 1 {
-			return out, 0xFF, fmt.Errorf("JMP requires 1 operand at line %d", instr.Line)
-		}
-		addr := cg.resolveOperandAddr(instr.Operands[0])
-		binary.BigEndian.PutUint16(out[2:], uint16(addr))
-	case 0x21, 0x22, 0x23, 0x24: // BEQ, BNE, BLT, BGT
-		if len(instr.Operands) != 3 {
-			return out, 0xFF, fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		for i := 0; i < 2; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			rn, err := regNum(reg.Name)
-			if err != nil {
-				return out, 0xFF, err
-			}
-			out[i+1] = rn
-		}
-		addr := cg.resolveOperandAddr(instr.Operands[2])
-		binary.BigEndian.PutUint16(out[2:], uint16(addr))
-	case 0x30: // WFI
-		// nothing more
-	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47: // VEC
-		if len(instr.Operands) != 3 {
-			return out, 0xFF, fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		vecRegs := map[string]byte{"VA": 0, "VT": 1, "VB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			vn, ok := vecRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a vector register (VA/VT/VB) at line %d", instr.Mnemonic, i+1, instr.Line)
-			}
-			out[i+1] = vn
+// checkRegisterOperand applies the hardware restrictions on special
+// registers in general register fields.
+func checkRegisterOperand(desc *InstrDesc, spec OperandSpec, name string, code byte) error {
+	if spec.Kind != KindGPR || code < specialBase || spec.Field != FieldRd {
+		return nil
+	}
+	return checkSpecialWrite(desc, strings.ToUpper(name), code-specialBase)
+}
+
+// branchOffset returns the distance in instruction slots from the current
+// instruction (or the enclosing VLIW bundle) to a jump or branch target.
+func (cg *CodeGenerator) branchOffset(desc *InstrDesc, op OperandNode, line int) (int64, error) {
+	switch op.(type) {
+	case *IdentifierNode, *ImmediateNode, *ExprNode:
+	default:
+		return 0, fmt.Errorf("%s target must be a label or address at line %d", desc.Mnemonic, line)
+	}
+	addr, err := cg.operandValue(op, line)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", desc.Mnemonic, err)
+	}
+	if err := checkRange(desc.Mnemonic+" target", op, addr, addrRange, line); err != nil {
+		return 0, err
+	}
+	delta := Addr(addr) - cg.CurrentAddr
+	if delta%cg.AddrUnit.slotSize() != 0 {
+		return 0, fmt.Errorf("%s target 0x%X is not aligned to an instruction slot at %s", desc.Mnemonic, addr, sourcePos(op, line))
+	}
+	return int64(delta / cg.AddrUnit.slotSize()), nil
+}
+
+// encodeMemOperand fills the base, index and displacement of a memory
+// operand. Supported forms:
+//
+//	[Rs1]        EA = Rs1
+//	[Rs1+imm]    EA = Rs1 + imm            (imm[10] = 0, imm[9:0] displacement)
+//	[Rs1+Rx]     EA = Rs1 + Rx, loads only (imm[10] = 1, Rx in the Rs2 field)
+//	label / imm  EA = TC + (addr - TC)     (program counter relative)
+func (cg *CodeGenerator) encodeMemOperand(w *InstrWord, desc *InstrDesc, op OperandNode, line int) error {
+	switch v := op.(type) {
+	case *ImmediateNode, *IdentifierNode, *ExprNode:
+		addr, err := cg.operandValue(v, line)
+		if err != nil {
+			return fmt.Errorf("%s: %v", desc.Mnemonic, err)
+		}
+		if err := checkRange(desc.Mnemonic+" address", v, addr, addrRange, line); err != nil {
+			return err
+		}
+		c := w.ctx[desc.Operands[0].Field]
+		disp := addr - int64(cg.CurrentAddr)
+		if memAbsRange.contains(addr) && (!memDispRange.contains(disp) || (c != 0 && c-1 != CtxTC)) {
+			w.Opcode = desc.ImmOpcode
+			w.Imm = int32(addr)
+			return nil
+		}
+		if c != 0 && c-1 != CtxTC {
+			reg, text := contextNames[c-1], operandText(v)
+			return fmt.Errorf("%s %s, %s: %s and the PC-relative address each need a special register context selector and only one fits, go through a T register (LEA T0, %s then %s %s, [T0]) at %s",
+				desc.Mnemonic, reg, text, reg, text, desc.Mnemonic, reg, sourcePos(v, line))
+		}
+		tc, _ := regNum("TC")
+		w.setReg(int(FieldRs1), tc)
+		if !memDispRange.contains(disp) {
+			return fmt.Errorf("%s address %s is %d %s from TC (0x%X), out of range for the %s (%d..%d) at %s", desc.Mnemonic, valueText(v, addr), disp, cg.AddrUnit.plural(), cg.CurrentAddr, memDispRange.Desc, memDispRange.Min, memDispRange.Max, sourcePos(v, line))
+		}
+		w.Imm = int32(disp) & memDispMask
+	case *MemoryOperandNode:
+		base, err := regNum(strings.ToUpper(v.Base))
+		if err != nil {
+			return fmt.Errorf("%s: invalid base register %s at line %d", desc.Mnemonic, v.Base, line)
 		}
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55: // FP
-		if len(instr.Operands) != 3 {
-			return out, 0xFF, fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
+		if strings.EqualFold(v.Base, "TC") {
+			return fmt.Errorf("%s: TC cannot be used as a base register, write the label without brackets for PC-relative addressing at line %d", desc.Mnemonic, line)
 		}
-		fpRegs := map[string]byte{"FA": 0, "FT": 1, "FB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+		w.setReg(int(FieldRs1), base)
+		if v.Index != "" {
+			if desc.Operands[0].Field == FieldRs2 {
+				return fmt.Errorf("%s: indexed addressing [%s+%s] is only available for loads and LEA, stores need [Rs1+imm] at line %d", desc.Mnemonic, v.Base, v.Index, line)
 			}
-			fn, ok := fpRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a floating point register (FA/FT/FB) at line %d", instr.Mnemonic, i+1, instr.Line)
+			kind, idx, ok := registerClass(v.Index)
+			if !ok || kind != KindGPR || idx > 6 {
+				return fmt.Errorf("%s: index register must be T0-T6, got %s at line %d", desc.Mnemonic, v.Index, line)
 			}
-			out[i+1] = fn
+			w.setReg(int(FieldRs2), idx)
+			w.Imm = memIndexedBit
+			return nil
 		}
-	case 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0x7B, 0x7C, 0x7D: // COMPLEX
-		// Most are binary, some unary (e.g., SQRT, ABS, SIN, COS, TAN, ASIN, ACOS, ATAN, EXP, LOG)
-		unaryOps := map[string]bool{"SQRT": true, "ABS": true, "SIN": true, "COS": true, "TAN": true, "ASIN": true, "ACOS": true, "ATAN": true, "EXP": true, "LOG": true}
-		if unaryOps[strings.ToUpper(instr.Mnemonic)] {
-			if len(instr.Operands) != 2 {
-				return out, 0xFF, fmt.Errorf("%s requires 2 operands (dst, src) at line %d", instr.Mnemonic, instr.Line)
-			}
-			for i := 0; i < 2; i++ {
-				reg, ok := instr.Operands[i].(*RegisterNode)
-				if !ok {
-					return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-				}
-				rn, err := regNum(reg.Name)
-				if err != nil {
-					return out, 0xFF, err
-				}
-				out[i+1] = rn
-			}
-			out[3] = 0 // unused
-		} else {
-			if len(instr.Operands) != 3 {
-				return out, 0xFF, fmt.Errorf("%s requires 3 operands (dst, src1, src2) at line %d", instr.Mnemonic, instr.Line)
+		if v.Offset != "" {
+			var off OperandNode = &ImmediateNode{Value: v.Offset, Line: v.Line, Column: v.Column}
+			if v.Disp != nil {
+				off = v.Disp
 			}
-			for i := 0; i < 3; i++ {
-				reg, ok := instr.Operands[i].(*RegisterNode)
-				if !ok {
-					return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
-				}
-				rn, err := regNum(reg.Name)
-				if err != nil {
-					return out, 0xFF, err
-				}
-				out[i+1] = rn
-			}
-		}
-	case 0x80, 0x81, 0x82, 0x83, 0x84, 0x85: // COMPLEX_VEC
-		if len(instr.Operands) != 3 {
-			return out, 0xFF, fmt.Errorf("%s requires 3 operands at line %d", instr.Mnemonic, instr.Line)
-		}
-		vecRegs := map[string]byte{"VA": 0, "VT": 1, "VB": 2}
-		for i := 0; i < 3; i++ {
-			reg, ok := instr.Operands[i].(*RegisterNode)
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a register at line %d", instr.Mnemonic, i+1, instr.Line)
+			disp, err := cg.operandValue(off, line)
+			if err != nil {
+				return fmt.Errorf("%s: invalid offset: %v", desc.Mnemonic, err)
 			}
-			vn, ok := vecRegs[strings.ToUpper(reg.Name)]
-			if !ok {
-				return out, 0xFF, fmt.Errorf("%s operand %d is not a vector register (VA/VT/VB) at line %d", instr.Mnemonic, i+1, instr.Line)
+			if err := checkRange(desc.Mnemonic+" offset", off, disp, memDispRange, line); err != nil {
+				return err
 			}
-			out[i+1] = vn
+			w.Imm = int32(disp) & memDispMask
 		}
-	case 0x90, 0x91, 0x92: // COMPLEX_MEM
-		// All bytes except opcode are zero
-		// No further action needed
-	case 0xA0, 0xA1, 0xA2: // COMPLEX_SYS
-		// All bytes except opcode are zero
-		// No further action needed
 	default:
-		return out, 0xFF, fmt.Errorf("unsupported opcode: %02X", opc)
+		return fmt.Errorf("%s operand must be an address or memory operand at line %d", desc.Mnemonic, line)
+	}
+	return nil
+}
+
+// checkStackOperand rejects PUSH/POP operands that conflict with the implicit
+// use of TB as stack pointer and TC as program counter.
+func checkStackOperand(desc *InstrDesc, instr *InstructionNode) error {
+	if desc.Mnemonic != "PUSH" && desc.Mnemonic != "POP" {
+		return nil
+	}
+	reg := strings.ToUpper(instr.Operands[0].(*RegisterNode).Name)
+	switch {
+	case reg == "TC":
+		return fmt.Errorf("%s TC is not allowed, use CALL/RET to save and restore the program counter at line %d", desc.Mnemonic, instr.Line)
+	case reg == "TB" && desc.Mnemonic == "POP":
+		return fmt.Errorf("POP TB is not allowed, TB is the stack pointer adjusted by POP at line %d", instr.Line)
 	}
-	return out, destReg, nil
+	return nil
 }
 
 // --- Directive/Data Emission ---
-func (cg *CodeGenerator) emitDirective(dir *DirectiveNode) error {
+
+// emitDirective emits a directive at cg.CurrentAddr; size is the number of
+// addresses layout gave it.
+func (cg *CodeGenerator) emitDirective(dir *DirectiveNode, size Addr) error {
 	fmt.Printf("[DEBUG] In emitDirective: %+v\n", dir)
 	if deprecatedDirectives[strings.ToUpper(dir.Name)] && codegenWarnings != nil {
 		*codegenWarnings = append(*codegenWarnings, fmt.Errorf("warning: directive '%s' at line %d is deprecated", dir.Name, dir.Line))
@@ -627,69 +549,46 @@ func (cg *CodeGenerator) emitDirective(dir *DirectiveNode) error {
 	name := strings.ToUpper(dir.Name)
 	switch name {
 	case ".ORG":
-		if len(dir.Params) > 0 {
-			imm, _ := parseImmediateOperand(dir.Params[0])
-			cg.CurrentAddr = uint32(imm)
-		}
-	case ".SPACE":
-		if len(dir.Params) > 0 {
-			imm, _ := parseImmediateOperand(dir.Params[0])
-			for i := 0; i < int(imm); i++ {
-				cg.Output = append(cg.Output, 0)
-				cg.CurrentAddr++
-			}
-		}
-	case ".DW":
+		cg.Memory.org(cg.CurrentAddr, cg.fill)
+	case ".SPACE", ".ALIGN":
+		unit := cg.Memory.fillBytes(cg.fill)
+		for i := Addr(0); i < size; i++ {
+			if cg.AddrUnit == UnitTritWord {
+				cg.Memory.writeWord(unit, tritWord(cg.fill))
+			} else {
+				cg.Memory.write(unit)
+			}
+		}
+		cg.CurrentAddr += size
+	case ".DW", ".DB", ".DT":
+		width, r := 2, halfRange
+		switch name {
+		case ".DB":
+			width, r = 1, byteRange
+		case ".DT":
+			width, r = 0, wordRange
+		}
+		var items []int64
 		for _, op := range dir.Params {
-			switch v := op.(type) {
-			case *ImmediateNode:
-				if isQuotedString(v.Value) {
-					for _, c := range unquoteString(v.Value) {
-						var buf [2]byte
-						binary.BigEndian.PutUint16(buf[:], uint16(c))
-						cg.Output = append(cg.Output, buf[:]...)
-						cg.CurrentAddr += 2
-					}
-				} else {
-					imm, _ := parseImmediateOperand(v)
-					var buf [2]byte
-					binary.BigEndian.PutUint16(buf[:], uint16(imm))
-					cg.Output = append(cg.Output, buf[:]...)
-					cg.CurrentAddr += 2
+			if v, ok := op.(*ImmediateNode); ok && isQuotedString(v.Value) {
+				for _, c := range unquoteString(v.Value) {
+					items = append(items, int64(c))
 				}
-			default:
-				imm, _ := parseImmediateOperand(op)
-				var buf [2]byte
-				binary.BigEndian.PutUint16(buf[:], uint16(imm))
-				cg.Output = append(cg.Output, buf[:]...)
-				cg.CurrentAddr += 2
+				continue
 			}
-		}
-	case ".DB":
-		for _, op := range dir.Params {
-			switch v := op.(type) {
-			case *ImmediateNode:
-				if isQuotedString(v.Value) {
-					for _, c := range unquoteString(v.Value) {
-						cg.Output = append(cg.Output, byte(c))
-						cg.CurrentAddr++
-					}
-				} else {
-					imm, _ := parseImmediateOperand(v)
-					cg.Output = append(cg.Output, byte(imm))
-					cg.CurrentAddr++
-				}
-			default:
-				imm, _ := parseImmediateOperand(op)
-				cg.Output = append(cg.Output, byte(imm))
-				cg.CurrentAddr++
+			imm, err := cg.dataValue(dir, op, r)
+			if err != nil {
+				return err
 			}
+			items = append(items, imm)
 		}
+		cg.emitData(width, items)
 	case ".EQU":
-		// Already handled in pass 1
+		// Defined by layout
 		return nil
 	case ".INCLUDE":
-		return fmt.Errorf(".INCLUDE directive not implemented yet")
+		// Replaced by the included lines before parsing
+		return fmt.Errorf("internal error: .INCLUDE at line %d was not expanded", dir.Line)
 	// TODO: Add support for other assembler directives as needed
 	default:
 		// Ignore other directives for now
@@ -697,11 +596,103 @@ func (cg *CodeGenerator) emitDirective(dir *DirectiveNode) error {
 	return nil
 }
 
+// emitData appends .DB (width 1), .DW (width 2) or .DT (width 0) items.
+// Halves are stored big-endian. With word addressing the items are packed
+// into words and the last word is padded; with trit-word addressing every
+// item fills a word of its own, stored like an instruction slot in the byte
+// stream and as an 18-trit word in the image. .DT items always fill a word
+// of their own, and take the addresses of an instruction slot.
+func (cg *CodeGenerator) emitData(width int, items []int64) {
+	var data []byte
+	for _, v := range items {
+		switch {
+		case cg.AddrUnit == UnitTritWord || width == 0:
+			var buf [InstrSlotBytes]byte
+			binary.LittleEndian.PutUint32(buf[:], uint32(int32(v)))
+			cg.Memory.writeWord(buf[:], tritWord(v))
+		case width == 2:
+			var buf [2]byte
+			binary.BigEndian.PutUint16(buf[:], uint16(v))
+			data = append(data, buf[:]...)
+		default:
+			data = append(data, byte(v))
+		}
+	}
+	size := cg.AddrUnit.dataSize(width, int64(len(items)))
+	if cg.AddrUnit != UnitTritWord && width != 0 {
+		for len(data) < int(size)*cg.AddrUnit.unitBytes() {
+			data = append(data, 0)
+		}
+		cg.Memory.write(data)
+	}
+	cg.CurrentAddr += size
+}
+
+// fillPragma applies a .FILL on line: the value of the addresses skipped by
+// later .ORGs and reserved by later .SPACEs.
+func (cg *CodeGenerator) fillPragma(line *LineNode) error {
+	p, ok := parsePragma(line)
+	if !ok || p.Name != "fill" {
+		return nil
+	}
+	if len(p.Args) == 0 {
+		return fmt.Errorf(".FILL at line %d needs one value", p.Line)
+	}
+	op := &ExprNode{Text: strings.Join(p.Args, ", "), Line: p.Line}
+	v, err := cg.operandValue(op, p.Line)
+	if err != nil {
+		return fmt.Errorf(".FILL: %v", err)
+	}
+	r := byteRange
+	if cg.AddrUnit == UnitTritWord {
+		r = wordRange
+	}
+	if err := checkRange(".FILL value", op, v, r, p.Line); err != nil {
+		return err
+	}
+	cg.fill = v
+	return nil
+}
+
+// directiveValue evaluates parameter idx of a directive and checks it against r.
+func (cg *CodeGenerator) directiveValue(dir *DirectiveNode, idx int, r valueRange) (int64, error) {
+	if idx >= len(dir.Params) {
+		return 0, fmt.Errorf("%s is missing a value at line %d", dir.Name, dir.Line)
+	}
+	return cg.dataValue(dir, dir.Params[idx], r)
+}
+
+// dataValue evaluates one data item of a directive and checks it against r.
+func (cg *CodeGenerator) dataValue(dir *DirectiveNode, op OperandNode, r valueRange) (int64, error) {
+	v, err := cg.operandValue(op, dir.Line)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", dir.Name, err)
+	}
+	if err := checkRange(dir.Name+" value", op, v, r, dir.Line); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
 // Helper: check if a string is quoted (e.g., '"Hello"')
 func isQuotedString(s string) bool {
 	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
 }
 
+// dataItemCount returns the number of data units emitted for a data list;
+// a quoted string contributes one unit per character.
+func dataItemCount(params []OperandNode) int64 {
+	n := int64(0)
+	for _, op := range params {
+		if v, ok := op.(*ImmediateNode); ok && isQuotedString(v.Value) {
+			n += int64(len(unquoteString(v.Value)))
+			continue
+		}
+		n++
+	}
+	return n
+}
+
 // Helper: remove quotes and unescape (basic)
 func unquoteString(s string) string {
 	if isQuotedString(s) {
@@ -717,15 +708,14 @@ func parseImmediateOperand(op OperandNode) (int64, error) {
 		// Support decimal, hex, binary, ternary
 		val := v.Value
 		if strings.HasPrefix(val, "0x") {
-			return strconv.ParseInt(val[2:], 16, 32)
+			return strconv.ParseInt(val[2:], 16, 64)
 		} else if strings.HasPrefix(val, "0b") {
-			return strconv.ParseInt(val[2:], 2, 32)
+			return strconv.ParseInt(val[2:], 2, 64)
 		} else if strings.HasPrefix(val, "0t") {
-			// Ternary: +, -, 0
-			// For now, treat as 0
-			return 0, nil
+			// Ternary: +, -, 0 (most significant trit first)
+			return ternary.ParseInt(val[2:])
 		} else {
-			return strconv.ParseInt(val, 10, 32)
+			return strconv.ParseInt(val, 10, 64)
 		}
 	case *IdentifierNode:
 		// Symbol/label reference
@@ -734,33 +724,18 @@ func parseImmediateOperand(op OperandNode) (int64, error) {
 	return 0, fmt.Errorf("unsupported immediate operand")
 }
 
-func (cg *CodeGenerator) resolveSymbol(name string) uint32 {
-	if v, ok := cg.Labels[name]; ok {
-		return v
-	}
-	if v, ok := cg.Equs[name]; ok {
-		return v
-	}
-	return 0
+func (cg *CodeGenerator) resolveSymbol(name string) Addr {
+	v, _ := cg.symbolValue(name)
+	return Addr(v)
 }
 
-func (cg *CodeGenerator) resolveOperandAddr(op OperandNode) uint32 {
+func (cg *CodeGenerator) resolveOperandAddr(op OperandNode) Addr {
 	switch v := op.(type) {
 	case *ImmediateNode:
 		imm, _ := parseImmediateOperand(v)
-		return uint32(imm)
+		return Addr(imm)
 	case *IdentifierNode:
 		return cg.resolveSymbol(v.Name)
 	}
 	return 0
 }
-
-func (cg *CodeGenerator) resolveMemOperand(mem *MemoryOperandNode) uint32 {
-	// For now, just use base register as address (stub)
-	if mem.Base != "" {
-		if addr, ok := cg.Labels[mem.Base]; ok {
-			return addr
-		}
-	}
-	return 0
-}
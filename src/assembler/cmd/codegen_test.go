@@ -1,15 +1,293 @@
 package cmd
 
 import (
+	"encoding/binary"
+	"strings"
 	"testing"
 )
 
+// assembleSource parses src and runs code generation on it.
+func assembleSource(t *testing.T, src string) (*CodeGenerator, error) {
+	t.Helper()
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	return cg, cg.Generate(ctx.AST)
+}
+
+// parseSource parses src, failing the test on syntax errors.
+func parseSource(t *testing.T, src string) *CompilationContext {
+	t.Helper()
+	ctx := &CompilationContext{
+		SourceFile:   "test.asm",
+		SourceCode:   src,
+		ErrorManager: NewErrorManager(),
+		SymbolTable:  NewSymbolTable(),
+	}
+	if err := runParsing(ctx); err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	if ctx.ErrorManager.HasErrors() {
+		t.Fatalf("syntax errors: %v", ctx.ErrorManager.Errors)
+	}
+	return ctx
+}
+
+// slotWords splits generated output into little-endian 32-bit slots.
+func slotWords(out []byte) []InstrWord {
+	var words []InstrWord
+	for i := 0; i+InstrSlotBytes <= len(out); i += InstrSlotBytes {
+		words = append(words, UnpackInstrWord(binary.LittleEndian.Uint32(out[i:])))
+	}
+	return words
+}
+
 func TestEmitInstruction(t *testing.T) {
-	// TODO: Add tests for emitInstruction
+	cg, err := assembleSource(t, "ADD T3, T1, T2\nHALT\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	if len(words) != 2 {
+		t.Fatalf("got %d slots, want 2", len(words))
+	}
+	want := InstrWord{Opcode: 0x01, Rd: 3, Rs1: 1, Rs2: 2, Type: OpTypeALU}
+	if words[0] != want {
+		t.Errorf("ADD encoded as %+v, want %+v", words[0], want)
+	}
+	if words[1].Type != OpTypeUCODE || words[1].Opcode != 0x22 {
+		t.Errorf("HALT encoded as %+v, want UCODE/100010", words[1])
+	}
+}
+
+func TestEmitVLIWInstruction(t *testing.T) {
+	cg, err := assembleSource(t, "[ADD T0, T1, T2] [NOP] [SUB T3, T4, T5]\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	if len(words) != VLIWSlots {
+		t.Fatalf("got %d slots, want %d", len(words), VLIWSlots)
+	}
+	if words[1].Type != OpTypeSYS || words[1].Opcode != 0 {
+		t.Errorf("slot 2 = %+v, want NOP", words[1])
+	}
+	if words[2].Opcode != 0x02 || words[2].Rd != 3 || words[2].Rs1 != 4 || words[2].Rs2 != 5 {
+		t.Errorf("slot 3 = %+v, want SUB T3, T4, T5", words[2])
+	}
+}
+
+func TestMemoryAddressingModes(t *testing.T) {
+	src := `LD T1, [T2]
+LD T1, [T2+8]
+LD T1, [TB+T0]
+ST T3, [T4+511]
+VLD VA, [T5+3]
+FST FT, [TB]
+LEA T6, [T1+T2]
+PUSH T3
+POP T4
+LD T0, data
+data: .DW 1
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	want := []InstrWord{
+		{Opcode: 0x00, Rd: 1, Rs1: 2, Type: OpTypeMEM},
+		{Opcode: 0x00, Rd: 1, Rs1: 2, Imm: 8, Type: OpTypeMEM},
+		{Opcode: 0x00, Rd: 1, Rs1: RegSpecial, Rs2: 0, Imm: -1024 | CtxTB, Type: OpTypeMEM},
+		{Opcode: 0x01, Rs1: 4, Rs2: 3, Imm: 511, Type: OpTypeMEM},
+		{Opcode: 0x02, Rd: 0, Rs1: 5, Imm: 3, Type: OpTypeMEM},
+		{Opcode: 0x05, Rd: CtxTB, Rs1: RegSpecial, Rs2: 1, Type: OpTypeMEM},
+		{Opcode: 0x06, Rd: 6, Rs1: 1, Rs2: 2, Imm: -1024, Type: OpTypeMEM},
+		{Opcode: 0x07, Rs1: 3, Type: OpTypeMEM},
+		{Opcode: 0x08, Rd: 4, Type: OpTypeMEM},
+		{Opcode: 0x00, Rd: 0, Rs1: RegSpecial, Rs2: CtxTC, Imm: 4, Type: OpTypeMEM},
+	}
+	for i, w := range want {
+		if words[i] != w {
+			t.Errorf("line %d encoded as %+v, want %+v", i+1, words[i], w)
+		}
+	}
+}
+
+func TestMemoryOperandErrors(t *testing.T) {
+	cases := []struct {
+		src     string
+		wantErr string
+	}{
+		{"ST T1, [T2+T3]\n", "only available for loads"},
+		{"LD T1, [T2+512]\n", "offset 512 is out of range for the 10-bit signed displacement (-512..511) at line 1, column 8"},
+		{"VLD T0, [T1]\n", "vector register"},
+		{"PUSH TC\n", "PUSH TC is not allowed"},
+		{"POP TB\n", "POP TB is not allowed"},
+		{"[LD T0, 0x1000] [NOP] [NOP]\n", "0x1000 (4096) is 4096 bytes from TC"},
+	}
+	for _, c := range cases {
+		_, err := assembleSource(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error %v, want it to mention %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestControlFlowOffsets(t *testing.T) {
+	src := `start:
+        NOP
+        JMP start
+        BEQ T3, 0, done
+        [ADD T0, T0, T1] [BNE T1, T2, start] [NOP]
+        JAL done
+        JR T4
+        JALR T5
+        CALL start
+        BLTU T1, T2, done
+done:
+        RET
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	// start=0, JMP=1, BEQ=2, bundle=3..5, JAL=6, JR=7, JALR=8, CALL=9, BLTU=10, done=11
+	want := map[int]InstrWord{
+		1:  {Opcode: 0x00, Imm: -1, Type: OpTypeCTRL},
+		2:  {Opcode: 0x14, Rs1: 3, Imm: 9, Type: OpTypeCTRL},
+		4:  {Opcode: 0x05, Rs1: 1, Rs2: 2, Imm: -3, Type: OpTypeCTRL, Par: ParALU},
+		6:  {Opcode: 0x01, Imm: 5, Type: OpTypeCTRL},
+		7:  {Opcode: 0x02, Rs1: 4, Type: OpTypeCTRL},
+		8:  {Opcode: 0x03, Rs1: 5, Type: OpTypeCTRL},
+		9:  {Opcode: 0x0A, Imm: -9, Type: OpTypeCTRL},
+		10: {Opcode: 0x08, Rs1: 1, Rs2: 2, Imm: 1, Type: OpTypeCTRL},
+		11: {Opcode: 0x0B, Type: OpTypeCTRL},
+	}
+	for i, w := range want {
+		if words[i] != w {
+			t.Errorf("slot %d encoded as %+v, want %+v", i, words[i], w)
+		}
+	}
+}
+
+func TestBranchCompareImmediate(t *testing.T) {
+	cg, err := assembleSource(t, "back:\n    BNE T1, -1, back\n    BGT TA, 3, back\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	if w := words[0]; w.Opcode != 0x15 || w.Rs1 != 1 || w.Rs2 != 7 || w.Imm != 0 {
+		t.Errorf("BNE T1, -1, back encoded as %+v", w)
+	}
+	// The comparand fills Rs2, so the selector of TA goes into Rd.
+	if w := words[1]; w.Opcode != 0x1C || w.Rd != CtxTA || w.Rs1 != RegSpecial || w.Rs2 != 3 || w.Imm != -1 {
+		t.Errorf("BGT TA, 3, back encoded as %+v", w)
+	}
+	if text, _ := Disassemble(words[0]); text != "BNE T1, -1, +0" {
+		t.Errorf("Disassemble = %q, want BNE T1, -1, +0", text)
+	}
+	for _, c := range []struct{ src, wantErr string }{
+		{"BEQ T1, 9, x\nx:\n NOP\n", "comparand 9 is out of range for the 3-bit signed comparand (-4..3)"},
+		{"BEQ T1, TB, x\nx:\n NOP\n", "must be T0-T6 or an immediate"},
+		{"JMP nowhere\n", "undefined symbol nowhere at line 1, column 5"},
+		{"JMP 0x1002\n", "not aligned"},
+	} {
+		if _, err := assembleSource(t, c.src); err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error %v, want it to mention %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestALUImmediateForms(t *testing.T) {
+	src := `ADD T0, T1, 5
+SUB T2, T2, 1023
+CMP T3, 0t+-
+SHL T4, T4, 17
+[ADD T0, T0, 1] [XOR T1, T1, 0x7F] [ROR T2, T2, T3]
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	want := []InstrWord{
+		{Opcode: 0x21, Rd: 0, Rs1: 1, Imm: 5, Type: OpTypeALU},
+		{Opcode: 0x22, Rd: 2, Rs1: 2, Imm: 1023, Type: OpTypeALU},
+		{Opcode: 0x2C, Rs1: 3, Imm: 2, Type: OpTypeALU},
+		{Opcode: 0x28, Rd: 4, Rs1: 4, Imm: 17, Type: OpTypeALU},
+		{Opcode: 0x21, Rd: 0, Rs1: 0, Imm: 1, Type: OpTypeALU, Par: ParALU},
+		{Opcode: 0x27, Rd: 1, Rs1: 1, Imm: 0x7F, Type: OpTypeALU, Par: ParALU},
+		{Opcode: 0x0B, Rd: 2, Rs1: 2, Rs2: 3, Type: OpTypeALU, Par: ParALU},
+	}
+	for i, w := range want {
+		if words[i] != w {
+			t.Errorf("slot %d encoded as %+v, want %+v", i, words[i], w)
+		}
+	}
+	if d, ok := LookupEncoding(OpTypeALU, 0x21); !ok || d.Mnemonic != "ADD" {
+		t.Errorf("LookupEncoding(ALU, 0x21) = %v, %v", d, ok)
+	}
+	if _, ok := LookupEncoding(OpTypeALU, 0x23); ok {
+		t.Errorf("MUL has no immediate form but decoded")
+	}
+
+	for _, c := range []struct{ src, wantErr string }{
+		{"MUL T0, T1, 3\n", "MUL has no immediate form"},
+		{"ADD T0, T1, 1024\n", "ADD immediate 1024 is out of range for the 11-bit signed immediate"},
+		{"SHR T0, T1, 18\n", "SHR immediate 18 is out of range for the shift count of an 18-trit word (0..17)"},
+		{"AND T0, 5, T1\n", "AND operand 2 is not a register"},
+		{"OR T0, T1, FA\n", "must be a general register or an immediate"},
+	} {
+		if _, err := assembleSource(t, c.src); err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error %v, want it to mention %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestRangeChecks(t *testing.T) {
+	cases := []struct {
+		src     string
+		wantErr string
+	}{
+		{".DB 256\n", ".DB value 256 is out of range for the 8-bit .DB unit (-128..255) at line 1, column 5"},
+		{".DB 0t+++++++\n", ".DB value 0t+++++++ (1093) is out of range"},
+		{".DW 0x10000\n", ".DW value 0x10000 (65536) is out of range for the 16-bit .DW unit"},
+		{".DT 99999999999\n", ".DT value 99999999999 is out of range for the 18-trit word (-193710244..193710244)"},
+		{".ORG 0x10000000\n", ".ORG value 0x10000000 (268435456) is out of range for the 18-trit address space (0..193710244)"},
+		{"VSHL VA, VT, 1024\n", "VSHL immediate 1024 is out of range for the 11-bit signed immediate (-1024..1023)"},
+		{"VSHL VA, VT, missing\n", "undefined symbol missing"},
+		{".EQU BIG, 0x10000000\n", "out of range for the 18-trit word"},
+	}
+	for _, c := range cases {
+		_, err := assembleSource(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error %v, want it to mention %q", c.src, err, c.wantErr)
+		}
+	}
+	if _, err := assembleSource(t, ".DB 255, 0t----\n.DW 65535\nVSHR VA, VT, 0t+-\n"); err != nil {
+		t.Errorf("in-range values rejected: %v", err)
+	}
 }
 
 func TestEmitDirective(t *testing.T) {
-	// TODO: Add tests for emitDirective
+	cg, err := assembleSource(t, ".DB 0t+-0, 0t-, 0x7F, \"AB\"\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := []byte{6, 0xFF, 0x7F, 'A', 'B'}
+	if string(cg.Output) != string(want) {
+		t.Errorf(".DB emitted % X, want % X", cg.Output, want)
+	}
+
+	cg, err = assembleSource(t, ".DT -2, 0t+-\nnext:\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want = []byte{0xFE, 0xFF, 0xFF, 0xFF, 2, 0, 0, 0}
+	if string(cg.Output) != string(want) || cg.Labels["next"] != 8 {
+		t.Errorf(".DT emitted % X with next = %d, want % X and 8", cg.Output, cg.Labels["next"], want)
+	}
 }
 
 func TestLabelResolution(t *testing.T) {
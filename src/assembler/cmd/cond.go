@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conditional assembly.
+//
+//	.IFDEF  BOARD_B
+//	.EQU    LEDS, 8
+//	.ELSEIF REV >= 2
+//	.EQU    LEDS, 4
+//	.ELSE
+//	.EQU    LEDS, 1
+//	.ENDIF
+//
+// .IF and .ELSEIF take a constant expression, which is true when it is not
+// 0. .IFDEF and .IFNDEF take a symbol: a constant predefined with -D, or a
+// constant or label defined on an earlier line. Only the lines of the first
+// true branch are assembled; the lines of the other branches are dropped
+// without being looked at, so they may use symbols that are not defined.
+//
+// Conditions are evaluated while the source is read, after inclusion and
+// before macro expansion, so a condition can choose which macros are defined.
+// They can use the -D constants and the .EQU constants of earlier lines whose
+// value does not depend on an address. A condition in a macro body is
+// evaluated at every expansion, after the arguments are substituted, and
+// also sees the constants and labels defined by earlier expansions.
+
+// condSym is a symbol known to conditions.
+type condSym struct {
+	value    int64
+	constant bool // A constant whose value is known, not a label
+	at       int  // Output line defining it, -1 for -D
+}
+
+// condFrame is an open .IF.
+type condFrame struct {
+	pos     srcLine // The .IF
+	active  bool    // The lines of the current branch are assembled
+	taken   bool    // A branch was taken, or the enclosing region is skipped
+	sawElse bool
+}
+
+// conditions evaluates the conditional directives of a source.
+type conditions struct {
+	syms  map[string]condSym
+	arith ArithMode
+	stack []condFrame
+}
+
+// newConditions returns conditions that know the -D constants of opts.
+func newConditions(opts Options) *conditions {
+	c := &conditions{syms: make(map[string]condSym), arith: opts.Arith}
+	for name, v := range opts.Defines {
+		c.syms[name] = condSym{value: v, constant: true, at: -1}
+	}
+	return c
+}
+
+// expandConditionals drops the lines of src in the branches not taken and
+// the conditional directives themselves. Macro bodies are copied unchanged;
+// their conditions are left to expandMacros. source gives the origin of each
+// line of src (see expandIncludes); expandConditionals returns the result,
+// the origin of each of its lines and the conditions for expandMacros.
+func expandConditionals(src string, source []srcLine, opts Options) (string, []srcLine, *conditions, error) {
+	c := newConditions(opts)
+	var out []string
+	var lines []srcLine
+	inMacro := false
+	for i, l := range strings.Split(src, "\n") {
+		pos := source[i]
+		_, word, _ := splitMacroLine(l)
+		switch {
+		case inMacro:
+			inMacro = !strings.EqualFold(word, ".ENDM")
+		case !c.active() && !isCondDirective(word):
+			continue
+		default:
+			ok, err := c.directive(l, pos, len(out))
+			if err != nil {
+				return "", nil, nil, err
+			}
+			if ok {
+				continue
+			}
+			inMacro = strings.EqualFold(word, ".MACRO")
+			if !inMacro {
+				c.note(l, len(out))
+			}
+		}
+		out, lines = append(out, l), append(lines, pos)
+	}
+	if err := c.end(0); err != nil {
+		return "", nil, nil, err
+	}
+	return strings.Join(out, "\n"), lines, c, nil
+}
+
+// isCondDirective reports whether word is a conditional directive.
+func isCondDirective(word string) bool {
+	switch strings.ToUpper(word) {
+	case ".IF", ".IFDEF", ".IFNDEF", ".ELSEIF", ".ELSE", ".ENDIF":
+		return true
+	}
+	return false
+}
+
+// active reports whether the current line is assembled.
+func (c *conditions) active() bool {
+	return len(c.stack) == 0 || c.stack[len(c.stack)-1].active
+}
+
+// directive handles a line if it is a conditional directive and reports
+// whether it was one. at is the output line the directive stands at.
+func (c *conditions) directive(text string, pos srcLine, at int) (bool, error) {
+	label, word, args := splitMacroLine(text)
+	word = strings.ToUpper(word)
+	if !isCondDirective(word) {
+		return false, nil
+	}
+	args = strings.TrimSpace(args)
+	outer := c.active()
+	if n := len(c.stack); n > 0 && word != ".IF" && word != ".IFDEF" && word != ".IFNDEF" {
+		outer = n == 1 || c.stack[n-2].active
+	}
+	if label != "" && outer {
+		return true, fileError(pos.File, fmt.Errorf("label %s on %s at line %s; put it on a line of its own", label, word, pos))
+	}
+	switch word {
+	case ".IF", ".IFDEF", ".IFNDEF":
+		f := condFrame{pos: pos, taken: true}
+		if outer {
+			v, err := c.test(word, args, pos, at)
+			if err != nil {
+				return true, err
+			}
+			f.active, f.taken = v, v
+		}
+		c.stack = append(c.stack, f)
+		return true, nil
+	}
+	if len(c.stack) == 0 {
+		return true, fileError(pos.File, fmt.Errorf("%s without .IF at line %s", word, pos))
+	}
+	f := &c.stack[len(c.stack)-1]
+	switch word {
+	case ".ELSEIF":
+		if f.sawElse {
+			return true, fileError(pos.File, fmt.Errorf(".ELSEIF after .ELSE at line %s (.IF at line %s)", pos, f.pos))
+		}
+		f.active = false
+		if !f.taken {
+			v, err := c.test(".IF", args, pos, at)
+			if err != nil {
+				return true, err
+			}
+			f.active, f.taken = v, v
+		}
+	case ".ELSE":
+		if f.sawElse {
+			return true, fileError(pos.File, fmt.Errorf("duplicate .ELSE at line %s (.IF at line %s)", pos, f.pos))
+		}
+		f.active, f.taken, f.sawElse = !f.taken, true, true
+	case ".ENDIF":
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	return true, nil
+}
+
+// test evaluates the condition of .IF, .ELSEIF, .IFDEF or .IFNDEF.
+func (c *conditions) test(word, args string, pos srcLine, at int) (bool, error) {
+	if word == ".IF" || word == ".ELSEIF" {
+		v, err := c.eval(args, at)
+		if err != nil {
+			return false, fileError(pos.File, fmt.Errorf("invalid condition at line %s: %v", pos, err))
+		}
+		return v != 0, nil
+	}
+	if !identifierPattern.MatchString(args) {
+		return false, fileError(pos.File, fmt.Errorf("expected a symbol after %s at line %s, got %q", word, pos, args))
+	}
+	_, defined := c.lookup(args, at)
+	return defined == (word == ".IFDEF"), nil
+}
+
+// eval evaluates a condition with the constants defined before output line
+// at.
+func (c *conditions) eval(text string, at int) (int64, error) {
+	e, err := parseExpr(text)
+	if err != nil {
+		return 0, err
+	}
+	cg := &CodeGenerator{Equs: make(map[string]int64), Arith: c.arith}
+	if err := c.bind(e, at, cg.Equs); err != nil {
+		return 0, err
+	}
+	return cg.eval(e)
+}
+
+// bind copies the value of every symbol of e into equs.
+func (c *conditions) bind(e expr, at int, equs map[string]int64) error {
+	switch e := e.(type) {
+	case *hereExpr:
+		return fmt.Errorf("$ has no value in a condition")
+	case *symExpr:
+		s, ok := c.lookup(e.name, at)
+		switch {
+		case !ok:
+			return fmt.Errorf("undefined symbol %s", e.name)
+		case !s.constant:
+			return fmt.Errorf("%s has no value before addresses are assigned", e.name)
+		}
+		equs[e.name] = s.value
+	case *unaryExpr:
+		return c.bind(e.x, at, equs)
+	case *binaryExpr:
+		if err := c.bind(e.x, at, equs); err != nil {
+			return err
+		}
+		return c.bind(e.y, at, equs)
+	case *callExpr:
+		for _, a := range e.args {
+			if err := c.bind(a, at, equs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns a symbol defined before output line at, or on that line by
+// a macro expansion.
+func (c *conditions) lookup(name string, at int) (condSym, bool) {
+	s, ok := c.syms[name]
+	return s, ok && s.at <= at
+}
+
+// note records the label and .EQU constant an assembled line at output line
+// at defines. A constant whose value cannot be computed yet, because it
+// depends on an address, is defined but has no value.
+func (c *conditions) note(text string, at int) {
+	label, word, args := splitMacroLine(text)
+	if identifierPattern.MatchString(label) {
+		c.define(label, condSym{at: at})
+	}
+	if !strings.EqualFold(word, ".EQU") {
+		return
+	}
+	name, value, ok := strings.Cut(strings.TrimSpace(args), ",")
+	if name = strings.TrimSpace(name); !ok || !identifierPattern.MatchString(name) {
+		return
+	}
+	s := condSym{at: at}
+	if v, err := c.eval(value, at); err == nil {
+		s.value, s.constant = v, true
+	}
+	c.define(name, s)
+}
+
+// define records a symbol unless it is defined already; duplicates are
+// reported by layout.
+func (c *conditions) define(name string, s condSym) {
+	if _, dup := c.syms[name]; !dup {
+		c.syms[name] = s
+	}
+}
+
+// end reports a .IF above depth without its .ENDIF.
+func (c *conditions) end(depth int) error {
+	if len(c.stack) > depth {
+		f := c.stack[depth]
+		c.stack = c.stack[:depth]
+		return fileError(f.pos.File, fmt.Errorf("missing .ENDIF for .IF at line %s", f.pos))
+	}
+	return nil
+}
+
+// ParseDefine parses a -D option, NAME or NAME=value, where the value is a
+// constant expression and defaults to 1.
+func ParseDefine(s string) (string, int64, error) {
+	name, value, hasValue := strings.Cut(s, "=")
+	if !identifierPattern.MatchString(name) {
+		return "", 0, fmt.Errorf("invalid symbol name %q in -D %s", name, s)
+	}
+	if !hasValue {
+		return name, 1, nil
+	}
+	v, err := newConditions(Options{}).eval(value, 0)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value in -D %s: %v", s, err)
+	}
+	return name, v, nil
+}
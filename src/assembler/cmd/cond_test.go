@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+// condSource assembles src with the given -D constants.
+func condSource(t *testing.T, src string, defines map[string]int64) (*CodeGenerator, error) {
+	t.Helper()
+	ctx := &CompilationContext{
+		SourceFile:   "test.asm",
+		SourceCode:   src,
+		ErrorManager: NewErrorManager(),
+		SymbolTable:  NewSymbolTable(),
+		Options:      Options{Defines: defines},
+	}
+	if err := runParsing(ctx); err != nil {
+		return nil, err
+	}
+	if ctx.ErrorManager.HasErrors() {
+		t.Fatalf("syntax errors: %v", ctx.ErrorManager.Errors)
+	}
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.Defines = defines
+	return cg, cg.Generate(ctx.AST)
+}
+
+func TestConditionals(t *testing.T) {
+	src := `.IFNDEF REV
+.EQU REV, 1
+.ENDIF
+.IFDEF BOARD_B
+.EQU LEDS, 8
+.ELSEIF REV >= 2 && REV != 5
+.EQU LEDS, 4
+.ELSE
+.EQU LEDS, 1
+.IF 0
+        ADD T0, T0, nowhere
+.ENDIF
+.ENDIF
+.MACRO BLINK n
+.IF n > 4
+        ADD T1, T1, n
+.EXITM
+.ENDIF
+        ADD T2, T2, n
+.ENDM
+        BLINK LEDS
+`
+	for _, c := range []struct {
+		defines map[string]int64
+		leds    int64
+		rd      uint8
+	}{
+		{nil, 1, 2},
+		{map[string]int64{"REV": 2}, 4, 2},
+		{map[string]int64{"REV": 5}, 1, 2},
+		{map[string]int64{"BOARD_B": 1}, 8, 1},
+	} {
+		cg, err := condSource(t, src, c.defines)
+		if err != nil {
+			t.Errorf("%v: %v", c.defines, err)
+			continue
+		}
+		if cg.Equs["LEDS"] != c.leds {
+			t.Errorf("%v: LEDS = %d, want %d", c.defines, cg.Equs["LEDS"], c.leds)
+		}
+		words := slotWords(cg.Output)
+		if len(words) != 1 || words[0].Rd != c.rd {
+			t.Errorf("%v: BLINK = %+v, want one ADD to T%d", c.defines, words, c.rd)
+		}
+	}
+
+	for _, c := range []struct {
+		src  string
+		want string
+	}{
+		{".IF 1\n", "missing .ENDIF for .IF at line 1"},
+		{".ENDIF\n", ".ENDIF without .IF at line 1"},
+		{".IF 1\n.ELSE\n.ELSE\n.ENDIF\n", "duplicate .ELSE at line 3 (.IF at line 1)"},
+		{".IF 0\n.ELSE\n.ELSEIF 1\n.ENDIF\n", ".ELSEIF after .ELSE at line 3"},
+		{".IF MISSING\n.ENDIF\n", "invalid condition at line 1: undefined symbol MISSING"},
+		{"start:\n.IF start\n.ENDIF\n", "start has no value before addresses are assigned"},
+		{".IFDEF 1x\n.ENDIF\n", "expected a symbol after .IFDEF at line 1"},
+		{".EQU REV, 3\n", "constant 'REV' at line 1 is already defined with -D"},
+		{".MACRO M\n.IF 1\n.ENDM\n        M\n", "missing .ENDIF for .IF at line 2#1"},
+	} {
+		_, err := condSource(t, c.src, map[string]int64{"REV": 2})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error %v, want %q", c.src, err, c.want)
+		}
+	}
+}
+
+func TestParseDefine(t *testing.T) {
+	for _, c := range []struct {
+		arg, name string
+		v         int64
+	}{
+		{"BOARD_B", "BOARD_B", 1},
+		{"REV=3", "REV", 3},
+		{"MASK=0x10|1", "MASK", 17},
+	} {
+		name, v, err := ParseDefine(c.arg)
+		if err != nil || name != c.name || v != c.v {
+			t.Errorf("ParseDefine(%q) = %s, %d, %v, want %s, %d", c.arg, name, v, err, c.name, c.v)
+		}
+	}
+	for _, arg := range []string{"1X=2", "X=Y", "X="} {
+		if _, _, err := ParseDefine(arg); err == nil {
+			t.Errorf("ParseDefine(%q) succeeded", arg)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Disassemble renders one instruction slot as assembly text. It is the
+// inverse of encodeInstruction and uses the same ISA table. Jump and branch
+// targets are shown as signed slot offsets relative to the instruction
+// (e.g. "BEQ T3, 0, +9"); PC-relative memory operands as [TC+disp].
+func Disassemble(w InstrWord) (string, error) {
+	desc, ok := LookupEncoding(w.Type, w.Opcode)
+	if !ok {
+		return "", fmt.Errorf("unknown instruction: type %s opcode %06b", w.Type, w.Opcode)
+	}
+	ctx := decodeContexts(desc, w)
+	regName := func(f Field) string {
+		code := w.reg(f)
+		if code == RegSpecial {
+			return contextNames[ctx[f]]
+		}
+		return fmt.Sprintf("T%d", code)
+	}
+	ops := make([]string, 0, len(desc.Operands))
+	for _, spec := range desc.Operands {
+		switch spec.Kind {
+		case KindGPR:
+			ops = append(ops, regName(spec.Field))
+		case KindVec:
+			ops = append(ops, [...]string{"VA", "VT", "VB", "V3", "V4", "V5", "V6", "V7"}[w.reg(spec.Field)])
+		case KindFP:
+			ops = append(ops, [...]string{"FA", "FT", "FB", "F3", "F4", "F5", "F6", "F7"}[w.reg(spec.Field)])
+		case KindImm:
+			ops = append(ops, fmt.Sprintf("%d", w.Imm))
+		case KindSrc, KindShift:
+			if desc.immForm(w) {
+				ops = append(ops, fmt.Sprintf("%d", w.Imm))
+			} else {
+				ops = append(ops, regName(spec.Field))
+			}
+		case KindCmp:
+			if desc.immForm(w) {
+				ops = append(ops, fmt.Sprintf("%d", signExtend(uint32(w.Rs2), 3)))
+			} else {
+				ops = append(ops, regName(spec.Field))
+			}
+		case KindTarget:
+			ops = append(ops, fmt.Sprintf("%+d", w.Imm))
+		case KindMem:
+			if desc.immForm(w) {
+				ops = append(ops, fmt.Sprintf("%d", w.Imm))
+			} else {
+				ops = append(ops, disasmMem(w, regName))
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return desc.Mnemonic, nil
+	}
+	return desc.Mnemonic + " " + strings.Join(ops, ", "), nil
+}
+
+// disasmMem renders the memory operand of a MEM instruction.
+func disasmMem(w InstrWord, regName func(Field) string) string {
+	base := regName(FieldRs1)
+	if w.Imm&memIndexedBit != 0 {
+		return fmt.Sprintf("[%s+%s]", base, regName(FieldRs2))
+	}
+	disp := signExtend(uint32(w.Imm), 10)
+	switch {
+	case disp == 0 && base != "TC":
+		return fmt.Sprintf("[%s]", base)
+	case disp < 0:
+		return fmt.Sprintf("[%s-%d]", base, -disp)
+	}
+	return fmt.Sprintf("[%s+%d]", base, disp)
+}
+
+// signExtend interprets the low bits of v as a two's complement number.
+func signExtend(v uint32, bits uint) int64 {
+	v &= 1<<bits - 1
+	if v&(1<<(bits-1)) != 0 {
+		return int64(v) - 1<<bits
+	}
+	return int64(v)
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OpType is the 3-bit operation type field of an instruction slot.
+// Together with the 6-bit opcode it selects the operation (two-level encoding).
+type OpType uint8
+
+const (
+	OpTypeALU   OpType = 0 // 000: Arithmetic and logical operations
+	OpTypeMEM   OpType = 1 // 001: Memory load/store operations
+	OpTypeCTRL  OpType = 2 // 010: Control flow operations
+	OpTypeVEC   OpType = 3 // 011: Vector/SIMD operations
+	OpTypeFPU   OpType = 4 // 100: Floating-point operations
+	OpTypeSYS   OpType = 5 // 101: System control operations
+	OpTypeUCODE OpType = 6 // 110: Microcode complex operations
+)
+
+func (t OpType) String() string {
+	switch t {
+	case OpTypeALU:
+		return "ALU"
+	case OpTypeMEM:
+		return "MEM"
+	case OpTypeCTRL:
+		return "CTRL"
+	case OpTypeVEC:
+		return "VEC"
+	case OpTypeFPU:
+		return "FPU"
+	case OpTypeSYS:
+		return "SYS"
+	case OpTypeUCODE:
+		return "UCODE"
+	}
+	return fmt.Sprintf("TYPE%d", uint8(t))
+}
+
+// Bit layout of a 32-bit instruction slot (docs/addendums/instructions.adoc):
+//
+//	[31:26] Opcode | [25:23] Rd | [22:20] Rs1 | [19:17] Rs2 | [16:6] Imm | [5:3] Type | [2:0] Par
+const (
+	opcodeShift = 26
+	rdShift     = 23
+	rs1Shift    = 20
+	rs2Shift    = 17
+	immShift    = 6
+	typeShift   = 3
+	parShift    = 0
+
+	opcodeMask = 0x3F
+	regMask    = 0x7
+	immMask    = 0x7FF
+	typeMask   = 0x7
+	parMask    = 0x7
+
+	// InstrSlotBytes is the size of one encoded instruction slot in the output stream.
+	InstrSlotBytes = 4
+	// VLIWSlots is the number of instruction slots in a VLIW bundle.
+	VLIWSlots = 3
+)
+
+// Parallel execution flags of the Par field (docs/vliw_encoding.adoc).
+// Values 5-7 are reserved.
+const (
+	ParSerial  = 0 // 000: no other operation runs alongside
+	ParALU     = 1 // 001: runs alongside ALU operations
+	ParMemory  = 2 // 010: runs alongside a memory operation
+	ParControl = 3 // 011: runs alongside a control operation
+	ParFull    = 4 // 100: runs alongside operations of several units
+	parMaxUsed = ParFull
+)
+
+// parNames is indexed by Par value.
+var parNames = [...]string{"serial", "alu", "mem", "ctrl", "full"}
+
+// RegSpecial is the 3-bit register code that selects the special register context.
+// A second 3-bit context selector then names the register.
+const RegSpecial = 0x7
+
+// Special register context selectors (docs/addendums/instructions.adoc).
+const (
+	CtxTA = 0 // Accumulator
+	CtxTB = 1 // Base pointer
+	CtxTC = 2 // Program counter
+	CtxTS = 3 // Status register
+	CtxTI = 4 // Instruction register
+	CtxVA = 5 // Vector A
+	CtxVT = 6 // Vector T
+	CtxVB = 7 // Vector B
+
+	// specialBase is added to a context selector to form the register
+	// number returned by regNum.
+	specialBase = 8
+)
+
+// contextNames is indexed by context selector.
+var contextNames = [8]string{"TA", "TB", "TC", "TS", "TI", "VA", "VT", "VB"}
+
+// specialContexts maps special register names to their context selector.
+var specialContexts = map[string]uint8{
+	"TA": CtxTA, "TB": CtxTB, "TC": CtxTC, "TS": CtxTS,
+	"TI": CtxTI, "VA": CtxVA, "VT": CtxVT, "VB": CtxVB,
+}
+
+// Addressing modes of memory operations, carried in the immediate field.
+// imm[10] clear selects [Rs1+disp] with a 10-bit signed displacement,
+// imm[10] set selects [Rs1+Rs2] (register indexed). The absolute form (the
+// ImmOpcode of the instruction) ignores Rs1 and takes the address itself.
+const (
+	memIndexedBit = 1 << 10
+	memDispMask   = 0x3FF
+	memDispMin    = -512
+	memDispMax    = 511
+	memAbsMax     = 1023
+)
+
+// Control-flow offsets are PC-relative and counted in instruction slots
+// (TC + 1 is the next slot). A branch in its register-immediate form compares
+// Rs1 with the signed 3-bit constant held in the Rs2 field.
+const (
+	ctrlOffsetMin = -1024
+	ctrlOffsetMax = 1023
+	cmpImmMin     = -4
+	cmpImmMax     = 3
+	cmpImmMask    = 0x7
+)
+
+// InstrWord holds the decoded fields of one instruction slot before packing.
+type InstrWord struct {
+	Opcode uint8  // 6-bit operation code within Type
+	Rd     uint8  // 3-bit destination register
+	Rs1    uint8  // 3-bit source register 1
+	Rs2    uint8  // 3-bit source register 2
+	Imm    int32  // 11-bit immediate/offset (stored two's complement)
+	Type   OpType // 3-bit operation type
+	Par    uint8  // 3-bit parallel execution flags
+
+	ctx [3]uint8 // pending context selector+1 per register field, placed by placeContexts
+}
+
+// Pack assembles the fields into the 32-bit slot layout.
+func (w InstrWord) Pack() uint32 {
+	return uint32(w.Opcode&opcodeMask)<<opcodeShift |
+		uint32(w.Rd&regMask)<<rdShift |
+		uint32(w.Rs1&regMask)<<rs1Shift |
+		uint32(w.Rs2&regMask)<<rs2Shift |
+		(uint32(w.Imm)&immMask)<<immShift |
+		uint32(uint8(w.Type)&typeMask)<<typeShift |
+		uint32(w.Par&parMask)<<parShift
+}
+
+// Bytes returns the packed slot in memory order (little-endian, see docs/vliw_encoding.adoc).
+func (w InstrWord) Bytes() [InstrSlotBytes]byte {
+	var out [InstrSlotBytes]byte
+	binary.LittleEndian.PutUint32(out[:], w.Pack())
+	return out
+}
+
+// UnpackInstrWord splits a 32-bit slot back into its fields.
+// The immediate is sign-extended from 11 bits.
+func UnpackInstrWord(v uint32) InstrWord {
+	imm := int32(v>>immShift) & immMask
+	if imm&0x400 != 0 {
+		imm -= 0x800
+	}
+	return InstrWord{
+		Opcode: uint8(v>>opcodeShift) & opcodeMask,
+		Rd:     uint8(v>>rdShift) & regMask,
+		Rs1:    uint8(v>>rs1Shift) & regMask,
+		Rs2:    uint8(v>>rs2Shift) & regMask,
+		Imm:    imm,
+		Type:   OpType(uint8(v>>typeShift) & typeMask),
+		Par:    uint8(v>>parShift) & parMask,
+	}
+}
+
+// setReg stores a register number in the field for operand position pos
+// (0 = Rd, 1 = Rs1, 2 = Rs2). Special registers are encoded as RegSpecial;
+// their context selector is kept until placeContexts finds room for it.
+func (w *InstrWord) setReg(pos int, rn byte) {
+	field := rn
+	if rn >= specialBase {
+		field = RegSpecial
+		w.ctx[pos] = rn - specialBase + 1
+	}
+	switch pos {
+	case 0:
+		w.Rd = field
+	case 1:
+		w.Rs1 = field
+	case 2:
+		w.Rs2 = field
+	}
+}
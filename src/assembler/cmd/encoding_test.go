@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestInstrWordPack(t *testing.T) {
+	// ADD T0, T1, T2 -> opcode 000001, Rd 000, Rs1 001, Rs2 010, type ALU
+	w := InstrWord{Opcode: 0x01, Rd: 0, Rs1: 1, Rs2: 2, Type: OpTypeALU}
+	if got := w.Pack(); got != 0x04140000 {
+		t.Errorf("Pack() = %08X, want 04140000", got)
+	}
+	// NOP -> opcode 000000, type SYS
+	w = InstrWord{Type: OpTypeSYS}
+	if got := w.Pack(); got != 0x00000028 {
+		t.Errorf("Pack() = %08X, want 00000028", got)
+	}
+	b := InstrWord{Opcode: 0x01, Rs1: 1, Rs2: 2}.Bytes()
+	if b != [4]byte{0x00, 0x00, 0x14, 0x04} {
+		t.Errorf("Bytes() = % X, want little-endian 00 00 14 04", b)
+	}
+}
+
+func TestInstrWordRoundTrip(t *testing.T) {
+	cases := []InstrWord{
+		{Opcode: 0x3F, Rd: 7, Rs1: 6, Rs2: 5, Imm: 1023, Type: OpTypeUCODE, Par: 4},
+		{Opcode: 0x04, Rd: 0, Rs1: 3, Rs2: 0, Imm: -1024, Type: OpTypeCTRL, Par: 0},
+		{Opcode: 0x00, Rd: 1, Rs1: 2, Rs2: 3, Imm: -1, Type: OpTypeMEM, Par: 2},
+	}
+	for _, want := range cases {
+		if got := UnpackInstrWord(want.Pack()); got != want {
+			t.Errorf("UnpackInstrWord(Pack(%+v)) = %+v", want, got)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 type CustomErrorListener struct {
 	*antlr.DefaultErrorListener
 	Errors *ErrorManager
+	Source []srcLine // Origin of each parsed line, see expandMacros
 }
 
 // NewCustomErrorListener creates a new CustomErrorListener.
@@ -23,5 +24,9 @@ func NewCustomErrorListener(errors *ErrorManager) *CustomErrorListener {
 // SyntaxError is called by ANTLR when a syntax error is detected.
 func (l *CustomErrorListener) SyntaxError(recognizer antlr.Recognizer, offendingSymbol interface{}, line, column int, msg string, e antlr.RecognitionException) {
 	// Format a more user-friendly error message
-	l.Errors.Errors = append(l.Errors.Errors, fmt.Errorf("syntax error at line %d:%d: %s", line, column, msg))
+	file := ""
+	if line >= 1 && line <= len(l.Source) {
+		file, line = l.Source[line-1].File, l.Source[line-1].Line
+	}
+	l.Errors.Errors = append(l.Errors.Errors, fileError(file, fmt.Errorf("syntax error at line %d:%d: %s", line, column, msg)))
 }
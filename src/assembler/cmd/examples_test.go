@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestExamples assembles every program shipped in examples/.
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "examples", "*.asm"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no examples found: %v", err)
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &CompilationContext{
+			SourceFile:   file,
+			SourceCode:   string(src),
+			ErrorManager: NewErrorManager(),
+			SymbolTable:  NewSymbolTable(),
+		}
+		if err := runParsing(ctx); err != nil {
+			t.Errorf("%s: parsing failed: %v", file, err)
+			continue
+		}
+		if ctx.ErrorManager.HasErrors() {
+			t.Errorf("%s: syntax errors: %v", file, ctx.ErrorManager.Errors)
+			continue
+		}
+		if err := runCodeGeneration(ctx); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,756 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kvany/vtx1/assembler/pkg/ternary"
+)
+
+// Constant expressions.
+//
+// Instruction operands, memory displacements and the values of .EQU, .ORG,
+// .SPACE, .ALIGN, .FILL, .DB, .DW and .DT are constant expressions:
+//
+//	LD   T0, [TB+2*4]
+//	.EQU SIZE, end-start
+//	.ORG $+0x100
+//	.DW  HIGH(table), LOW(table), -1
+//
+// Operators, from lowest to highest precedence:
+//
+//	||        logical or
+//	&&        logical and
+//	|         bitwise or
+//	^         bitwise exclusive or
+//	&         bitwise and
+//	== !=     equality
+//	< <= > >= comparison
+//	<< >>     shifts (arithmetic right shift)
+//	+ -       addition, subtraction
+//	* / %     multiplication, truncating division, remainder
+//	- + ~ !   unary minus, plus, bitwise not and logical not
+//
+// These are the meanings in binary arithmetic; fold.go describes ternary
+// arithmetic, selected with -arith ternary. Comparisons and logical operators
+// give 1 for true and 0 for false in both arithmetics, and take any value
+// other than 0 as true.
+//
+// Operands are literals, symbols, local labels (see locals.go), $ (the
+// address of the current line), parenthesized expressions and the functions
+// below. A ternary literal takes every following +, - and 0, so write
+// "0t+- + 1" rather than "0t+-+1".
+//
+//	HIGH(x), LOW(x)    high and low 9-trit tryte of the 18-trit word x, so
+//	                   x = HIGH(x)*19683 + LOW(x)
+//	SIZEOF(label)      addresses from label to the next label or .ORG
+//	TAND(x, y)         tritwise minimum of two 18-trit words
+//	TOR(x, y)          tritwise maximum
+//	TNOT(x)            tritwise negation
+//
+// The grammar only accepts a literal, a symbol or "a+b" in these places, so
+// rewriteExpressions replaces every other operand by a literal of the same
+// width before parsing, and attachExpressions puts it back into the AST as an
+// ExprNode. Line and column numbers are unchanged.
+
+// expr is a parsed constant expression.
+type expr interface{}
+
+type numExpr struct {
+	v    int64
+	text string // As written
+}
+
+type symExpr struct{ name string }
+
+type hereExpr struct{}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+type callExpr struct {
+	fn   string
+	args []expr
+}
+
+// exprFuncs gives the number of arguments of each function.
+var exprFuncs = map[string]int{
+	"HIGH":   1,
+	"LOW":    1,
+	"SIZEOF": 1,
+	"TAND":   2,
+	"TOR":    2,
+	"TNOT":   1,
+}
+
+// exprLevels lists the binary operators from lowest to highest precedence.
+var exprLevels = [][]string{{"||"}, {"&&"}, {"|"}, {"^"}, {"&"}, {"==", "!="}, {"<=", ">=", "<", ">"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}}
+
+// exprLongOps lists the operators of two characters, so that "&" is not
+// taken from the start of "&&".
+var exprLongOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<<", ">>"}
+
+// exprParser is a recursive descent parser over the text of one expression.
+type exprParser struct {
+	src string
+	pos int
+}
+
+// parseExpr parses the text of a constant expression.
+func parseExpr(src string) (expr, error) {
+	p := &exprParser{src: src}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q", p.src[p.pos:])
+	}
+	return e, nil
+}
+
+func (p *exprParser) skip() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes the first of ops that follows, unless a longer operator
+// starts with it.
+func (p *exprParser) accept(ops ...string) string {
+	p.skip()
+	rest := p.src[p.pos:]
+	long := false
+	for _, op := range exprLongOps {
+		long = long || strings.HasPrefix(rest, op)
+	}
+	for _, op := range ops {
+		if strings.HasPrefix(rest, op) && (len(op) > 1 || !long) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) binary(level int) (expr, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.accept(exprLevels[level]...)
+		if op == "" {
+			return x, nil
+		}
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if op := p.accept("-", "+", "~", "!"); op != "" {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (expr, error) {
+	p.skip()
+	if p.pos == len(p.src) {
+		return nil, fmt.Errorf("missing operand")
+	}
+	start := p.pos
+	switch c := p.src[p.pos]; {
+	case c == '(':
+		p.pos++
+		x, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.accept(")") == "" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return x, nil
+	case c == '$':
+		p.pos++
+		return &hereExpr{}, nil
+	case isDigit(c) && isNumericRef(p.src[p.pos:]):
+		for isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+		p.pos++
+		return &symExpr{name: p.src[start:p.pos]}, nil
+	case isDigit(c):
+		if strings.HasPrefix(p.src[p.pos:], "0t") {
+			p.pos += 2
+			for p.pos < len(p.src) && strings.IndexByte("+-0", p.src[p.pos]) >= 0 {
+				p.pos++
+			}
+		} else {
+			for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+		text := p.src[start:p.pos]
+		v, err := parseImmediateOperand(&ImmediateNode{Value: text})
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", text)
+		}
+		return &numExpr{v: v, text: text}, nil
+	case isIdentChar(c) || c == '.' && p.pos+1 < len(p.src) && isIdentChar(p.src[p.pos+1]):
+		// A symbol, a local label, a qualified local label or a label of a
+		// macro expansion
+		p.pos++
+		for p.pos < len(p.src) && (isIdentChar(p.src[p.pos]) ||
+			p.src[p.pos] == '.' && p.pos+1 < len(p.src) && isIdentChar(p.src[p.pos+1]) ||
+			p.src[p.pos] == '#' && p.pos+1 < len(p.src) && isDigit(p.src[p.pos+1])) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.accept("(") == "" {
+			return &symExpr{name: name}, nil
+		}
+		fn := strings.ToUpper(name)
+		arity, ok := exprFuncs[fn]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", name)
+		}
+		call := &callExpr{fn: fn}
+		for p.accept(")") == "" {
+			if len(call.args) > 0 && p.accept(",") == "" {
+				return nil, fmt.Errorf("missing , or ) in %s()", fn)
+			}
+			x, err := p.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, x)
+		}
+		if len(call.args) != arity {
+			return nil, fmt.Errorf("%s takes %d argument(s), got %d", fn, arity, len(call.args))
+		}
+		return call, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", p.src[p.pos:])
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// isNumericRef reports whether s starts with a numeric label reference such
+// as 1f or 12b.
+func isNumericRef(s string) bool {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i > 0 && i < len(s) && (s[i] == 'f' || s[i] == 'b') && (i+1 == len(s) || !isIdentChar(s[i+1]))
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+// eval computes the value of e.
+func (cg *CodeGenerator) eval(e expr) (int64, error) {
+	switch e := e.(type) {
+	case *numExpr:
+		return cg.checkWord(e.v), nil
+	case *hereExpr:
+		return int64(cg.here), nil
+	case *symExpr:
+		v, ok := cg.symbolValue(e.name)
+		if !ok {
+			return 0, fmt.Errorf("undefined symbol %s", e.name)
+		}
+		return v, nil
+	case *unaryExpr:
+		x, err := cg.eval(e.x)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case e.op == "!":
+			return truth(x == 0), nil
+		case e.op == "-" || e.op == "~" && cg.Arith == ArithTernary:
+			return cg.checkWord(-x), nil
+		case e.op == "~":
+			return ^x, nil
+		}
+		return x, nil
+	case *binaryExpr:
+		x, err := cg.eval(e.x)
+		if err != nil {
+			return 0, err
+		}
+		y, err := cg.eval(e.y)
+		if err != nil {
+			return 0, err
+		}
+		if v, ok := compareOp(e.op, x, y); ok {
+			return v, nil
+		}
+		if cg.Arith == ArithTernary {
+			return cg.ternaryOp(e.op, x, y)
+		}
+		v, err := binaryOp(e.op, x, y)
+		return cg.checkWord(v), err
+	case *callExpr:
+		return cg.call(e)
+	}
+	return 0, fmt.Errorf("invalid expression")
+}
+
+// binaryOp applies a binary operator.
+func binaryOp(op string, x, y int64) (int64, error) {
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "<<", ">>":
+		if y < 0 || y > 63 {
+			return 0, fmt.Errorf("shift count %d is out of range (0..63)", y)
+		}
+		if op == "<<" {
+			return x << uint(y), nil
+		}
+		return x >> uint(y), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", op)
+}
+
+// compareOp applies a comparison or logical operator. ok is false for any
+// other operator.
+func compareOp(op string, x, y int64) (v int64, ok bool) {
+	switch op {
+	case "==":
+		return truth(x == y), true
+	case "!=":
+		return truth(x != y), true
+	case "<":
+		return truth(x < y), true
+	case "<=":
+		return truth(x <= y), true
+	case ">":
+		return truth(x > y), true
+	case ">=":
+		return truth(x >= y), true
+	case "&&":
+		return truth(x != 0 && y != 0), true
+	case "||":
+		return truth(x != 0 || y != 0), true
+	}
+	return 0, false
+}
+
+// truth returns 1 for true and 0 for false.
+func truth(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// call evaluates a function of an expression.
+func (cg *CodeGenerator) call(e *callExpr) (int64, error) {
+	if e.fn == "SIZEOF" {
+		sym, ok := e.args[0].(*symExpr)
+		if !ok {
+			return 0, fmt.Errorf("SIZEOF takes a label")
+		}
+		cg.reference(sym.name)
+		if n, ok := cg.sizes[sym.name]; ok {
+			return int64(n), nil
+		}
+		if cg.provisional {
+			cg.unresolved = true
+			return 0, nil
+		}
+		return 0, fmt.Errorf("SIZEOF of unknown label %s", sym.name)
+	}
+	var words []ternary.Word
+	for _, a := range e.args {
+		v, err := cg.eval(a)
+		if err != nil {
+			return 0, err
+		}
+		w, err := ternary.WordFromInt64(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s argument %d is out of range for an 18-trit word", e.fn, v)
+		}
+		words = append(words, w)
+	}
+	switch e.fn {
+	case "HIGH":
+		_, hi := words[0].Trytes()
+		return hi.Int64(), nil
+	case "LOW":
+		lo, _ := words[0].Trytes()
+		return lo.Int64(), nil
+	case "TAND":
+		return words[0].Min(words[1]).Int64(), nil
+	case "TOR":
+		return words[0].Max(words[1]).Int64(), nil
+	}
+	return words[0].Neg().Int64(), nil // TNOT
+}
+
+// symbolValue returns the value of a label or .EQU constant. During a
+// provisional layout pass a symbol defined further down is not known yet; it
+// counts as 0 and the pass is marked unresolved.
+func (cg *CodeGenerator) symbolValue(name string) (int64, bool) {
+	cg.reference(name)
+	if a, ok := cg.Labels[name]; ok {
+		return int64(a), true
+	}
+	if n, ok := cg.Equs[name]; ok {
+		return n, true
+	}
+	if cg.provisional {
+		cg.unresolved = true
+		return 0, true
+	}
+	return 0, false
+}
+
+// reference records a use of a label for the unused label check. Labels
+// local to a macro are used under the name of their expansion, again#2.
+func (cg *CodeGenerator) reference(name string) {
+	if _, ok := cg.Labels[name]; ok && cg.SymbolTable != nil {
+		cg.SymbolTable.Reference(name)
+	}
+}
+
+// --- Source rewriting ---
+
+// exprPos is the line and 0-based column of a rewritten operand. For a
+// memory operand it is the position of the opening bracket.
+type exprPos struct{ Line, Column int }
+
+var (
+	literalPattern    = regexp.MustCompile(`^(0x[0-9a-fA-F]+|0b[01]+|0t[+\-0]+|[0-9]+)$`)
+	identifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// operandContext says which operands the grammar accepts at a position.
+type operandContext int
+
+const (
+	instrOperand operandContext = iota // register, literal, symbol or memory operand
+	valueOperand                       // literal only
+	dataOperand                        // literal or string
+)
+
+// exprDirectives are the directives whose values are expressions. .EQU
+// starts with the name of the constant.
+var exprDirectives = map[string]operandContext{
+	".ORG":   valueOperand,
+	".SPACE": valueOperand,
+	".ALIGN": valueOperand,
+	".EQU":   valueOperand,
+	".DB":    dataOperand,
+	".DW":    dataOperand,
+	".DT":    dataOperand,
+}
+
+// rewriteExpressions replaces every operand the grammar cannot parse by a
+// literal of the same width, and returns the original operands by position.
+func rewriteExpressions(src string) (string, map[exprPos]string) {
+	exprs := make(map[exprPos]string)
+	lines := strings.Split(src, "\n")
+	for i, l := range lines {
+		r := []rune(l)
+		rewriteLine(r, i+1, exprs)
+		lines[i] = string(r)
+	}
+	return strings.Join(lines, "\n"), exprs
+}
+
+// rewriteLine rewrites the operands of one source line in place.
+func rewriteLine(r []rune, line int, exprs map[exprPos]string) {
+	end := commentStart(r)
+	i := skipSpace(r, 0, end)
+	if i == end {
+		return
+	}
+	if r[i] == '[' {
+		for i < end && r[i] == '[' {
+			close := matchingBracket(r, i, end)
+			if close < 0 {
+				return
+			}
+			rewriteOperands(r, wordEnd(r, skipSpace(r, i+1, close), close), close, line, instrOperand, false, exprs)
+			i = skipSpace(r, close+1, end)
+		}
+		return
+	}
+	we := wordEnd(r, i, end)
+	if r[i] != '.' {
+		// A label, an instruction, or "name: .DW ..." with optional colon
+		j := skipSpace(r, we, end)
+		colon := j < end && r[j] == ':'
+		if colon {
+			j = skipSpace(r, j+1, end)
+		}
+		if j == end {
+			return
+		}
+		dir := strings.ToUpper(string(r[j:wordEnd(r, j, end)]))
+		if _, ok := exprDirectives[dir]; !ok || r[j] != '.' {
+			if !colon {
+				rewriteOperands(r, we, end, line, instrOperand, false, exprs)
+			}
+			return
+		}
+		i, we = j, wordEnd(r, j, end)
+	}
+	name := strings.ToUpper(string(r[i:we]))
+	ctx, ok := exprDirectives[name]
+	if !ok {
+		return
+	}
+	rewriteOperands(r, we, end, line, ctx, name == ".EQU", exprs)
+}
+
+// rewriteOperands rewrites the comma-separated operands in r[from:to].
+func rewriteOperands(r []rune, from, to, line int, ctx operandContext, skipFirst bool, exprs map[exprPos]string) {
+	for n, part := range splitOperands(r, from, to) {
+		s, e := part[0], part[1]
+		for s < e && isSpaceRune(r[s]) {
+			s++
+		}
+		for e > s && isSpaceRune(r[e-1]) {
+			e--
+		}
+		if s == e || (n == 0 && skipFirst) {
+			continue
+		}
+		text := string(r[s:e])
+		switch {
+		case literalPattern.MatchString(text):
+			continue
+		case ctx == dataOperand && len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"':
+			continue
+		case ctx == instrOperand && (isRegisterName(text) || identifierPattern.MatchString(text)):
+			continue
+		case ctx == instrOperand && r[s] == '[' && r[e-1] == ']':
+			rewriteMemoryOperand(r, s, e, line, exprs)
+			continue
+		}
+		exprs[exprPos{line, s}] = text
+		r[s] = '0'
+		for k := s + 1; k < e; k++ {
+			r[k] = ' '
+		}
+	}
+}
+
+// rewriteMemoryOperand rewrites the displacement of [base+expr] or
+// [base-expr] in r[s:e].
+func rewriteMemoryOperand(r []rune, s, e, line int, exprs map[exprPos]string) {
+	i := skipSpace(r, s+1, e-1)
+	i = wordEnd(r, i, e-1)
+	i = skipSpace(r, i, e-1)
+	if i == e-1 || (r[i] != '+' && r[i] != '-') {
+		return
+	}
+	disp := strings.TrimSpace(string(r[i+1 : e-1]))
+	if r[i] == '+' && (literalPattern.MatchString(disp) || isRegisterName(disp)) {
+		return
+	}
+	if r[i] == '-' {
+		disp = "-" + disp
+	}
+	exprs[exprPos{line, s}] = disp
+	r[i], r[i+1] = '+', '0'
+	for k := i + 2; k < e-1; k++ {
+		r[k] = ' '
+	}
+}
+
+// isRegisterName reports whether s is a register token of the grammar.
+func isRegisterName(s string) bool {
+	_, _, ok := registerClass(s)
+	return ok && s == strings.ToUpper(s)
+}
+
+// splitOperands returns the [start, end) ranges of the comma-separated parts
+// of r[from:to], ignoring commas inside brackets, parentheses and strings.
+func splitOperands(r []rune, from, to int) [][2]int {
+	var parts [][2]int
+	depth, quoted, start := 0, false, from
+	for i := from; i < to; i++ {
+		switch c := r[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, [2]int{start, i})
+			start = i + 1
+		}
+	}
+	return append(parts, [2]int{start, to})
+}
+
+// commentStart returns the index of the ; that starts the line comment, or
+// the length of the line.
+func commentStart(r []rune) int {
+	quoted := false
+	for i, c := range r {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ';' && !quoted {
+			return i
+		}
+	}
+	return len(r)
+}
+
+// matchingBracket returns the index of the ] closing the [ at open.
+func matchingBracket(r []rune, open, end int) int {
+	depth := 0
+	for i := open; i < end; i++ {
+		switch r[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isSpaceRune(c rune) bool { return c == ' ' || c == '\t' || c == '\r' }
+
+func skipSpace(r []rune, i, end int) int {
+	for i < end && isSpaceRune(r[i]) {
+		i++
+	}
+	return i
+}
+
+// wordEnd returns the end of the mnemonic, directive or label name at i.
+func wordEnd(r []rune, i, end int) int {
+	for i < end && (r[i] == '.' || r[i] < 0x80 && isIdentChar(byte(r[i]))) {
+		i++
+	}
+	return i
+}
+
+// attachExpressions replaces the placeholders left by rewriteExpressions by
+// ExprNodes holding the original expressions. checkExpressions reports the
+// ones that do not parse, once the lines of the AST are final.
+func attachExpressions(ast *AST, exprs map[exprPos]string) {
+	if len(exprs) == 0 {
+		return
+	}
+	for _, line := range ast.Program.Lines {
+		for _, ops := range operandLists(line.Statement) {
+			for i, op := range ops {
+				switch v := op.(type) {
+				case *ImmediateNode:
+					if text, ok := exprs[exprPos{v.Line, v.Column}]; ok {
+						ops[i] = &ExprNode{Text: text, Line: v.Line, Column: v.Column}
+					}
+				case *MemoryOperandNode:
+					if text, ok := exprs[exprPos{v.Line, v.Column}]; ok {
+						v.Disp = &ExprNode{Text: text, Line: v.Line, Column: v.Column}
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkExpressions parses every expression of the AST and returns the first
+// error.
+func checkExpressions(ast *AST) error {
+	for _, line := range ast.Program.Lines {
+		for _, ops := range operandLists(line.Statement) {
+			for _, op := range ops {
+				n, ok := op.(*ExprNode)
+				if m, isMem := op.(*MemoryOperandNode); isMem {
+					n, ok = m.Disp, m.Disp != nil
+				}
+				if !ok {
+					continue
+				}
+				if _, err := n.parsed(); err != nil {
+					return fileError(line.File, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// operandLists returns the operand lists of a statement: one per instruction,
+// or the parameters of a directive.
+func operandLists(stmt StatementNode) [][]OperandNode {
+	switch s := stmt.(type) {
+	case *InstructionNode:
+		return [][]OperandNode{s.Operands}
+	case *VLIWInstructionNode:
+		var lists [][]OperandNode
+		for _, in := range s.Instructions {
+			lists = append(lists, in.Operands)
+		}
+		return lists
+	case *DirectiveNode:
+		return [][]OperandNode{s.Params}
+	}
+	return nil
+}
+
+// parsed returns the parsed expression of n.
+func (n *ExprNode) parsed() (expr, error) {
+	if n.expr == nil {
+		e, err := parseExpr(n.Text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %s at line %d, column %d: %v", n.Text, n.Line, n.Column+1, err)
+		}
+		n.expr = e
+	}
+	return n.expr, nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpressions(t *testing.T) {
+	src := `        .EQU BASE, 0x10
+        .EQU N, (end-start)/2
+        .EQU MASK, ~0 << 4 & 0xFF | 1
+        .EQU SZ, SIZEOF(table)
+        .EQU HI, HIGH(19683*2+5)
+        .EQU LO, LOW(19683*2+5)
+        .EQU TRIT, TNOT(TAND(0t+-, 0t-+))
+        .EQU LOGIC, (1 | 2 == 2) + (N >= 8 && !(N < 8)) * 2 + (3 || 0) * 4
+        .ORG BASE*2
+start:
+        ADD T0, T1, N+1
+        LD  T2, [TB-4]
+        LD  T3, [TB+N*2]
+        JMP $+4
+end:
+table:  .DB -1, 7 % 4, 1 << 3
+pad:
+        .SPACE 8-SIZEOF(table)
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]int64{"N": 8, "MASK": 0xF1, "SZ": 3, "HI": 2, "LO": 5, "TRIT": 4, "LOGIC": 7}
+	for name, v := range want {
+		if cg.Equs[name] != v {
+			t.Errorf("%s = %d, want %d", name, cg.Equs[name], v)
+		}
+	}
+	if cg.Labels["start"] != 0x20 || cg.Labels["table"] != 0x30 {
+		t.Errorf("start = 0x%X, table = 0x%X, want 0x20, 0x30", cg.Labels["start"], cg.Labels["table"])
+	}
+	words := slotWords(cg.Output[:4*InstrSlotBytes])
+	if words[0].Imm != 9 {
+		t.Errorf("ADD immediate = %d, want 9", words[0].Imm)
+	}
+	if words[1].Imm != -4&memDispMask || words[2].Imm != 16 {
+		t.Errorf("displacements = %d, %d, want -4, 16", words[1].Imm, words[2].Imm)
+	}
+	if words[3].Imm != 1 {
+		t.Errorf("JMP $+4 offset = %d, want 1", words[3].Imm)
+	}
+	if data := cg.Output[16:]; len(data) != 8 || string(data[:3]) != "\xFF\x03\x08" {
+		t.Errorf("data = % X, want FF 03 08 and 5 bytes of .SPACE", data)
+	}
+
+	for _, c := range []struct{ src, want string }{
+		{".DB 1/0\n", "division by zero in 1/0 at line 1, column 5"},
+		{".DW missing+1\n", "undefined symbol missing in missing+1"},
+		{".ORG (4\n", "invalid expression (4 at line 1, column 6: missing )"},
+		{".DB FOO(1)\n", "unknown function FOO"},
+		{".EQU A, B+1\n.EQU B, A\n", "forward references did not settle after 64 layout passes"},
+	} {
+		ctx := &CompilationContext{SourceCode: c.src, ErrorManager: NewErrorManager(), SymbolTable: NewSymbolTable()}
+		err := runParsing(ctx)
+		if err == nil {
+			cg := NewCodeGenerator(ctx.SymbolTable)
+			err = cg.Generate(ctx.AST)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.want)
+		}
+	}
+}
+
+func TestRewriteExpressions(t *testing.T) {
+	src := "lbl: .DW a+1, \"x,y\", 2\n        [ADD T0, T1, -1] [LD T2, [TB+T3]]\n        LD T0, [TB-(2)] ; a-b\n"
+	got, exprs := rewriteExpressions(src)
+	want := "lbl: .DW 0  , \"x,y\", 2\n        [ADD T0, T1, 0 ] [LD T2, [TB+T3]]\n        LD T0, [TB+0  ] ; a-b\n"
+	if got != want {
+		t.Errorf("rewritten source =\n%s\nwant\n%s", got, want)
+	}
+	if len(exprs) != 3 || exprs[exprPos{1, 9}] != "a+1" || exprs[exprPos{2, 21}] != "-1" || exprs[exprPos{3, 15}] != "-(2)" {
+		t.Errorf("expressions = %v", exprs)
+	}
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kvany/vtx1/assembler/pkg/ternary"
+)
+
+// Constant folding.
+//
+// Expressions are folded in one of two arithmetics, selected with -arith:
+//
+//   - binary (the default): 64-bit integers and Go's bitwise operators, as
+//     described in expr.go.
+//   - ternary: 18-trit balanced ternary words, as the machine computes. +, -
+//     and * wrap around modulo 3^18, / rounds to the nearest integer and %
+//     leaves the balanced remainder (-|y|/2..|y|/2, halves rounding toward
+//     zero), << and >> shift by trits, and &, | and ~ are the tritwise AND
+//     (minimum), OR (maximum) and NOT (negation) of the ternary logic unit.
+//     ^ has no hardware counterpart and is rejected.
+//
+// In both arithmetics a value that leaves the 18-trit range anywhere in an
+// expression is reported with a warning. In ternary arithmetic an expression
+// with a hexadecimal or binary literal is also folded in binary, and a
+// warning is reported when the two results differ, because such literals are
+// usually meant as bit masks.
+
+// ArithMode selects the arithmetic of constant expressions.
+type ArithMode int
+
+const (
+	ArithBinary  ArithMode = iota // 64-bit integers, bitwise logic
+	ArithTernary                  // 18-trit balanced ternary words, tritwise logic
+)
+
+var arithModeNames = []string{"binary", "ternary"}
+
+func (m ArithMode) String() string {
+	if int(m) < len(arithModeNames) {
+		return arithModeNames[m]
+	}
+	return fmt.Sprintf("ArithMode(%d)", int(m))
+}
+
+// ParseArithMode converts the value of the -arith flag.
+func ParseArithMode(s string) (ArithMode, error) {
+	for m, name := range arithModeNames {
+		if strings.EqualFold(s, name) {
+			return ArithMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported arithmetic: %s (use binary or ternary)", s)
+}
+
+// checkWord records an overflow when v leaves the 18-trit range and, in
+// ternary arithmetic, wraps it around.
+func (cg *CodeGenerator) checkWord(v int64) int64 {
+	if wordRange.contains(v) {
+		return v
+	}
+	cg.overflow = true
+	if cg.Arith == ArithTernary {
+		return ternary.WrapWord(v).Int64()
+	}
+	return v
+}
+
+// ternaryOp applies a binary operator to two 18-trit words.
+func (cg *CodeGenerator) ternaryOp(op string, x, y int64) (int64, error) {
+	switch op {
+	case "+":
+		return cg.checkWord(x + y), nil
+	case "-":
+		return cg.checkWord(x - y), nil
+	case "*":
+		return cg.checkWord(x * y), nil
+	case "/", "%":
+		q, r, err := ternary.WrapWord(x).DivMod(ternary.WrapWord(y))
+		if err != nil {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			return q.Int64(), nil
+		}
+		return r.Int64(), nil
+	case "<<", ">>":
+		if y < 0 || y >= ternary.WordTrits {
+			return 0, fmt.Errorf("shift count %d is out of range (0..%d trits)", y, ternary.WordTrits-1)
+		}
+		if op == "<<" {
+			for ; y > 0; y-- {
+				x *= 3
+			}
+			return cg.checkWord(x), nil
+		}
+		w, shifted := ternary.WrapWord(x), ternary.Word{}
+		copy(shifted[:], w[y:])
+		return shifted.Int64(), nil
+	case "&":
+		return ternary.WrapWord(x).Min(ternary.WrapWord(y)).Int64(), nil
+	case "|":
+		return ternary.WrapWord(x).Max(ternary.WrapWord(y)).Int64(), nil
+	}
+	return 0, fmt.Errorf("%s has no tritwise meaning, use TAND, TOR or TNOT or fold with -arith binary", op)
+}
+
+// hasBinaryLiteral reports whether e contains a hexadecimal or binary literal.
+func hasBinaryLiteral(e expr) bool {
+	switch e := e.(type) {
+	case *numExpr:
+		lit := strings.ToLower(e.text)
+		return strings.HasPrefix(lit, "0x") || strings.HasPrefix(lit, "0b")
+	case *unaryExpr:
+		return hasBinaryLiteral(e.x)
+	case *binaryExpr:
+		return hasBinaryLiteral(e.x) || hasBinaryLiteral(e.y)
+	case *callExpr:
+		for _, a := range e.args {
+			if hasBinaryLiteral(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fold evaluates the expression of n in the selected arithmetic and reports
+// overflows and binary literals whose ternary reading differs.
+func (cg *CodeGenerator) fold(n *ExprNode, e expr, line int) (int64, error) {
+	cg.overflow = false
+	v, err := cg.eval(e)
+	if err != nil || cg.provisional {
+		return v, err
+	}
+	pos := sourcePos(n, line)
+	if cg.overflow {
+		if cg.Arith == ArithTernary {
+			cg.warn(fmt.Errorf("warning: %s overflows the 18-trit word (-%d..%d) and wraps to %d at %s", n.Text, ternary.WordMax, ternary.WordMax, v, pos))
+		} else {
+			cg.warn(fmt.Errorf("warning: %s leaves the 18-trit word (-%d..%d) at %s; the machine would wrap around", n.Text, ternary.WordMax, ternary.WordMax, pos))
+		}
+	}
+	if cg.Arith == ArithTernary && hasBinaryLiteral(e) {
+		cg.Arith = ArithBinary
+		b, err := cg.eval(e)
+		cg.Arith = ArithTernary
+		if err == nil && b != v {
+			cg.warn(fmt.Errorf("warning: %s is %d in ternary arithmetic but %d in binary at %s; hexadecimal and binary literals are not trit masks", n.Text, v, b, pos))
+		}
+	}
+	return v, nil
+}
+
+// warn reports a code generation warning once.
+func (cg *CodeGenerator) warn(err error) {
+	if cg.warned == nil {
+		cg.warned = make(map[string]bool)
+	}
+	if cg.warned[err.Error()] {
+		return
+	}
+	cg.warned[err.Error()] = true
+	if codegenWarnings != nil {
+		*codegenWarnings = append(*codegenWarnings, err)
+	}
+}
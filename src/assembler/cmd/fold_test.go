@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kvany/vtx1/assembler/pkg/ternary"
+)
+
+func TestTernaryArithmetic(t *testing.T) {
+	var warnings []error
+	AttachCodegenWarnings(&warnings)
+	defer AttachCodegenWarnings(nil)
+
+	src := `        .EQU WRAP, 193710244 + 1
+        .EQU PROD, 19683 * 19683
+        .EQU SL, 1 << 4
+        .EQU SR, 0t+-0+ >> 2
+        .EQU MIN3, 0t+-0 & 0t0++
+        .EQU MAX3, 0t+-0 | 0t0++
+        .EQU NEG3, ~0t+-0
+        .EQU MASK, 0xF0 & 0x0F
+        .EQU QUO, -7 / 2
+        .EQU QNEG, -8 / 3
+        .EQU RNEG, -8 % 3
+        .EQU QDIV, 7 / -3
+        .EQU RDIV, 8 % -3
+        .EQU RBOTH, -7 % -3
+`
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.Arith = ArithTernary
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]int64{
+		"WRAP":  -ternary.WordMax,
+		"PROD":  ternary.WrapWord(19683 * 19683).Int64(),
+		"SL":    81,
+		"SR":    3 - 1,
+		"MIN3":  0*9 - 1*3 + 0, // min(+,0) min(-,+) min(0,+)
+		"MAX3":  9 + 3 + 1,     // max(+,0) max(-,+) max(0,+)
+		"NEG3":  -9 + 3,
+		"MASK":  -12,
+		"QUO":   -3,
+		"QNEG":  -3, // -2.67 rounds to nearest
+		"RNEG":  1,  // -8 = -3*3 + 1
+		"QDIV":  -2,
+		"RDIV":  -1, // 8 = -3*-3 - 1
+		"RBOTH": -1,
+	}
+	for name, v := range want {
+		if cg.Equs[name] != v {
+			t.Errorf("%s = %d, want %d", name, cg.Equs[name], v)
+		}
+	}
+	for _, w := range []string{
+		"193710244 + 1 overflows the 18-trit word (-193710244..193710244) and wraps to -193710244 at line 1",
+		"19683 * 19683 overflows the 18-trit word",
+		"0xF0 & 0x0F is -12 in ternary arithmetic but 0 in binary at line 8",
+	} {
+		found := 0
+		for _, got := range warnings {
+			if strings.Contains(got.Error(), w) {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("warning %q reported %d times in %v", w, found, warnings)
+		}
+	}
+	if len(warnings) != 3 {
+		t.Errorf("warnings = %v, want 3", warnings)
+	}
+
+	ctx = parseSource(t, ".EQU X, 1 ^ 2\n")
+	cg = NewCodeGenerator(ctx.SymbolTable)
+	cg.Arith = ArithTernary
+	if err := cg.Generate(ctx.AST); err == nil || !strings.Contains(err.Error(), "^ has no tritwise meaning") {
+		t.Errorf("ternary ^ error = %v", err)
+	}
+
+	ctx = parseSource(t, ".EQU X, 5 % 0\n")
+	cg = NewCodeGenerator(ctx.SymbolTable)
+	cg.Arith = ArithTernary
+	if err := cg.Generate(ctx.AST); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("ternary %% 0 error = %v", err)
+	}
+}
+
+func TestBinaryArithmeticOverflow(t *testing.T) {
+	var warnings []error
+	AttachCodegenWarnings(&warnings)
+	defer AttachCodegenWarnings(nil)
+
+	cg, err := assembleSource(t, ".EQU M, 0xFFFFFFFF & 0xFF\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if cg.Equs["M"] != 0xFF {
+		t.Errorf("M = %d, want 255", cg.Equs["M"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "0xFFFFFFFF & 0xFF leaves the 18-trit word") {
+		t.Errorf("warnings = %v", warnings)
+	}
+	if m, err := ParseArithMode("Ternary"); err != nil || m != ArithTernary {
+		t.Errorf("ParseArithMode(Ternary) = %v, %v", m, err)
+	}
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pipeline hazard analysis.
+//
+// Every instruction or bundle issues in one cycle, and an operation's result
+// can be used InstrDesc.Cycles cycles after it issued (MUL 2, LD 2, VLD 3,
+// FADD 3, microcode 4-16). The analysis follows straight-line code and reports
+// every operation that issues too early:
+//
+//   - it reads a register whose new value is not ready yet (load-use or
+//     multi-cycle result);
+//   - it writes a register that a slower earlier operation also writes, so
+//     the older result would arrive last (write-after-write);
+//   - it needs the microcode sequencer while an earlier microcode operation
+//     still runs.
+//
+// Labels do not reset the state, since they can be reached by falling
+// through; jumps, calls, returns, HALT, SYSCALL and BREAK do, because the
+// code after them is only entered from elsewhere. Hazards along taken
+// branches are not analysed.
+
+// HazardMode selects what the assembler does about a pipeline hazard.
+type HazardMode int
+
+const (
+	HazardWarn  HazardMode = iota // Report a warning
+	HazardNOP                     // Insert NOPs until the operation can issue
+	HazardError                   // Fail the build
+)
+
+var hazardModeNames = []string{"warn", "nop", "error"}
+
+func (m HazardMode) String() string {
+	if int(m) < len(hazardModeNames) {
+		return hazardModeNames[m]
+	}
+	return fmt.Sprintf("HazardMode(%d)", int(m))
+}
+
+// ParseHazardMode converts the value of the -hazards flag.
+func ParseHazardMode(s string) (HazardMode, error) {
+	for m, name := range hazardModeNames {
+		if strings.EqualFold(s, name) {
+			return HazardMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hazard mode: %s (use warn, nop or error)", s)
+}
+
+// Hazard describes an operation that issues before an earlier one allows.
+type Hazard struct {
+	Line     int
+	Mnemonic string
+	FromLine int
+	From     string // Mnemonic of the earlier operation
+	Reg      string // Register involved; empty for the microcode sequencer
+	Kind     string
+	Distance int // Cycles between the two operations as written
+	Stalls   int // Cycles the operation has to wait
+}
+
+func (h Hazard) String() string {
+	var what string
+	switch h.Kind {
+	case "write-after-write":
+		what = fmt.Sprintf("%s writes %s %d cycle(s) after %s at line %d, whose slower result would arrive last", h.Mnemonic, h.Reg, h.Distance, h.From, h.FromLine)
+	case "microcode busy":
+		what = fmt.Sprintf("%s needs the microcode sequencer %d cycle(s) after %s at line %d started on it", h.Mnemonic, h.Distance, h.From, h.FromLine)
+	default:
+		what = fmt.Sprintf("%s reads %s %d cycle(s) after %s at line %d writes it", h.Mnemonic, h.Reg, h.Distance, h.From, h.FromLine)
+	}
+	return fmt.Sprintf("line %d: %s, %d stall cycle(s) needed (%s hazard)", h.Line, what, h.Stalls, h.Kind)
+}
+
+// issued is an operation that may still be executing.
+type issued struct {
+	op    loopOp
+	line  int
+	cycle int
+}
+
+// hazardBetween returns the hazard, if any, of issuing b in cycle c after a.
+func hazardBetween(a issued, b loopOp, line, c int) (Hazard, bool) {
+	h := Hazard{
+		Line: line, Mnemonic: b.slot.desc.Mnemonic,
+		FromLine: a.line, From: a.op.slot.desc.Mnemonic, Distance: c - a.cycle,
+	}
+	need := 0
+	for _, r := range b.slot.reads {
+		if overlaps([]string{r}, a.op.slot.writes) && a.op.lat-h.Distance > need {
+			need, h.Reg, h.Kind = a.op.lat-h.Distance, r, "multi-cycle result"
+			if isLoad(a.op.slot.desc) {
+				h.Kind = "load-use"
+			}
+		}
+	}
+	for _, r := range b.slot.writes {
+		if d := a.op.lat - b.lat + 1 - h.Distance; overlaps([]string{r}, a.op.slot.writes) && d > need {
+			need, h.Reg, h.Kind = d, r, "write-after-write"
+		}
+	}
+	if a.op.slot.desc.Type == OpTypeUCODE && b.slot.desc.Type == OpTypeUCODE && a.op.lat-h.Distance > need {
+		need, h.Reg, h.Kind = a.op.lat-h.Distance, "", "microcode busy"
+	}
+	h.Stalls = need
+	return h, need > 0
+}
+
+// groupOps returns the operations a line issues together, or nil for lines
+// that issue nothing or that the encoder will reject.
+func groupOps(stmt StatementNode) []loopOp {
+	var instrs []*InstructionNode
+	switch s := stmt.(type) {
+	case *InstructionNode:
+		instrs = []*InstructionNode{s}
+	case *VLIWInstructionNode:
+		instrs = s.Instructions
+	}
+	ops := make([]loopOp, 0, len(instrs))
+	for _, instr := range instrs {
+		desc, known := LookupInstr(instr.Mnemonic)
+		if !known || len(instr.Operands) != len(desc.Operands) {
+			return nil
+		}
+		reads, writes := registerEffects(instr, desc)
+		ops = append(ops, loopOp{slot: bundleSlot{instr: instr, desc: desc, reads: reads, writes: writes}, lat: opLatency(desc)})
+	}
+	return ops
+}
+
+// endsFlow reports whether execution never falls through past op.
+func endsFlow(op loopOp) bool {
+	if _, cond := invertedBranch[op.slot.desc.Mnemonic]; cond {
+		return false
+	}
+	return isControlOp(op.slot.desc, op.slot.writes)
+}
+
+// checkHazards analyses the program for pipeline hazards and handles them
+// according to cg.Hazards. With HazardNOP it returns a copy of ast with NOPs
+// inserted before every operation that would issue too early. Every hazard is
+// recorded in cg.HazardReport.
+func (cg *CodeGenerator) checkHazards(ast *AST) (*AST, error) {
+	cg.HazardReport = nil
+	out := &AST{Program: &ProgramNode{}}
+	var inflight []issued
+	cycle := 0
+	for _, line := range ast.Program.Lines {
+		ops := groupOps(line.Statement)
+		if len(ops) == 0 {
+			out.Program.Lines = append(out.Program.Lines, line)
+			continue
+		}
+		var worst Hazard
+		for _, op := range ops {
+			for _, a := range inflight {
+				if h, ok := hazardBetween(a, op, line.Line, cycle); ok && h.Stalls > worst.Stalls {
+					worst = h
+				}
+			}
+		}
+		if worst.Stalls > 0 {
+			cg.HazardReport = append(cg.HazardReport, worst)
+			switch cg.Hazards {
+			case HazardError:
+				return nil, fmt.Errorf("pipeline hazard at %s", worst)
+			case HazardNOP:
+				for i := 0; i < worst.Stalls; i++ {
+					nop := &InstructionNode{Mnemonic: "NOP", Line: line.Line, Column: line.Column}
+					out.Program.Lines = append(out.Program.Lines, &LineNode{Statement: nop, Line: line.Line, Column: line.Column})
+				}
+				cycle += worst.Stalls
+			default:
+				if codegenWarnings != nil {
+					*codegenWarnings = append(*codegenWarnings, fmt.Errorf("warning: pipeline hazard at %s", worst))
+				}
+			}
+		}
+		out.Program.Lines = append(out.Program.Lines, line)
+		live := inflight[:0]
+		for _, a := range inflight {
+			if a.cycle+a.op.lat > cycle+1 {
+				live = append(live, a)
+			}
+		}
+		inflight = live
+		for _, op := range ops {
+			if endsFlow(op) {
+				inflight = nil
+				break
+			}
+			inflight = append(inflight, issued{op: op, line: line.Line, cycle: cycle})
+		}
+		cycle++
+	}
+	return out, nil
+}
+
+// formatHazards renders the hazard report for verbose output and listings.
+func formatHazards(hazards []Hazard, mode HazardMode) string {
+	var sb strings.Builder
+	stalls := 0
+	for _, h := range hazards {
+		fmt.Fprintf(&sb, "  %s\n", h)
+		stalls += h.Stalls
+	}
+	if mode == HazardNOP {
+		fmt.Fprintf(&sb, "  %d NOP(s) inserted\n", stalls)
+	}
+	return sb.String()
+}
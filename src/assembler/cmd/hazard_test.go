@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHazardDetection(t *testing.T) {
+	for _, c := range []struct {
+		src    string
+		want   string // substring of the first hazard, empty for none
+		stalls int
+	}{
+		{"LD T3, [TB]\nADD T0, T3, 1\n", "line 2: ADD reads T3 1 cycle(s) after LD at line 1 writes it, 1 stall cycle(s) needed (load-use hazard)", 1},
+		{"LD T3, [TB]\nADD T1, T1, 1\nADD T0, T3, 1\n", "", 0},
+		{"MUL T3, T1, T2\nADD T0, T3, 1\n", "(multi-cycle result hazard)", 1},
+		{"[LD T3, [TB]] [ADD T1, T1, 1]\nADD T0, T3, 1\n", "ADD reads T3", 1},
+		{"LD T3, [TB]\nl:\nADD T0, T3, 1\n", "load-use", 1},
+		{"DIV T0, T1, T2\nADD T0, T4, 1\n", "ADD writes T0 1 cycle(s) after DIV at line 1, whose slower result would arrive last, 11 stall cycle(s) needed (write-after-write hazard)", 11},
+		{"DIV T0, T1, T2\nSQRT T4, T5\n", "SQRT needs the microcode sequencer 1 cycle(s) after DIV at line 1 started on it, 11 stall cycle(s) needed (microcode busy hazard)", 11},
+		{"DIV T0, T1, T2\nBEQ T1, 0, l\nADD T4, T0, 1\nl:\nADD T6, T6, 1\n", "ADD reads T0 2 cycle(s) after DIV", 10},
+		{"LD T3, [TB]\nJMP l\nl:\nADD T0, T3, 1\n", "", 0},
+		{"LD T3, [TB]\nST T3, [TB+4]\n", "ST reads T3", 1},
+	} {
+		cg, err := assembleSource(t, c.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.src, err)
+			continue
+		}
+		if c.want == "" {
+			if len(cg.HazardReport) != 0 {
+				t.Errorf("%q: unexpected hazard %s", c.src, cg.HazardReport[0])
+			}
+			continue
+		}
+		if len(cg.HazardReport) != 1 {
+			t.Errorf("%q: got %d hazards, want 1", c.src, len(cg.HazardReport))
+			continue
+		}
+		if h := cg.HazardReport[0]; !strings.Contains(h.String(), c.want) || h.Stalls != c.stalls {
+			t.Errorf("%q: hazard %q with %d stalls, want %q with %d", c.src, h, h.Stalls, c.want, c.stalls)
+		}
+	}
+}
+
+func TestHazardModes(t *testing.T) {
+	src := "LD T3, [TB]\nMUL T4, T3, T3\nADD T5, T4, 1\nHALT\n"
+
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.Hazards = HazardNOP
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var got []string
+	for _, w := range slotWords(cg.Output) {
+		text, err := Disassemble(w)
+		if err != nil {
+			t.Fatalf("Disassemble: %v", err)
+		}
+		got = append(got, strings.Fields(text)[0])
+	}
+	if want := "LD NOP MUL NOP ADD HALT"; strings.Join(got, " ") != want {
+		t.Errorf("NOP mode emitted %s, want %s", strings.Join(got, " "), want)
+	}
+	if len(cg.HazardReport) != 2 {
+		t.Errorf("got %d hazards, want 2", len(cg.HazardReport))
+	}
+
+	ctx = parseSource(t, src)
+	cg = NewCodeGenerator(ctx.SymbolTable)
+	cg.Hazards = HazardError
+	err := cg.Generate(ctx.AST)
+	if err == nil || !strings.Contains(err.Error(), "pipeline hazard at line 2: MUL reads T3") {
+		t.Errorf("error mode: error = %v", err)
+	}
+
+	for _, name := range []string{"warn", "NOP", "error"} {
+		if m, err := ParseHazardMode(name); err != nil || !strings.EqualFold(m.String(), name) {
+			t.Errorf("ParseHazardMode(%q) = %v, %v", name, m, err)
+		}
+	}
+	if _, err := ParseHazardMode("stall"); err == nil {
+		t.Error("ParseHazardMode accepted an unknown mode")
+	}
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import "github.com/kvany/vtx1/assembler/pkg/ternary"
+
+// Word image.
+//
+// Besides the byte stream written by --wordsize 8, the code generator builds
+// the program as a sequence of 36-bit machine words, the unit the VTX1 memory
+// stores:
+//
+//   - an instruction slot fills the low 32 bits of a word, and a bundle is
+//     three consecutive words (108 bits), which the 108 container keeps in
+//     one unit;
+//   - the address literal of a relaxed branch or far access fills the low 32
+//     bits too, as the long form loads it;
+//   - every .DT item and every .DB/.DW item under trit-word addressing is an
+//     18-trit word, two bits per trit;
+//   - other data bytes are packed four to a word, first byte lowest, and the
+//     last word of each segment is padded with zero bytes.
+//
+// Each segment of the memory image keeps its words next to its bytes, and the
+// 36, 36be and 108 containers serialize them flattened. Under byte
+// addressing, an instruction that follows a partial word of data has no word
+// of its own, so those containers are then rejected.
+
+// MachineWord is one 36-bit word of the image.
+type MachineWord uint64
+
+// machineWordBits is the width of a MachineWord.
+const machineWordBits = 2 * ternary.WordTrits
+
+// tritWord returns the 18-trit encoding of v.
+func tritWord(v int64) MachineWord {
+	return MachineWord(ternary.WrapWord(v).Bits())
+}
+
+// pack36BitWords stores every word in 5 bytes, little-endian; the top 4 bits
+// of the fifth byte are zero.
+func pack36BitWords(words []MachineWord) []byte {
+	out := make([]byte, 0, 5*len(words))
+	for _, w := range words {
+		for i := 0; i < 5; i++ {
+			out = append(out, byte(w>>(8*i)))
+		}
+	}
+	return out
+}
+
+// unitBytes is the size of one 108-bit unit in the 108 container.
+const unitBytes = 14
+
+// nopWord is the word of a NOP slot, which pads 108-bit units.
+var nopWord = MachineWord(InstrWord{Type: OpTypeSYS}.Pack())
+
+// pack108BitWords stores the words three to a 108-bit unit of 14 bytes,
+// little-endian with the first word in the low bits. The words listed in
+// starts, ascending, begin a new unit, so that every bundle fills exactly
+// one unit; the unit before such a word, and the last unit, are padded with
+// NOP words. It also returns the unit holding each word.
+func pack108BitWords(words []MachineWord, starts []int) ([]byte, []int) {
+	var units [][VLIWSlots]MachineWord
+	unitOf := make([]int, len(words))
+	n := VLIWSlots // Words in the last unit
+	for i, w := range words {
+		if len(starts) > 0 && starts[0] == i {
+			starts = starts[1:]
+			n = VLIWSlots
+		}
+		if n == VLIWSlots {
+			units = append(units, [VLIWSlots]MachineWord{nopWord, nopWord, nopWord})
+			n = 0
+		}
+		units[len(units)-1][n] = w
+		unitOf[i] = len(units) - 1
+		n++
+	}
+	out := make([]byte, 0, unitBytes*len(units))
+	for _, u := range units {
+		var chunk [unitBytes]byte
+		for j, w := range u {
+			for bit := 0; bit < machineWordBits; bit++ {
+				if w>>bit&1 != 0 {
+					pos := j*machineWordBits + bit
+					chunk[pos/8] |= 1 << (pos % 8)
+				}
+			}
+		}
+		out = append(out, chunk[:]...)
+	}
+	return out, unitOf
+}
+
+// pack36BitWordsBE stores every word in 5 bytes, big-endian after 4 zero
+// bits. This is not a ternary encoding of its own: a word in trit form is
+// written as its 18 trit pairs (00 = -1, 01 = 0, 10 = +1), most significant
+// trit first, and an instruction slot or packed data as its bits.
+func pack36BitWordsBE(words []MachineWord) []byte {
+	out := make([]byte, 0, 5*len(words))
+	for _, w := range words {
+		for i := 4; i >= 0; i-- {
+			out = append(out, byte(w>>(8*i)))
+		}
+	}
+	return out
+}
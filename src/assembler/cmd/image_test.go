@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// imageOf assembles src with the given addressing unit.
+func imageOf(t *testing.T, src string, unit AddrUnit) *CodeGenerator {
+	t.Helper()
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.AddrUnit = unit
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	return cg
+}
+
+func TestWordImage(t *testing.T) {
+	cg := imageOf(t, "ADD T0, T0, 1\n[ADD T1, T1, 1] [ADD T2, T2, 1]\n.DB 1, 2, 3, 4, 5\nHALT\n", UnitWord)
+	slots := slotWords(cg.Output)
+	want := []MachineWord{
+		MachineWord(slots[0].Pack()),
+		MachineWord(slots[1].Pack()), MachineWord(slots[2].Pack()), MachineWord(slots[3].Pack()),
+		0x04030201, 0x05,
+		MachineWord(slots[6].Pack()),
+	}
+	if len(cg.Image) != len(want) {
+		t.Fatalf("image has %d words, want %d", len(cg.Image), len(want))
+	}
+	for i := range want {
+		if cg.Image[i] != want[i] {
+			t.Errorf("word %d = 0x%09X, want 0x%09X", i, cg.Image[i], want[i])
+		}
+	}
+	if cg.ImageErr != nil {
+		t.Errorf("ImageErr = %v", cg.ImageErr)
+	}
+
+	cg = imageOf(t, ".DB 0t-, 7\n.SPACE 1\n", UnitTritWord)
+	if want := []MachineWord{tritWord(-1), tritWord(7), tritWord(0)}; len(cg.Image) != 3 || cg.Image[0] != want[0] || cg.Image[1] != want[1] || cg.Image[2] != want[2] {
+		t.Errorf("trit-word data image = %X, want %X", cg.Image, want)
+	}
+
+	cg = imageOf(t, ".DT 0t+-0+\nHALT\n", UnitWord)
+	if len(cg.Image) != 2 || cg.Image[0] != tritWord(19) {
+		t.Errorf(".DT image = %X, want the 18-trit word of 19 and HALT", cg.Image)
+	}
+
+	cg = imageOf(t, "JMP far\n.SPACE 8192\nfar:\nHALT\n", UnitByte)
+	if len(cg.Image) < 2 || cg.Image[1] != 8200 {
+		t.Errorf("relaxed branch literal = %X, want the 32-bit address 8200", cg.Image)
+	}
+
+	cg = imageOf(t, ".DB 1\nHALT\n", UnitByte)
+	if cg.ImageErr == nil || !strings.Contains(cg.ImageErr.Error(), "0x1 follows 1 byte(s) of data and is not word-aligned") {
+		t.Errorf("ImageErr = %v, want a word alignment error", cg.ImageErr)
+	}
+}
+
+func TestWordContainers(t *testing.T) {
+	words := []MachineWord{0xF12345678, 0x1}
+	if got := pack36BitWords(words); string(got) != string([]byte{0x78, 0x56, 0x34, 0x12, 0x0F, 0x01, 0, 0, 0, 0}) {
+		t.Errorf("36-bit container = % X", got)
+	}
+
+	got, _ := pack108BitWords([]MachineWord{0, 0xFFFFFFFFF, 0, 1}, nil)
+	want := make([]byte, 28)
+	want[4], want[5], want[6], want[7], want[8] = 0xF0, 0xFF, 0xFF, 0xFF, 0xFF
+	want[14], want[18], want[19], want[23] = 0x01, 0x80, 0x02, 0x28 // 1, NOP, NOP
+	if string(got) != string(want) {
+		t.Errorf("108-bit container = % X, want % X", got, want)
+	}
+
+	// A bundle after a single slot starts a unit of its own.
+	cg := imageOf(t, "HALT\n[ADD T0, T0, 1] [ADD T1, T1, 1]\nHALT\n", UnitByte)
+	got, units := pack108BitWords(cg.Image, cg.Memory.UnitStarts())
+	if len(got) != 3*unitBytes || fmt.Sprint(units) != "[0 1 1 1 2]" {
+		t.Errorf("108-bit container has %d bytes, units %v, want 3 units holding [0 1 1 1 2]", len(got), units)
+	}
+
+	if got := pack36BitWordsBE([]MachineWord{tritWord(0), tritWord(1)}); string(got) != string([]byte{0x05, 0x55, 0x55, 0x55, 0x55, 0x05, 0x55, 0x55, 0x55, 0x56}) {
+		t.Errorf("big-endian 36-bit container = % X", got)
+	}
+
+	dir := t.TempDir()
+	ctx := &CompilationContext{Image: words}
+	out := filepath.Join(dir, "out.bin")
+	if err := writeOutput(ctx, out, "binary", "36"); err != nil {
+		t.Fatalf("writeOutput: %v", err)
+	}
+	if data, err := os.ReadFile(out); err != nil || len(data) != 10 {
+		t.Errorf("wrote %d bytes (%v), want 10", len(data), err)
+	}
+	ctx.ImageErr = errors.New("misaligned")
+	if err := writeOutput(ctx, out, "binary", "108"); err == nil || !strings.Contains(err.Error(), "cannot write 108 words: misaligned") {
+		t.Errorf("writeOutput error = %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Include files.
+//
+//	.INCLUDE "defs.inc"
+//
+// replaces the directive line by the lines of defs.inc. The file is looked
+// up next to the file that includes it, then in every -I directory in order.
+// A file may be included any number of times, but not from within itself.
+//
+// Inclusion is textual and comes first, before macro expansion. Every line
+// of the result remembers its file, so diagnostics for lines of an included
+// file start with the file name, the listing shows their text, and labels
+// enter the symbol table with their file. Every file read is added to the
+// SourceMap and listed in Includes, the build dependencies of the program.
+
+// includer expands the .INCLUDE directives of a source.
+type includer struct {
+	ctx   *CompilationContext
+	stack []string // Absolute paths of the files being included, outermost first
+	names []string // Names of the same files, for diagnostics
+	out   []string
+	lines []srcLine
+}
+
+// expandIncludes replaces every .INCLUDE directive of the source by the
+// lines of the file. It returns the result and the origin of each line.
+func expandIncludes(ctx *CompilationContext) (string, []srcLine, error) {
+	in := &includer{ctx: ctx}
+	if ctx.SourceMap == nil {
+		ctx.SourceMap = make(map[string]string)
+	}
+	ctx.Includes = nil
+	if err := in.include("", ctx.SourceFile, ctx.SourceCode); err != nil {
+		return "", nil, err
+	}
+	return strings.Join(in.out, "\n"), in.lines, nil
+}
+
+// include copies the lines of a file to the output. file is "" for the
+// source file itself, whose lines carry no file name.
+func (in *includer) include(file, path, src string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	in.stack, in.names = append(in.stack, abs), append(in.names, path)
+	defer func() {
+		in.stack, in.names = in.stack[:len(in.stack)-1], in.names[:len(in.names)-1]
+	}()
+
+	for i, l := range strings.Split(src, "\n") {
+		inc, ok, err := includeName(l)
+		if err != nil {
+			return fileError(file, fmt.Errorf("%v at line %d", err, i+1))
+		}
+		if ok {
+			if err := in.includeFile(inc, filepath.Dir(path), file, i+1); err != nil {
+				return err
+			}
+			continue
+		}
+		in.out, in.lines = append(in.out, l), append(in.lines, srcLine{File: file, Line: i + 1})
+	}
+	return nil
+}
+
+// includeFile finds, reads and includes the file inc, named on a line of
+// file in directory dir.
+func (in *includer) includeFile(inc, dir, file string, line int) error {
+	candidates := []string{inc}
+	if !filepath.IsAbs(inc) {
+		candidates = []string{filepath.Join(dir, inc)}
+		for _, p := range in.ctx.Options.IncludePaths {
+			candidates = append(candidates, filepath.Join(p, inc))
+		}
+	}
+	for _, path := range candidates {
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			abs = path
+		}
+		for i, p := range in.stack {
+			if p == abs {
+				chain := append(append([]string(nil), in.names[i:]...), path)
+				return fileError(file, fmt.Errorf("include cycle at line %d: %s", line, strings.Join(chain, " includes ")))
+			}
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return fileError(file, fmt.Errorf("cannot read include file %s at line %d: %v", path, line, err))
+		}
+		if _, seen := in.ctx.SourceMap[path]; !seen {
+			in.ctx.Includes = append(in.ctx.Includes, path)
+		}
+		in.ctx.SourceMap[path] = string(src)
+		return in.include(path, path, string(src))
+	}
+	return fileError(file, fmt.Errorf("cannot find include file %q at line %d (searched %s)", inc, line, strings.Join(candidates, ", ")))
+}
+
+// includeName returns the file name of an .INCLUDE line. ok is false for
+// any other line.
+func includeName(l string) (name string, ok bool, err error) {
+	_, word, rest := splitMacroLine(l)
+	if !strings.EqualFold(word, ".INCLUDE") {
+		return "", false, nil
+	}
+	rest = strings.TrimSpace(rest)
+	if len(rest) < 3 || rest[0] != '"' || rest[len(rest)-1] != '"' {
+		return "", false, fmt.Errorf("expected a quoted file name after .INCLUDE, got %q", rest)
+	}
+	return rest[1 : len(rest)-1], true, nil
+}
+
+// fileError prefixes err with the file it is about, if that is an included
+// file rather than the source file.
+func fileError(file string, err error) error {
+	if err == nil || file == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", file, err)
+}
+
+// writeDeps writes the dependencies of the output file on the source file and
+// every included file as a make rule, with an empty rule for every included
+// file so that make does not fail when one is removed.
+func writeDeps(ctx *CompilationContext, outputFile, depsFile string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: %s", outputFile, ctx.SourceFile)
+	for _, inc := range ctx.Includes {
+		fmt.Fprintf(&sb, " \\\n  %s", inc)
+	}
+	sb.WriteString("\n")
+	for _, inc := range ctx.Includes {
+		fmt.Fprintf(&sb, "\n%s:\n", inc)
+	}
+	return os.WriteFile(depsFile, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// includeContext writes files into a temporary directory and returns a
+// context for assembling the first of them.
+func includeContext(t *testing.T, files map[string]string, main string, paths ...string) (*CompilationContext, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, p := range paths {
+		paths[i] = filepath.Join(dir, p)
+	}
+	return &CompilationContext{
+		SourceFile:   filepath.Join(dir, main),
+		SourceCode:   files[main],
+		ErrorManager: NewErrorManager(),
+		SymbolTable:  NewSymbolTable(),
+		Options:      Options{IncludePaths: paths},
+	}, dir
+}
+
+func TestInclude(t *testing.T) {
+	ctx, dir := includeContext(t, map[string]string{
+		"main.asm": `.INCLUDE "defs.inc"
+        ZERO T1
+start:
+        ADD T0, T0, COUNT
+`,
+		"lib/defs.inc": `.INCLUDE "more.inc"
+.MACRO ZERO r
+        SUB r, r, r
+.ENDM
+`,
+		"lib/more.inc": `.EQU COUNT, 3
+helper:
+        RET
+`,
+	}, "main.asm", "lib")
+	if err := runParsing(ctx); err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	defs, more := filepath.Join(dir, "lib", "defs.inc"), filepath.Join(dir, "lib", "more.inc")
+	if strings.Join(ctx.Includes, ",") != defs+","+more {
+		t.Errorf("Includes = %v, want [%s %s]", ctx.Includes, defs, more)
+	}
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if w := slotWords(cg.Output)[1]; w.Rd != 1 || w.Rs1 != 1 {
+		t.Errorf("ZERO T1 from the include = T%d, T%d, want T1, T1", w.Rd, w.Rs1)
+	}
+	if s, ok := ctx.SymbolTable.Lookup("helper"); !ok || s.File != more || s.Line != 2 {
+		t.Errorf("helper = %+v, want defined at %s:2", s, more)
+	}
+	if l := cg.Listing[0]; l.File != more || l.Line != 1 {
+		t.Errorf("first listing line = %s:%d, want %s:1", l.File, l.Line, more)
+	}
+
+	deps := filepath.Join(dir, "main.d")
+	if err := writeDeps(ctx, "main.bin", deps); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(deps)
+	want := "main.bin: " + ctx.SourceFile + " \\\n  " + defs + " \\\n  " + more + "\n\n" + defs + ":\n\n" + more + ":\n"
+	if string(got) != want {
+		t.Errorf("deps =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	for _, c := range []struct {
+		files map[string]string
+		want  string
+	}{
+		{map[string]string{"main.asm": ".INCLUDE \"a.inc\"\n", "a.inc": "\n.INCLUDE \"b.inc\"\n", "b.inc": ".INCLUDE \"a.inc\"\n"},
+			"b.inc: include cycle at line 1: "},
+		{map[string]string{"main.asm": "        NOP\n.INCLUDE \"none.inc\"\n"}, "cannot find include file \"none.inc\" at line 2"},
+		{map[string]string{"main.asm": ".INCLUDE defs.inc\n"}, "expected a quoted file name after .INCLUDE"},
+		{map[string]string{"main.asm": "x:\n.INCLUDE \"a.inc\"\n", "a.inc": "        NOP\nx:\n"},
+			"a.inc: duplicate definition of label 'x' at line 2"},
+		{map[string]string{"main.asm": ".INCLUDE \"a.inc\"\n", "a.inc": "        NOP\n        ADD T0, T0, missing\n"},
+			"a.inc: undefined symbol"},
+	} {
+		ctx, dir := includeContext(t, c.files, "main.asm")
+		err := runParsing(ctx)
+		if err == nil {
+			cg := NewCodeGenerator(ctx.SymbolTable)
+			err = cg.Generate(ctx.AST)
+		}
+		if err == nil || !strings.Contains(strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), ""), c.want) {
+			t.Errorf("%v: error %v, want %q", c.files, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OperandKind is the class of value an instruction operand accepts.
+type OperandKind int
+
+const (
+	KindGPR    OperandKind = iota // T0-T6 or a special register (TA, TB, TC, TS, TI)
+	KindVec                       // Vector register (VA, VT, VB)
+	KindFP                        // Floating-point register (FA, FT, FB)
+	KindImm                       // Immediate value or constant symbol
+	KindMem                       // Memory operand ([Rs1], [Rs1+imm], label)
+	KindTarget                    // Jump/branch target (label or address)
+	KindCmp                       // Branch comparand: T register or 3-bit constant
+	KindSrc                       // ALU source: T register or signed imm11
+	KindShift                     // Shift/rotate amount: T register or trit count
+)
+
+func (k OperandKind) String() string {
+	switch k {
+	case KindGPR:
+		return "general register"
+	case KindVec:
+		return "vector register (VA/VT/VB)"
+	case KindFP:
+		return "floating point register (FA/FT/FB)"
+	case KindImm:
+		return "immediate"
+	case KindMem:
+		return "memory operand"
+	case KindTarget:
+		return "branch target"
+	case KindCmp, KindSrc:
+		return "register or immediate"
+	case KindShift:
+		return "register or shift count"
+	}
+	return fmt.Sprintf("kind%d", int(k))
+}
+
+// Field is the instruction slot field an operand is encoded into.
+type Field int
+
+const (
+	FieldRd Field = iota
+	FieldRs1
+	FieldRs2
+	FieldImm
+)
+
+// OperandSpec describes one operand position of an instruction.
+type OperandSpec struct {
+	Kind  OperandKind
+	Field Field
+}
+
+// InstrDesc describes one instruction of the VTX1 ISA.
+type InstrDesc struct {
+	Mnemonic string
+	Type     OpType
+	Opcode   uint8
+	Operands []OperandSpec
+	Cycles   int  // Execution cycles from the reference table
+	Variable bool // Cycle count depends on the operation (e.g. SYSCALL)
+
+	// ImmOpcode is the opcode of the register-immediate form, or 0 if there
+	// is none. ALU instructions take the constant in imm11 instead of Rs2,
+	// branches take a 3-bit comparand in the Rs2 field, and memory accesses
+	// take an absolute address in imm11 instead of [Rs1+disp].
+	ImmOpcode uint8
+}
+
+// Writes returns the position of the operand written by the instruction, or -1.
+func (d *InstrDesc) Writes() int {
+	for i, op := range d.Operands {
+		if op.Field == FieldRd && isRegisterKind(op.Kind) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Signature renders the operand list for diagnostics, e.g. "ADD Tn, Tn, Tn".
+func (d *InstrDesc) Signature() string {
+	parts := make([]string, len(d.Operands))
+	for i, op := range d.Operands {
+		switch op.Kind {
+		case KindGPR:
+			parts[i] = "Tn"
+		case KindVec:
+			parts[i] = "Vn"
+		case KindFP:
+			parts[i] = "Fn"
+		case KindImm:
+			parts[i] = "imm"
+		case KindMem:
+			parts[i] = "[mem]"
+		case KindTarget:
+			parts[i] = "target"
+		case KindCmp, KindSrc:
+			parts[i] = "Tn|imm"
+		case KindShift:
+			parts[i] = "Tn|count"
+		}
+	}
+	if len(parts) == 0 {
+		return d.Mnemonic
+	}
+	return d.Mnemonic + " " + strings.Join(parts, ", ")
+}
+
+// AcceptsImm reports whether the instruction has a register-immediate form.
+func (d *InstrDesc) AcceptsImm() bool { return d.ImmOpcode != 0 }
+
+// immForm reports whether w is encoded in the register-immediate form.
+func (d *InstrDesc) immForm(w InstrWord) bool {
+	return d.AcceptsImm() && w.Opcode == d.ImmOpcode
+}
+
+func isRegisterKind(k OperandKind) bool {
+	return k == KindGPR || k == KindVec || k == KindFP
+}
+
+// Operand signature shorthands used by the ISA table.
+var (
+	rd      = OperandSpec{KindGPR, FieldRd}
+	rs1     = OperandSpec{KindGPR, FieldRs1}
+	rs2     = OperandSpec{KindGPR, FieldRs2}
+	vd      = OperandSpec{KindVec, FieldRd}
+	vs1     = OperandSpec{KindVec, FieldRs1}
+	vs2     = OperandSpec{KindVec, FieldRs2}
+	fd      = OperandSpec{KindFP, FieldRd}
+	fs1     = OperandSpec{KindFP, FieldRs1}
+	fs2     = OperandSpec{KindFP, FieldRs2}
+	imm     = OperandSpec{KindImm, FieldImm}
+	mem     = OperandSpec{KindMem, FieldImm}
+	target  = OperandSpec{KindTarget, FieldImm}
+	cmp     = OperandSpec{KindCmp, FieldRs2}
+	src     = OperandSpec{KindSrc, FieldRs2}
+	amt     = OperandSpec{KindShift, FieldRs2}
+	noOpnds = []OperandSpec{}
+)
+
+func ops(specs ...OperandSpec) []OperandSpec { return specs }
+
+// isaTable is the single description of the VTX1 instruction set
+// (docs/addendums/instructions.adoc). POP, BGT and BLE and the
+// register-immediate opcodes are not in the reference tables; they are listed
+// under Assembler Encoding Extensions there.
+var isaTable = []InstrDesc{
+	// ALU operations (type 000)
+	{Mnemonic: "NEG", Type: OpTypeALU, Opcode: 0x00, Operands: ops(rd, rs1), Cycles: 1},
+	{Mnemonic: "ADD", Type: OpTypeALU, Opcode: 0x01, Operands: ops(rd, rs1, src), Cycles: 1, ImmOpcode: 0x21},
+	{Mnemonic: "SUB", Type: OpTypeALU, Opcode: 0x02, Operands: ops(rd, rs1, src), Cycles: 1, ImmOpcode: 0x22},
+	{Mnemonic: "MUL", Type: OpTypeALU, Opcode: 0x03, Operands: ops(rd, rs1, rs2), Cycles: 2},
+	{Mnemonic: "AND", Type: OpTypeALU, Opcode: 0x04, Operands: ops(rd, rs1, src), Cycles: 1, ImmOpcode: 0x24},
+	{Mnemonic: "OR", Type: OpTypeALU, Opcode: 0x05, Operands: ops(rd, rs1, src), Cycles: 1, ImmOpcode: 0x25},
+	{Mnemonic: "NOT", Type: OpTypeALU, Opcode: 0x06, Operands: ops(rd, rs1), Cycles: 1},
+	{Mnemonic: "XOR", Type: OpTypeALU, Opcode: 0x07, Operands: ops(rd, rs1, src), Cycles: 1, ImmOpcode: 0x27},
+	{Mnemonic: "SHL", Type: OpTypeALU, Opcode: 0x08, Operands: ops(rd, rs1, amt), Cycles: 1, ImmOpcode: 0x28},
+	{Mnemonic: "SHR", Type: OpTypeALU, Opcode: 0x09, Operands: ops(rd, rs1, amt), Cycles: 1, ImmOpcode: 0x29},
+	{Mnemonic: "ROL", Type: OpTypeALU, Opcode: 0x0A, Operands: ops(rd, rs1, amt), Cycles: 1, ImmOpcode: 0x2A},
+	{Mnemonic: "ROR", Type: OpTypeALU, Opcode: 0x0B, Operands: ops(rd, rs1, amt), Cycles: 1, ImmOpcode: 0x2B},
+	{Mnemonic: "CMP", Type: OpTypeALU, Opcode: 0x0C, Operands: ops(rs1, src), Cycles: 1, ImmOpcode: 0x2C},
+	{Mnemonic: "TEST", Type: OpTypeALU, Opcode: 0x0D, Operands: ops(rs1, src), Cycles: 1, ImmOpcode: 0x2D},
+	{Mnemonic: "INC", Type: OpTypeALU, Opcode: 0x0E, Operands: ops(rd, rs1), Cycles: 1},
+	{Mnemonic: "DEC", Type: OpTypeALU, Opcode: 0x0F, Operands: ops(rd, rs1), Cycles: 1},
+
+	// Memory operations (type 001)
+	{Mnemonic: "LD", Type: OpTypeMEM, Opcode: 0x00, Operands: ops(rd, mem), Cycles: 2, ImmOpcode: 0x20},
+	{Mnemonic: "ST", Type: OpTypeMEM, Opcode: 0x01, Operands: ops(rs2, mem), Cycles: 2, ImmOpcode: 0x21},
+	{Mnemonic: "VLD", Type: OpTypeMEM, Opcode: 0x02, Operands: ops(vd, mem), Cycles: 3, ImmOpcode: 0x22},
+	{Mnemonic: "VST", Type: OpTypeMEM, Opcode: 0x03, Operands: ops(vs2, mem), Cycles: 3, ImmOpcode: 0x23},
+	{Mnemonic: "FLD", Type: OpTypeMEM, Opcode: 0x04, Operands: ops(fd, mem), Cycles: 2, ImmOpcode: 0x24},
+	{Mnemonic: "FST", Type: OpTypeMEM, Opcode: 0x05, Operands: ops(fs2, mem), Cycles: 2, ImmOpcode: 0x25},
+	{Mnemonic: "LEA", Type: OpTypeMEM, Opcode: 0x06, Operands: ops(rd, mem), Cycles: 1, ImmOpcode: 0x26},
+	{Mnemonic: "PUSH", Type: OpTypeMEM, Opcode: 0x07, Operands: ops(rs1), Cycles: 2},
+	{Mnemonic: "POP", Type: OpTypeMEM, Opcode: 0x08, Operands: ops(rd), Cycles: 2},
+
+	// Control operations (type 010)
+	{Mnemonic: "JMP", Type: OpTypeCTRL, Opcode: 0x00, Operands: ops(target), Cycles: 1},
+	{Mnemonic: "JAL", Type: OpTypeCTRL, Opcode: 0x01, Operands: ops(target), Cycles: 2},
+	{Mnemonic: "JR", Type: OpTypeCTRL, Opcode: 0x02, Operands: ops(rs1), Cycles: 1},
+	{Mnemonic: "JALR", Type: OpTypeCTRL, Opcode: 0x03, Operands: ops(rs1), Cycles: 2},
+	{Mnemonic: "BEQ", Type: OpTypeCTRL, Opcode: 0x04, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x14},
+	{Mnemonic: "BNE", Type: OpTypeCTRL, Opcode: 0x05, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x15},
+	{Mnemonic: "BLT", Type: OpTypeCTRL, Opcode: 0x06, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x16},
+	{Mnemonic: "BGE", Type: OpTypeCTRL, Opcode: 0x07, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x17},
+	{Mnemonic: "BLTU", Type: OpTypeCTRL, Opcode: 0x08, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x18},
+	{Mnemonic: "BGEU", Type: OpTypeCTRL, Opcode: 0x09, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x19},
+	{Mnemonic: "CALL", Type: OpTypeCTRL, Opcode: 0x0A, Operands: ops(target), Cycles: 3},
+	{Mnemonic: "RET", Type: OpTypeCTRL, Opcode: 0x0B, Operands: noOpnds, Cycles: 2},
+	{Mnemonic: "BGT", Type: OpTypeCTRL, Opcode: 0x0C, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x1C},
+	{Mnemonic: "BLE", Type: OpTypeCTRL, Opcode: 0x0D, Operands: ops(rs1, cmp, target), Cycles: 1, ImmOpcode: 0x1D},
+
+	// Vector operations (type 011)
+	{Mnemonic: "VADD", Type: OpTypeVEC, Opcode: 0x00, Operands: ops(vd, vs1, vs2), Cycles: 2},
+	{Mnemonic: "VSUB", Type: OpTypeVEC, Opcode: 0x01, Operands: ops(vd, vs1, vs2), Cycles: 2},
+	{Mnemonic: "VMUL", Type: OpTypeVEC, Opcode: 0x02, Operands: ops(vd, vs1, vs2), Cycles: 3},
+	{Mnemonic: "VAND", Type: OpTypeVEC, Opcode: 0x03, Operands: ops(vd, vs1, vs2), Cycles: 1},
+	{Mnemonic: "VOR", Type: OpTypeVEC, Opcode: 0x04, Operands: ops(vd, vs1, vs2), Cycles: 1},
+	{Mnemonic: "VNOT", Type: OpTypeVEC, Opcode: 0x05, Operands: ops(vd, vs1), Cycles: 1},
+	{Mnemonic: "VSHL", Type: OpTypeVEC, Opcode: 0x06, Operands: ops(vd, vs1, imm), Cycles: 2},
+	{Mnemonic: "VSHR", Type: OpTypeVEC, Opcode: 0x07, Operands: ops(vd, vs1, imm), Cycles: 2},
+
+	// FPU operations (type 100)
+	{Mnemonic: "FADD", Type: OpTypeFPU, Opcode: 0x00, Operands: ops(fd, fs1, fs2), Cycles: 3},
+	{Mnemonic: "FSUB", Type: OpTypeFPU, Opcode: 0x01, Operands: ops(fd, fs1, fs2), Cycles: 3},
+	{Mnemonic: "FMUL", Type: OpTypeFPU, Opcode: 0x02, Operands: ops(fd, fs1, fs2), Cycles: 3},
+	{Mnemonic: "FCMP", Type: OpTypeFPU, Opcode: 0x03, Operands: ops(fs1, fs2), Cycles: 2},
+	{Mnemonic: "FMOV", Type: OpTypeFPU, Opcode: 0x04, Operands: ops(fd, fs1), Cycles: 1},
+	{Mnemonic: "FNEG", Type: OpTypeFPU, Opcode: 0x05, Operands: ops(fd, fs1), Cycles: 1},
+
+	// System operations (type 101)
+	{Mnemonic: "NOP", Type: OpTypeSYS, Opcode: 0x00, Operands: noOpnds, Cycles: 1},
+	{Mnemonic: "WFI", Type: OpTypeSYS, Opcode: 0x01, Operands: noOpnds, Cycles: 1},
+
+	// Microcode: complex arithmetic (type 110)
+	{Mnemonic: "DIV", Type: OpTypeUCODE, Opcode: 0x00, Operands: ops(rd, rs1, rs2), Cycles: 12},
+	{Mnemonic: "MOD", Type: OpTypeUCODE, Opcode: 0x01, Operands: ops(rd, rs1, rs2), Cycles: 12},
+	{Mnemonic: "UDIV", Type: OpTypeUCODE, Opcode: 0x02, Operands: ops(rd, rs1, rs2), Cycles: 10},
+	{Mnemonic: "UMOD", Type: OpTypeUCODE, Opcode: 0x03, Operands: ops(rd, rs1, rs2), Cycles: 10},
+	{Mnemonic: "SQRT", Type: OpTypeUCODE, Opcode: 0x04, Operands: ops(rd, rs1), Cycles: 16},
+	{Mnemonic: "ABS", Type: OpTypeUCODE, Opcode: 0x05, Operands: ops(rd, rs1), Cycles: 4},
+
+	// Microcode: transcendental functions
+	{Mnemonic: "SIN", Type: OpTypeUCODE, Opcode: 0x08, Operands: ops(fd, fs1), Cycles: 14},
+	{Mnemonic: "COS", Type: OpTypeUCODE, Opcode: 0x09, Operands: ops(fd, fs1), Cycles: 14},
+	{Mnemonic: "TAN", Type: OpTypeUCODE, Opcode: 0x0A, Operands: ops(fd, fs1), Cycles: 16},
+	{Mnemonic: "ASIN", Type: OpTypeUCODE, Opcode: 0x0B, Operands: ops(fd, fs1), Cycles: 16},
+	{Mnemonic: "ACOS", Type: OpTypeUCODE, Opcode: 0x0C, Operands: ops(fd, fs1), Cycles: 16},
+	{Mnemonic: "ATAN", Type: OpTypeUCODE, Opcode: 0x0D, Operands: ops(fd, fs1), Cycles: 14},
+	{Mnemonic: "EXP", Type: OpTypeUCODE, Opcode: 0x0E, Operands: ops(fd, fs1), Cycles: 12},
+	{Mnemonic: "LOG", Type: OpTypeUCODE, Opcode: 0x0F, Operands: ops(fd, fs1), Cycles: 12},
+
+	// Microcode: advanced vector operations
+	{Mnemonic: "VDOT", Type: OpTypeUCODE, Opcode: 0x10, Operands: ops(rd, vs1, vs2), Cycles: 6},
+	{Mnemonic: "VREDUCE", Type: OpTypeUCODE, Opcode: 0x11, Operands: ops(rd, vs1, imm), Cycles: 8},
+	{Mnemonic: "VMAX", Type: OpTypeUCODE, Opcode: 0x12, Operands: ops(vd, vs1, vs2), Cycles: 5},
+	{Mnemonic: "VMIN", Type: OpTypeUCODE, Opcode: 0x13, Operands: ops(vd, vs1, vs2), Cycles: 5},
+	{Mnemonic: "VSUM", Type: OpTypeUCODE, Opcode: 0x14, Operands: ops(rd, vs1), Cycles: 4},
+	{Mnemonic: "VPERM", Type: OpTypeUCODE, Opcode: 0x15, Operands: ops(vd, vs1, vs2), Cycles: 10},
+
+	// Microcode: memory management
+	{Mnemonic: "CACHE", Type: OpTypeUCODE, Opcode: 0x18, Operands: ops(rs1), Cycles: 6},
+	{Mnemonic: "FLUSH", Type: OpTypeUCODE, Opcode: 0x19, Operands: noOpnds, Cycles: 8},
+	{Mnemonic: "MEMBAR", Type: OpTypeUCODE, Opcode: 0x1A, Operands: noOpnds, Cycles: 4},
+
+	// Microcode: system control
+	{Mnemonic: "SYSCALL", Type: OpTypeUCODE, Opcode: 0x20, Operands: noOpnds, Variable: true},
+	{Mnemonic: "BREAK", Type: OpTypeUCODE, Opcode: 0x21, Operands: noOpnds, Cycles: 4},
+	{Mnemonic: "HALT", Type: OpTypeUCODE, Opcode: 0x22, Operands: noOpnds, Cycles: 1},
+}
+
+// isaByMnemonic indexes isaTable by upper-case mnemonic.
+var isaByMnemonic = func() map[string]*InstrDesc {
+	m := make(map[string]*InstrDesc, len(isaTable))
+	for i := range isaTable {
+		m[isaTable[i].Mnemonic] = &isaTable[i]
+	}
+	return m
+}()
+
+// isaByEncoding indexes isaTable by operation type and opcode, for decoding.
+var isaByEncoding = func() map[[2]uint8]*InstrDesc {
+	m := make(map[[2]uint8]*InstrDesc, len(isaTable))
+	for i := range isaTable {
+		d := &isaTable[i]
+		m[[2]uint8{uint8(d.Type), d.Opcode}] = d
+		if d.AcceptsImm() {
+			m[[2]uint8{uint8(d.Type), d.ImmOpcode}] = d
+		}
+	}
+	return m
+}()
+
+// LookupInstr returns the descriptor for a mnemonic (case-insensitive).
+func LookupInstr(mnemonic string) (*InstrDesc, bool) {
+	d, ok := isaByMnemonic[strings.ToUpper(mnemonic)]
+	return d, ok
+}
+
+// LookupEncoding returns the descriptor for an operation type and opcode,
+// which may be the opcode of a register-immediate form.
+func LookupEncoding(t OpType, opcode uint8) (*InstrDesc, bool) {
+	d, ok := isaByEncoding[[2]uint8{uint8(t), opcode}]
+	return d, ok
+}
+
+// Mnemonics returns all mnemonics of the ISA in sorted order.
+func Mnemonics() []string {
+	names := make([]string, 0, len(isaTable))
+	for _, d := range isaTable {
+		names = append(names, d.Mnemonic)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// immMnemonics returns the ALU mnemonics that have a register-immediate form.
+func immMnemonics() []string {
+	var names []string
+	for i := range isaTable {
+		if isaTable[i].Type == OpTypeALU && isaTable[i].AcceptsImm() {
+			names = append(names, isaTable[i].Mnemonic)
+		}
+	}
+	return names
+}
+
+// registerClass returns the operand kind of a register name and the code
+// that goes into its 3-bit register field.
+func registerClass(name string) (OperandKind, byte, bool) {
+	switch strings.ToUpper(name) {
+	case "VA":
+		return KindVec, 0, true
+	case "VT":
+		return KindVec, 1, true
+	case "VB":
+		return KindVec, 2, true
+	case "FA":
+		return KindFP, 0, true
+	case "FT":
+		return KindFP, 1, true
+	case "FB":
+		return KindFP, 2, true
+	}
+	rn, err := regNum(strings.ToUpper(name))
+	if err != nil {
+		return 0, 0, false
+	}
+	return KindGPR, rn, true
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestISATableEncodingsUnique(t *testing.T) {
+	seen := make(map[[2]uint8]string)
+	for _, d := range isaTable {
+		key := [2]uint8{uint8(d.Type), d.Opcode}
+		if other, dup := seen[key]; dup {
+			t.Errorf("%s and %s share type %s opcode %06b", d.Mnemonic, other, d.Type, d.Opcode)
+		}
+		seen[key] = d.Mnemonic
+		if d.Opcode > opcodeMask {
+			t.Errorf("%s opcode %X does not fit in 6 bits", d.Mnemonic, d.Opcode)
+		}
+	}
+	if len(isaByMnemonic) != len(isaTable) {
+		t.Errorf("duplicate mnemonics in isaTable")
+	}
+}
+
+func TestISAOperandClasses(t *testing.T) {
+	cases := []struct {
+		src     string
+		wantErr string
+	}{
+		{"SIN FA, FT\n", ""},
+		{"SIN T0, T1\n", "floating point register"},
+		{"VDOT T0, VA, VB\n", ""},
+		{"VDOT VA, VA, VB\n", "general register"},
+		{"VADD VA, VT, VB\n", ""},
+		{"FADD FA, FT, T0\n", "floating point register"},
+		{"ADD T0, T1\n", "requires 3 operands"},
+		{"RET T0\n", "does not take any operands"},
+	}
+	for _, c := range cases {
+		_, err := assembleSource(t, c.src)
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", c.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error %v, want it to mention %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestLookupEncoding(t *testing.T) {
+	for _, name := range []string{"LD", "NEG", "BLE", "HALT", "VDOT"} {
+		d, _ := LookupInstr(name)
+		back, ok := LookupEncoding(d.Type, d.Opcode)
+		if !ok || back.Mnemonic != name {
+			t.Errorf("LookupEncoding(%s, %d) = %v, want %s", d.Type, d.Opcode, back, name)
+		}
+	}
+}
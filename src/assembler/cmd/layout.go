@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Layout.
+//
+// Layout is the only phase that computes addresses. It sizes every line once
+// per pass: instructions and bundles by their slots (a relaxed branch or far
+// access by its long form), .DB, .DW and .DT by the addressing unit, .SPACE by its count and
+// .ALIGN by the padding up to its boundary, while .ORG moves the location
+// counter. Labels take the address of their line, after any .ORG on it.
+//
+// Branch relaxation and forward references repeat the pass until nothing
+// moves. The final pass defines the labels in the symbol table, and the code
+// generator emits every line at the address and size it was given; the
+// listing, the memory image and the timing analysis read the same places.
+
+// LinePlace is where layout put one line of the program.
+type LinePlace struct {
+	Addr Addr // Address of the first unit the line occupies
+	Size Addr // Number of addresses the line occupies
+}
+
+// End returns the address after the line.
+func (p LinePlace) End() Addr { return p.Addr + p.Size }
+
+// layout assigns addresses to every line, relaxing out-of-range branches
+// until the layout reaches a fixed point, and defines the labels.
+//
+// Expressions may refer to symbols defined further down. Such a pass is
+// provisional: the symbol counts as 0 and the pass is repeated until no label,
+// constant or size changes. Branches are only relaxed on a stable layout, and
+// a final strict pass reports what still cannot be evaluated.
+func (cg *CodeGenerator) layout(ast *AST) error {
+	if cg.relaxed == nil {
+		cg.relaxed = make(map[*InstructionNode]bool)
+	}
+	for pass := 0; pass < maxRelaxPasses; pass++ {
+		if err := cg.settle(ast); err != nil {
+			return err
+		}
+		grown := false
+		for i, line := range ast.Program.Lines {
+			if cg.splitPackedRelaxable(ast, i) {
+				grown = true
+				break // line indices changed, lay out again
+			}
+			instr, ok := line.Statement.(*InstructionNode)
+			if !ok || cg.relaxed[instr] || !isRelaxable(instr) {
+				continue
+			}
+			cg.here = cg.Layout[i].Addr
+			if cg.relaxFits(instr, cg.Layout[i].Addr) {
+				continue
+			}
+			cg.relaxed[instr] = true
+			grown = true
+		}
+		if !grown {
+			if _, err := cg.place(ast, false); err != nil {
+				return err
+			}
+			return cg.defineSymbols(ast)
+		}
+	}
+	return fmt.Errorf("layout did not converge after %d relaxation passes", maxRelaxPasses)
+}
+
+// maxSettlePasses bounds the provisional passes that resolve forward
+// references between two relaxation steps. Each pass resolves at least one
+// more symbol in a well-formed program, so only chains of symbols that keep
+// changing each other, such as .EQU A, B+1 with .EQU B, A, reach it.
+const maxSettlePasses = 64
+
+// settle repeats provisional layout passes until no label, constant or size
+// changes.
+func (cg *CodeGenerator) settle(ast *AST) error {
+	for pass := 0; pass < maxSettlePasses; pass++ {
+		changed, err := cg.place(ast, true)
+		if err != nil || !changed {
+			return err
+		}
+	}
+	return fmt.Errorf("forward references did not settle after %d layout passes", maxSettlePasses)
+}
+
+// place is one layout pass: it places every line and records the labels,
+// their sizes and the .EQU constants. It reports whether any of them changed
+// from the previous pass.
+func (cg *CodeGenerator) place(ast *AST, provisional bool) (changed bool, err error) {
+	cg.provisional = provisional
+	defer func() { cg.provisional = false }()
+	addr := Addr(0)
+	cg.Layout = cg.Layout[:0]
+	labelLine := make(map[string]*LineNode)
+	equLine := make(map[string]int)
+	sizes := make(map[string]Addr)
+	var open []string // Labels whose SIZEOF is still growing
+	openUsed := false
+	for _, line := range ast.Program.Lines {
+		p := LinePlace{Addr: addr}
+		cg.here = addr
+		if line.Statement != nil {
+			equ := equName(line.Statement)
+			if prev, dup := equLine[equ]; dup {
+				return false, fileError(line.File, fmt.Errorf("duplicate definition of constant '%s' at line %d (originally defined at line %d)", equ, line.Line, prev))
+			}
+			if _, pre := cg.Defines[equ]; pre {
+				return false, fileError(line.File, fmt.Errorf("constant '%s' at line %d is already defined with -D", equ, line.Line))
+			}
+			old, had := cg.Equs[equ]
+			cg.unresolved = false
+			if p, err = cg.placeStatement(line.Statement, addr); err != nil {
+				if !cg.unresolved {
+					return false, fileError(line.File, err)
+				}
+				p = LinePlace{Addr: addr} // retried once the symbol is known
+			}
+			if equ != "" {
+				equLine[equ] = line.Line
+				if v, ok := cg.Equs[equ]; ok != had || v != old {
+					changed = true
+				}
+			}
+			if dir, ok := line.Statement.(*DirectiveNode); ok && strings.EqualFold(dir.Name, ".ORG") {
+				open = nil
+			}
+		}
+		if l := line.Label; l != nil {
+			if prev, dup := labelLine[l.Name]; dup {
+				at, was := srcLine{Line: l.Line, Expansion: line.Expansion}, srcLine{Line: prev.Label.Line, Expansion: prev.Expansion}
+				return false, fileError(line.File, fmt.Errorf("duplicate definition of label '%s' at line %s, column %d (originally defined at line %s, column %d)", l.Name, at, l.Column+1, was, prev.Label.Column+1))
+			}
+			labelLine[l.Name] = line
+			if old, ok := cg.Labels[l.Name]; !ok || old != p.Addr {
+				changed = true
+			}
+			cg.Labels[l.Name] = p.Addr
+			if openUsed {
+				open, openUsed = nil, false
+			}
+			open = append(open, l.Name)
+			sizes[l.Name] = 0
+		}
+		if line.Statement != nil {
+			openUsed = true
+		}
+		for _, name := range open {
+			sizes[name] += p.Size
+		}
+		if int64(p.End()) > addrRange.Max+1 {
+			return false, fmt.Errorf("location counter 0x%X exceeds the %s (0..%d) at line %d", p.End(), addrRange.Desc, addrRange.Max, line.Line)
+		}
+		cg.Layout = append(cg.Layout, p)
+		addr = p.End()
+	}
+	for name, n := range sizes {
+		if old, ok := cg.sizes[name]; !ok || old != n {
+			changed = true
+		}
+	}
+	cg.sizes = sizes
+	return changed, nil
+}
+
+// placeStatement returns the place of a statement that starts at addr.
+func (cg *CodeGenerator) placeStatement(stmt StatementNode, addr Addr) (LinePlace, error) {
+	p := LinePlace{Addr: addr}
+	switch s := stmt.(type) {
+	case *InstructionNode:
+		p.Size = cg.instrSize(s)
+	case *VLIWInstructionNode:
+		p.Size = VLIWSlots * cg.AddrUnit.slotSize()
+	case *DirectiveNode:
+		switch strings.ToUpper(s.Name) {
+		case ".ORG":
+			imm, err := cg.directiveValue(s, 0, addrRange)
+			if err != nil {
+				return p, err
+			}
+			p.Addr = Addr(imm)
+		case ".SPACE":
+			imm, err := cg.directiveValue(s, 0, addrRange)
+			if err != nil {
+				return p, err
+			}
+			p.Size = Addr(imm)
+		case ".ALIGN":
+			imm, err := cg.directiveValue(s, 0, alignRange)
+			if err != nil {
+				return p, err
+			}
+			p.Size = (Addr(imm) - addr%Addr(imm)) % Addr(imm)
+		case ".DW":
+			p.Size = cg.AddrUnit.dataSize(2, dataItemCount(s.Params))
+		case ".DB":
+			p.Size = cg.AddrUnit.dataSize(1, dataItemCount(s.Params))
+		case ".DT":
+			p.Size = cg.AddrUnit.dataSize(0, dataItemCount(s.Params))
+		case ".EQU":
+			if len(s.Params) == 2 {
+				if id, ok := s.Params[0].(*IdentifierNode); ok {
+					imm, err := cg.directiveValue(s, 1, wordRange)
+					if err != nil {
+						return p, err
+					}
+					cg.Equs[id.Name] = imm
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// equName returns the name a .EQU statement defines, or "".
+func equName(stmt StatementNode) string {
+	if dir, ok := stmt.(*DirectiveNode); ok && strings.EqualFold(dir.Name, ".EQU") && len(dir.Params) == 2 {
+		if id, ok := dir.Params[0].(*IdentifierNode); ok {
+			return id.Name
+		}
+	}
+	return ""
+}
+
+// defineSymbols enters the labels of the final layout into the symbol table.
+func (cg *CodeGenerator) defineSymbols(ast *AST) error {
+	if cg.SymbolTable == nil {
+		return nil
+	}
+	for _, line := range ast.Program.Lines {
+		if l := line.Label; l != nil {
+			file := cg.File
+			if line.File != "" {
+				file = line.File
+			}
+			if _, err := cg.SymbolTable.Define(l.Name, cg.Labels[l.Name], file, l.Line, l.Column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	src := `        HALT
+        .FILL 0xEE
+        .DB 1
+        .ALIGN 4
+aligned:
+        HALT
+tbl:    .DW 1, 2
+end:
+        .ORG 0x40
+org:
+        NOP
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]Addr{"aligned": 8, "tbl": 12, "end": 16, "org": 0x40}
+	for name, addr := range want {
+		if cg.Labels[name] != addr {
+			t.Errorf("%s = 0x%X, want 0x%X", name, cg.Labels[name], addr)
+		}
+		if sym, ok := cg.SymbolTable.Lookup(name); !ok || !sym.Defined || sym.Address != addr {
+			t.Errorf("symbol table %s = %+v, want 0x%X", name, sym, addr)
+		}
+	}
+	if got := cg.Output[4:8]; string(got) != "\x01\xEE\xEE\xEE" {
+		t.Errorf(".DB and .ALIGN padding = % X, want 01 EE EE EE", got)
+	}
+	lines := map[int]Addr{1: 0, 3: 4, 4: 5, 6: 8, 7: 12, 9: 0x40, 11: 0x40}
+	for _, l := range cg.Listing {
+		if addr, ok := lines[l.Line]; ok && l.Addr != addr {
+			t.Errorf("listing of line %d at 0x%X, want 0x%X", l.Line, l.Addr, addr)
+		}
+		if l.Line == 4 && len(l.Code) != 3 {
+			t.Errorf("listing of .ALIGN has %d bytes, want 3", len(l.Code))
+		}
+	}
+
+	_, err = assembleSource(t, "a:\nHALT\na:\nNOP\n")
+	if err == nil || !strings.Contains(err.Error(), "duplicate definition of label 'a' at line 3") {
+		t.Errorf("duplicate label error = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Local and anonymous labels.
+//
+// A label that starts with a dot is local to the nearest preceding global
+// label, so every routine can have its own .loop and .done:
+//
+//	strlen:
+//	        SUB  T1, T1, T1
+//	.loop:
+//	        LD   T2, [T0+0]
+//	        BEQ  T2, 0, .done
+//	        INC  T1, T1
+//	        INC  T0, T0
+//	        JMP  .loop
+//	.done:
+//	        RET
+//
+// The full name of a local label is the global label, a dot and the local
+// name, strlen.loop here. That is the name in the symbol table, the listing
+// and diagnostics, and other routines can use it to refer to the label.
+//
+// A numeric label such as "1:" can be defined any number of times. "1b"
+// refers to the nearest definition on or before the line and "1f" to the
+// nearest one after it. Each definition is named after its number and line,
+// 1@12 for "1:" on line 12, and 1@12#3 in the third macro expansion.
+//
+// The grammar only knows plain identifiers, so rewriteLocalLabels turns local
+// and numeric label definitions into identifiers before parsing and
+// qualifyLabels gives them their full names in the AST. References are
+// expressions and are qualified in their parsed form.
+
+// localLabels records the local and numeric labels defined in a source.
+type localLabels struct {
+	defs    map[int]LabelNode // Label as written, by line
+	numeric map[string][]int  // Lines defining each numeric label, ascending
+	source  []srcLine         // Origin of each line, see expandMacros
+}
+
+// rewriteLocalLabels replaces every ".name:" label by "_name:", every
+// "1:" label by "_1:", taking the place of a following blank to keep the
+// columns of the line, and every "name#2:" label of a macro expansion by
+// "name_2:".
+func rewriteLocalLabels(src string, source []srcLine) (string, *localLabels) {
+	locals := &localLabels{defs: make(map[int]LabelNode), numeric: make(map[string][]int), source: source}
+	lines := strings.Split(src, "\n")
+	for n, l := range lines {
+		r := []rune(l)
+		i := skipSpace(r, 0, len(r))
+		if i == len(r) || r[i] >= 0x80 || r[i] != '.' && !isIdentChar(byte(r[i])) {
+			continue
+		}
+		k := i + 1
+		for k < len(r) && r[k] < 0x80 && (isDigit(byte(r[k])) || !isDigit(byte(r[i])) && isIdentChar(byte(r[k]))) {
+			k++
+		}
+		hash := -1
+		if k+1 < len(r) && r[k] == '#' && !isDigit(byte(r[i])) && isDigit(byte(r[k+1])) {
+			hash = k
+			for k++; k < len(r) && r[k] < 0x80 && isDigit(byte(r[k])); k++ {
+			}
+		}
+		colon := skipSpace(r, k, len(r))
+		local := r[i] == '.' && k > i+1 || isDigit(byte(r[i])) || hash >= 0
+		if !local || colon == len(r) || r[colon] != ':' {
+			continue
+		}
+		name, line := string(r[i:k]), n+1
+		locals.defs[line] = LabelNode{Name: name, Line: line, Column: i}
+		if hash >= 0 {
+			r[hash] = '_'
+		}
+		if r[i] == '.' {
+			r[i] = '_'
+		} else if isDigit(byte(r[i])) {
+			locals.numeric[name] = append(locals.numeric[name], line)
+			if colon+1 < len(r) && isSpaceRune(r[colon+1]) {
+				copy(r[i+1:colon+2], r[i:colon+1])
+				r[i] = '_'
+			} else {
+				r = append(r[:i], append([]rune{'_'}, r[i:]...)...)
+			}
+		}
+		lines[n] = string(r)
+	}
+	return strings.Join(lines, "\n"), locals
+}
+
+// qualifyLabels gives the local and numeric labels of the AST their full
+// names, both where they are defined and where they are used. A reference
+// that is only a label becomes an IdentifierNode, like a global label.
+func qualifyLabels(ast *AST, locals *localLabels) {
+	scope := ""
+	for _, line := range ast.Program.Lines {
+		if l := line.Label; l != nil {
+			if def, ok := locals.defs[l.Line]; ok {
+				l.Name, l.Column = locals.qualify(def.Name, scope, l.Line, true), def.Column
+			} else {
+				scope = l.Name
+			}
+		}
+		for _, ops := range operandLists(line.Statement) {
+			for i, op := range ops {
+				switch v := op.(type) {
+				case *ExprNode:
+					e, err := v.parsed()
+					if err != nil {
+						continue
+					}
+					locals.qualifyExpr(e, scope, v.Line)
+					if sym, ok := e.(*symExpr); ok {
+						ops[i] = &IdentifierNode{Name: sym.name, Line: v.Line, Column: v.Column}
+					}
+				case *MemoryOperandNode:
+					if v.Disp == nil {
+						continue
+					}
+					if e, err := v.Disp.parsed(); err == nil {
+						locals.qualifyExpr(e, scope, v.Line)
+					}
+				}
+			}
+		}
+	}
+}
+
+// qualifyExpr replaces the local and numeric label references in e by the
+// full names of the labels.
+func (ll *localLabels) qualifyExpr(e expr, scope string, line int) {
+	switch e := e.(type) {
+	case *symExpr:
+		e.name = ll.qualify(e.name, scope, line, false)
+	case *unaryExpr:
+		ll.qualifyExpr(e.x, scope, line)
+	case *binaryExpr:
+		ll.qualifyExpr(e.x, scope, line)
+		ll.qualifyExpr(e.y, scope, line)
+	case *callExpr:
+		for _, a := range e.args {
+			ll.qualifyExpr(a, scope, line)
+		}
+	}
+}
+
+// qualify returns the full name of a label defined (def) or used on a line
+// in the scope of a global label. A numeric reference without a matching
+// definition is returned unchanged and reported as an undefined symbol.
+func (ll *localLabels) qualify(name, scope string, line int, def bool) string {
+	switch {
+	case strings.HasPrefix(name, "."):
+		return scope + name
+	case !isDigit(name[0]):
+		return name
+	case def:
+		return ll.numericName(name, line)
+	}
+	num, dir := name[:len(name)-1], name[len(name)-1]
+	lines := ll.numeric[num]
+	if dir == 'b' {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if lines[i] <= line {
+				return ll.numericName(num, lines[i])
+			}
+		}
+	} else {
+		for _, l := range lines {
+			if l > line {
+				return ll.numericName(num, l)
+			}
+		}
+	}
+	return name
+}
+
+// numericName returns the name of the numeric label num defined on a line:
+// the number and the source line, and in a macro expansion the number of the
+// expansion, as in 1@12#3. The line of an included file follows its file
+// name, as in 1@defs.inc:12.
+func (ll *localLabels) numericName(num string, line int) string {
+	if line >= 1 && line <= len(ll.source) {
+		if src := ll.source[line-1]; src.File != "" {
+			return fmt.Sprintf("%s@%s:%s", num, src.File, src)
+		}
+		return fmt.Sprintf("%s@%s", num, ll.source[line-1])
+	}
+	return fmt.Sprintf("%s@%d", num, line)
+}
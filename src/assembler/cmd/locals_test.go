@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocalLabels(t *testing.T) {
+	src := `first:
+.loop:
+        DEC T0, T0
+        BNE T0, 0, .loop
+1:
+        JMP 1f
+1:
+        JMP 1b
+second:
+.loop:
+        JMP .loop
+        JMP first.loop
+        .DW .loop, SIZEOF(.tbl)
+.tbl:   .DW 1, 2
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]Addr{"first.loop": 0, "1@5": 8, "1@7": 12, "second.loop": 16, "second.tbl": 28}
+	for name, addr := range want {
+		if a, ok := cg.Labels[name]; !ok || a != addr {
+			t.Errorf("%s = 0x%X (defined %v), want 0x%X", name, a, ok, addr)
+		}
+		if sym, ok := cg.SymbolTable.Lookup(name); !ok || sym.Address != addr {
+			t.Errorf("symbol table %s = %+v, want 0x%X", name, sym, addr)
+		}
+	}
+	words := slotWords(cg.Output[:7*InstrSlotBytes])
+	if words[1].Imm != -1 {
+		t.Errorf("BNE .loop offset = %d, want -1", words[1].Imm)
+	}
+	for i, off := range map[int]int32{2: 1, 3: 0, 4: 0, 5: -5} {
+		if words[i].Imm != off {
+			t.Errorf("slot %d offset = %d, want %d", i, words[i].Imm, off)
+		}
+	}
+	if data := cg.Output[24:28]; string(data) != "\x00\x10\x00\x04" {
+		t.Errorf(".DW .loop, SIZEOF(.tbl) = % X, want 00 10 00 04", data)
+	}
+
+	_, err = assembleSource(t, "outer:\n        JMP .missing\n")
+	if err == nil || !strings.Contains(err.Error(), "outer.missing") {
+		t.Errorf("undefined local label error = %v", err)
+	}
+	_, err = assembleSource(t, "outer:\n.a:\n.a:\n")
+	if err == nil || !strings.Contains(err.Error(), "duplicate definition of label 'outer.a' at line 3, column 1") {
+		t.Errorf("duplicate local label error = %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Macros.
+//
+// A macro is defined once and then used like an instruction:
+//
+//	.MACRO SWAP a, b, tmp=T2
+//	        ADD  tmp, a, 0
+//	        ADD  a, b, 0
+//	        ADD  b, tmp, 0
+//	.ENDM
+//
+//	        SWAP T0, T1
+//	        SWAP b=T4, a=T3, tmp=T5
+//
+// Parameters are given by position or by name; a parameter with a default
+// may be left out. Every whole word in the body that names a parameter is
+// replaced by the argument. A label defined in the body is local to each
+// expansion: its name gets the number of the expansion, so the second
+// expansion of a macro defining "again:" defines "again#2", and one defining
+// ".loop:" after the global label main defines "main.loop#2". Numeric labels
+// carry the expansion number in their names already (see locals.go). A body may
+// invoke other macros, up to maxMacroDepth expansions deep, and .EXITM ends
+// the expansion early.
+//
+// Macros are expanded in the source text before parsing, so the grammar's
+// macroDefinition rule never sees a definition. expandMacros returns where
+// every line of the expanded source comes from, and once the AST is built
+// remapLines points the lines of each expansion back into the macro body.
+
+// maxMacroDepth limits nested macro invocations, catching macros that
+// invoke themselves.
+const maxMacroDepth = 32
+
+// srcLine is where a line of the expanded source comes from.
+type srcLine struct {
+	File      string // Included file, "" for the source file itself
+	Line      int    // Line in the file, inside the macro body for an expanded line
+	Expansion int    // Number of the macro expansion the line is part of, 0 outside macros
+}
+
+// String returns the line number, followed by the expansion number for a
+// line of a macro expansion: 12#3. The file is left to fileError.
+func (l srcLine) String() string {
+	if l.Expansion == 0 {
+		return fmt.Sprint(l.Line)
+	}
+	return fmt.Sprintf("%d#%d", l.Line, l.Expansion)
+}
+
+// macroParam is a parameter of a macro.
+type macroParam struct {
+	Name       string
+	Default    string
+	HasDefault bool
+}
+
+// macro is a macro definition.
+type macro struct {
+	Name   string
+	Params []macroParam
+	Body   []string
+	Pos    srcLine         // Position of the .MACRO directive
+	source []srcLine       // Position of each body line
+	labels map[string]bool // Labels defined in the body
+}
+
+// macroExpander expands the macro invocations of a source.
+type macroExpander struct {
+	macros map[string]*macro // By upper-case name
+	count  int               // Expansions so far
+	cond   *conditions       // Conditions of the macro bodies, see cond.go
+	at     int               // Line of the source being expanded
+	out    []string
+	lines  []srcLine
+}
+
+// expandMacros collects the macro definitions of src and replaces every
+// invocation by the body of the macro. source gives the origin of each line
+// of src (see expandIncludes); expandMacros returns the expanded source and
+// the origin of each of its lines. cond evaluates the conditional directives
+// of the macro bodies.
+func expandMacros(src string, source []srcLine, cond *conditions) (string, []srcLine, error) {
+	x := &macroExpander{macros: make(map[string]*macro), cond: cond}
+	lines := strings.Split(src, "\n")
+	var rest []int // Lines outside macro definitions
+	var def *macro
+	for i, l := range lines {
+		_, word, args := splitMacroLine(l)
+		pos := source[i]
+		switch strings.ToUpper(word) {
+		case ".MACRO":
+			if def != nil {
+				return "", nil, fileError(pos.File, fmt.Errorf("nested .MACRO at line %d inside macro %s defined at line %d", pos.Line, def.Name, def.Pos.Line))
+			}
+			m, err := parseMacroHeader(args, pos)
+			if err != nil {
+				return "", nil, fileError(pos.File, err)
+			}
+			def = m
+		case ".ENDM":
+			if def == nil {
+				return "", nil, fileError(pos.File, fmt.Errorf(".ENDM without .MACRO at line %d", pos.Line))
+			}
+			if err := x.define(def); err != nil {
+				return "", nil, fileError(def.Pos.File, err)
+			}
+			def = nil
+		default:
+			if def != nil {
+				def.Body = append(def.Body, l)
+				def.source = append(def.source, pos)
+			} else {
+				rest = append(rest, i)
+			}
+		}
+	}
+	if def != nil {
+		return "", nil, fileError(def.Pos.File, fmt.Errorf("missing .ENDM for macro %s defined at line %d", def.Name, def.Pos.Line))
+	}
+	for _, i := range rest {
+		x.at = i
+		if err := x.line(lines[i], source[i], 0); err != nil {
+			return "", nil, err
+		}
+	}
+	return strings.Join(x.out, "\n"), x.lines, nil
+}
+
+// parseMacroHeader parses the name and parameters after .MACRO. Parameters
+// are separated by commas or, as in the grammar, by blanks.
+func parseMacroHeader(args string, pos srcLine) (*macro, error) {
+	line := pos.Line
+	fields := strings.Fields(args)
+	if len(fields) == 0 || !identifierPattern.MatchString(fields[0]) {
+		return nil, fmt.Errorf("missing macro name after .MACRO at line %d", line)
+	}
+	m := &macro{Name: fields[0], Pos: pos, labels: make(map[string]bool)}
+	params := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), fields[0]))
+	var list []string
+	if strings.Contains(params, ",") {
+		list = strings.Split(params, ",")
+	} else {
+		list = strings.Fields(params)
+	}
+	for _, p := range list {
+		name, def, hasDefault := strings.Cut(p, "=")
+		name = strings.TrimSpace(name)
+		if !identifierPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter %q of macro %s at line %d", strings.TrimSpace(p), m.Name, line)
+		}
+		if m.param(name) >= 0 {
+			return nil, fmt.Errorf("duplicate parameter %s of macro %s at line %d", name, m.Name, line)
+		}
+		m.Params = append(m.Params, macroParam{Name: name, Default: strings.TrimSpace(def), HasDefault: hasDefault})
+	}
+	return m, nil
+}
+
+// define adds a complete definition.
+func (x *macroExpander) define(m *macro) error {
+	key := strings.ToUpper(m.Name)
+	if prev, dup := x.macros[key]; dup {
+		where := fmt.Sprintf("line %d", prev.Pos.Line)
+		if prev.Pos.File != m.Pos.File {
+			where = fmt.Sprintf("%s line %d", prev.Pos.File, prev.Pos.Line)
+		}
+		return fmt.Errorf("duplicate definition of macro %s at line %d (originally defined at %s)", m.Name, m.Pos.Line, where)
+	}
+	if _, ok := LookupInstr(m.Name); ok {
+		return fmt.Errorf("macro %s at line %d has the name of an instruction", m.Name, m.Pos.Line)
+	}
+	for _, l := range m.Body {
+		label, _, _ := splitMacroLine(l)
+		if identifierPattern.MatchString(label) && m.param(label) < 0 ||
+			strings.HasPrefix(label, ".") && identifierPattern.MatchString(label[1:]) {
+			m.labels[label] = true
+		}
+	}
+	x.macros[key] = m
+	return nil
+}
+
+// param returns the index of the parameter called name, or -1.
+func (m *macro) param(name string) int {
+	for i, p := range m.Params {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// line copies one source line to the output, expanding it if it invokes a
+// macro.
+func (x *macroExpander) line(text string, pos srcLine, depth int) error {
+	label, word, args := splitMacroLine(text)
+	m, ok := x.macros[strings.ToUpper(word)]
+	if !ok {
+		x.out, x.lines = append(x.out, text), append(x.lines, pos)
+		if depth > 0 {
+			x.cond.note(text, x.at)
+		}
+		return nil
+	}
+	if depth >= maxMacroDepth {
+		return fileError(pos.File, fmt.Errorf("macro %s nested more than %d deep at line %s", m.Name, maxMacroDepth, pos))
+	}
+	subst, err := m.bind(args, pos)
+	if err != nil {
+		return fileError(pos.File, err)
+	}
+	if label != "" {
+		x.out, x.lines = append(x.out, label+":"), append(x.lines, pos)
+	}
+	x.count++
+	n := x.count
+	for l := range m.labels {
+		subst[l] = fmt.Sprintf("%s#%d", l, n)
+	}
+	base := len(x.cond.stack)
+	for i, body := range m.Body {
+		pos := m.source[i]
+		pos.Expansion = n
+		text := substituteWords(body, subst)
+		if ok, err := x.cond.directive(text, pos, x.at); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !x.cond.active() {
+			continue
+		}
+		if _, word, _ := splitMacroLine(body); strings.EqualFold(word, ".EXITM") {
+			x.cond.stack = x.cond.stack[:base]
+			return nil
+		}
+		if err := x.line(text, pos, depth+1); err != nil {
+			return err
+		}
+	}
+	return x.cond.end(base)
+}
+
+// bind matches the arguments of an invocation with the parameters.
+func (m *macro) bind(args string, pos srcLine) (map[string]string, error) {
+	subst := make(map[string]string)
+	r := []rune(args)
+	named := false
+	for i, part := range splitOperands(r, 0, len(r)) {
+		text := strings.TrimSpace(string(r[part[0]:part[1]]))
+		if text == "" && i == 0 && strings.TrimSpace(args) == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(text, "="); ok && identifierPattern.MatchString(strings.TrimSpace(name)) {
+			name = strings.TrimSpace(name)
+			if m.param(name) < 0 {
+				return nil, fmt.Errorf("macro %s has no parameter %s at line %s", m.Name, name, pos)
+			}
+			if _, dup := subst[name]; dup {
+				return nil, fmt.Errorf("parameter %s of macro %s given twice at line %s", name, m.Name, pos)
+			}
+			subst[name], named = strings.TrimSpace(value), true
+			continue
+		}
+		if named {
+			return nil, fmt.Errorf("positional argument %s after named arguments of macro %s at line %s", text, m.Name, pos)
+		}
+		if i >= len(m.Params) {
+			return nil, fmt.Errorf("macro %s takes %d argument(s), got %d at line %s", m.Name, len(m.Params), i+1, pos)
+		}
+		subst[m.Params[i].Name] = text
+	}
+	for _, p := range m.Params {
+		if _, ok := subst[p.Name]; ok {
+			continue
+		}
+		if !p.HasDefault {
+			return nil, fmt.Errorf("missing argument %s of macro %s at line %s", p.Name, m.Name, pos)
+		}
+		subst[p.Name] = p.Default
+	}
+	return subst, nil
+}
+
+// splitMacroLine splits a source line into its label, its first word and
+// the rest of the line before the comment.
+func splitMacroLine(text string) (label, word, rest string) {
+	r := []rune(text)
+	end := commentStart(r)
+	i := skipSpace(r, 0, end)
+	we := wordEnd(r, i, end)
+	if j := skipSpace(r, we, end); j < end && r[j] == ':' && we > i {
+		label = string(r[i:we])
+		i = skipSpace(r, j+1, end)
+		we = wordEnd(r, i, end)
+	}
+	return label, string(r[i:we]), string(r[we:end])
+}
+
+// substituteWords replaces every whole word of text found in subst, outside
+// strings and the comment.
+func substituteWords(text string, subst map[string]string) string {
+	r := []rune(text)
+	end := commentStart(r)
+	var sb strings.Builder
+	quoted := false
+	for i := 0; i < len(r); {
+		c := r[i]
+		if i >= end || c == '"' || quoted || !isWordStart(r, i) && !isLocalStart(r, i) {
+			if i < end && c == '"' {
+				quoted = !quoted
+			}
+			sb.WriteRune(c)
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(r) && r[j] < 0x80 && isIdentChar(byte(r[j])) {
+			j++
+		}
+		if v, ok := subst[string(r[i:j])]; ok && (j == len(r) || r[j] != '#') {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(string(r[i:j]))
+		}
+		i = j
+	}
+	return sb.String()
+}
+
+// isWordStart reports whether an identifier starts at r[i]: a letter or _
+// not preceded by a character that makes it part of another name.
+func isWordStart(r []rune, i int) bool {
+	c := r[i]
+	if c >= 0x80 || !isIdentChar(byte(c)) || isDigit(byte(c)) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	p := r[i-1]
+	return p >= 0x80 || !isIdentChar(byte(p)) && p != '.' && p != '#'
+}
+
+// isLocalStart reports whether a local label name such as .loop starts at
+// r[i].
+func isLocalStart(r []rune, i int) bool {
+	if r[i] != '.' || i+1 == len(r) || r[i+1] >= 0x80 || !isIdentChar(byte(r[i+1])) || isDigit(byte(r[i+1])) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	p := r[i-1]
+	return p >= 0x80 || !isIdentChar(byte(p)) && p != '.' && p != '#'
+}
+
+// remapLines replaces the line numbers of the AST, which count lines of the
+// expanded source, by the lines they come from, and records the file of
+// every line.
+func remapLines(ast *AST, lines []srcLine) {
+	at := func(n int) int {
+		if n >= 1 && n <= len(lines) {
+			return lines[n-1].Line
+		}
+		return n
+	}
+	operands := func(ops []OperandNode) {
+		for _, op := range ops {
+			switch v := op.(type) {
+			case *RegisterNode:
+				v.Line = at(v.Line)
+			case *ImmediateNode:
+				v.Line = at(v.Line)
+			case *IdentifierNode:
+				v.Line = at(v.Line)
+			case *ExprNode:
+				v.Line = at(v.Line)
+			case *MemoryOperandNode:
+				if v.Disp != nil {
+					v.Disp.Line = at(v.Disp.Line)
+				}
+				v.Line = at(v.Line)
+			}
+		}
+	}
+	for _, line := range ast.Program.Lines {
+		if line.Line >= 1 && line.Line <= len(lines) {
+			line.File = lines[line.Line-1].File
+		}
+		if line.Line >= 1 && line.Line <= len(lines) {
+			line.Expansion = lines[line.Line-1].Expansion
+		}
+		line.Line = at(line.Line)
+		if line.Label != nil {
+			line.Label.Line = at(line.Label.Line)
+		}
+		switch s := line.Statement.(type) {
+		case *InstructionNode:
+			s.Line = at(s.Line)
+		case *DirectiveNode:
+			s.Line = at(s.Line)
+		case *VLIWInstructionNode:
+			s.Line = at(s.Line)
+			for _, in := range s.Instructions {
+				in.Line = at(in.Line)
+			}
+		}
+		for _, ops := range operandLists(line.Statement) {
+			operands(ops)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMacros(t *testing.T) {
+	src := `.MACRO SWAP a, b, tmp=T2
+        ADD tmp, a, 0
+        ADD a, b, 0
+        ADD b, tmp, 0
+.ENDM
+.MACRO WAIT reg=T0
+again:
+        DEC reg, reg
+        BNE reg, 0, again
+        .EXITM
+        HALT
+.ENDM
+.MACRO BOTH
+        SWAP T0, T1
+        WAIT T1
+.ENDM
+        SWAP T0, T1
+        SWAP b=T4, a=T3, tmp=T5
+        BOTH
+        WAIT
+`
+	ctx := parseSource(t, src)
+	if first := ctx.AST.Program.Lines[0].Statement.(*InstructionNode); first.Line != 2 {
+		t.Errorf("first expanded line = %d, want 2 in the body of SWAP", first.Line)
+	}
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	if len(words) != 13 {
+		t.Fatalf("got %d slots, want 13", len(words))
+	}
+	if w := words[3]; w.Rd != 5 || w.Rs1 != 3 {
+		t.Errorf("SWAP with named arguments: first ADD = T%d, T%d, want T5, T3", w.Rd, w.Rs1)
+	}
+	if w := words[9]; w.Rd != 1 {
+		t.Errorf("nested WAIT T1 decrements T%d, want T1", w.Rd)
+	}
+	if w := words[11]; w.Rd != 0 {
+		t.Errorf("WAIT with default decrements T%d, want T0", w.Rd)
+	}
+	if cg.Labels["again#5"] != 36 || cg.Labels["again#6"] != 44 {
+		t.Errorf("macro labels = %v, want again#5 = 36, again#6 = 44", cg.Labels)
+	}
+
+	// Every expansion branches to its own again; only done is unused.
+	ctx = parseSource(t, src+"done:\n        HALT\n")
+	if err := NewCodeGenerator(ctx.SymbolTable).Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if unused := ctx.SymbolTable.UnusedLabels(); len(unused) != 1 || unused[0].Name != "done" {
+		t.Errorf("unused labels = %v, want only done", unused)
+	}
+
+	// Local and numeric labels of the body are unique to each expansion too.
+	cg, err := assembleSource(t, `.MACRO WAIT n
+.loop:
+        DEC n, n
+        BNE n, 0, .loop
+1:
+        BNE n, 0, 1b
+.ENDM
+main:
+        WAIT T0
+        WAIT T1
+`)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if cg.Labels["main.loop#1"] != 0 || cg.Labels["main.loop#2"] != 12 || cg.Labels["1@5#2"] != 20 {
+		t.Errorf("macro labels = %v, want main.loop#1 = 0, main.loop#2 = 12, 1@5#2 = 20", cg.Labels)
+	}
+	if w := slotWords(cg.Output)[4]; w.Imm != -1 {
+		t.Errorf("BNE of the second expansion branches by %d slots, want -1 to its own .loop", w.Imm)
+	}
+	_, err = assembleSource(t, ".MACRO DUP\n.a:\n.a:\n.ENDM\nmain:\n        DUP\n        DUP\n")
+	if want := "duplicate definition of label 'main.a#1' at line 3#1, column 1 (originally defined at line 2#1, column 1)"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+
+	for _, c := range []struct{ src, want string }{
+		{".MACRO R\n        R\n.ENDM\n        R\n", "macro R nested more than 32 deep"},
+		{src + "        SWAP T0\n", "missing argument b of macro SWAP at line 21"},
+		{src + "        SWAP T0, T1, T2, T3\n", "macro SWAP takes 3 argument(s), got 4 at line 21"},
+		{src + "        SWAP c=T1\n", "macro SWAP has no parameter c at line 21"},
+		{".MACRO ADD\n.ENDM\n", "macro ADD at line 1 has the name of an instruction"},
+		{".MACRO M\nHALT\n", "missing .ENDM for macro M defined at line 1"},
+		{".MACRO BAD\n        ADD T0,, T1\n.ENDM\n        BAD\n", "syntax error at line 2:"},
+	} {
+		ctx := &CompilationContext{SourceCode: c.src, ErrorManager: NewErrorManager(), SymbolTable: NewSymbolTable()}
+		err := runParsing(ctx)
+		if err == nil && ctx.ErrorManager.HasErrors() {
+			err = ctx.ErrorManager.Errors[0]
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Memory image.
+//
+// Code and data are written into address-tagged segments rather than one flat
+// stream. The program starts a segment at address 0 and every .ORG starts a
+// new one, so code placed at 0x1000 and data at 0x1100 keep their addresses.
+// A segment records its fill value, the contents of the unwritten addresses
+// between the previous segment and itself, as set by the last .FILL.
+//
+// When generation ends, every pair of segments is checked for overlap. The
+// binary and word containers flatten the segments from the lowest address,
+// Intel HEX writes each segment at its own address, and the listing shows the
+// bytes of each line as placed in its segment.
+
+// Segment is a run of consecutive addresses written by the program.
+type Segment struct {
+	Addr    Addr          // Address of the first unit
+	Line    int           // Source line of the first write
+	Fill    int64         // Value of the unwritten addresses before the segment
+	Data    []byte        // Contents as bytes
+	Words   []MachineWord // Contents as 36-bit machine words
+	Bundles []int         // Indices of the Words that start a bundle
+
+	tail []byte // Data bytes not yet completing a word
+}
+
+// End returns the address after the last unit of s.
+func (s *Segment) End(unit AddrUnit) Addr {
+	return s.Addr + Addr(len(s.Data)/unit.unitBytes())
+}
+
+// MemoryImage is the program as written by the code generator.
+type MemoryImage struct {
+	Unit     AddrUnit
+	Segments []*Segment // In the order the program started them
+
+	line    int   // Source line being generated
+	wordErr error // First write the word image cannot place
+	bundle  bool  // The next word starts a bundle
+}
+
+// NewMemoryImage returns an empty image whose first segment starts at 0.
+func NewMemoryImage(unit AddrUnit) *MemoryImage {
+	return &MemoryImage{Unit: unit, Segments: []*Segment{{}}}
+}
+
+func (m *MemoryImage) current() *Segment { return m.Segments[len(m.Segments)-1] }
+
+// org starts a new segment at addr; unwritten addresses before it hold fill.
+func (m *MemoryImage) org(addr Addr, fill int64) {
+	cur := m.current()
+	cur.flush()
+	if len(cur.Data) == 0 {
+		m.Segments = m.Segments[:len(m.Segments)-1]
+	}
+	m.Segments = append(m.Segments, &Segment{Addr: addr, Fill: fill})
+}
+
+// write appends data bytes; the word image packs them four to a word.
+func (m *MemoryImage) write(b []byte) {
+	cur := m.current()
+	m.started(cur)
+	cur.Data = append(cur.Data, b...)
+	for _, c := range b {
+		cur.tail = append(cur.tail, c)
+		if len(cur.tail) == InstrSlotBytes {
+			cur.flush()
+		}
+	}
+}
+
+// writeWord appends one whole word: b is its byte form, w its word form.
+func (m *MemoryImage) writeWord(b []byte, w MachineWord) {
+	cur := m.current()
+	m.started(cur)
+	if len(cur.tail) > 0 {
+		if m.wordErr == nil {
+			m.wordErr = fmt.Errorf("the word at 0x%X follows %d byte(s) of data and is not word-aligned, pad the data or use --addrunit word", cur.End(m.Unit), len(cur.tail))
+		}
+		cur.flush()
+	}
+	if m.bundle {
+		cur.Bundles = append(cur.Bundles, len(cur.Words))
+		m.bundle = false
+	}
+	cur.Data = append(cur.Data, b...)
+	cur.Words = append(cur.Words, w)
+}
+
+// startBundle marks the next word as the first slot of a bundle.
+func (m *MemoryImage) startBundle() { m.bundle = true }
+
+// started records the line of the first write to s.
+func (m *MemoryImage) started(s *Segment) {
+	if len(s.Data) == 0 {
+		s.Line = m.line
+	}
+}
+
+// flush appends the pending data bytes of s as one zero-padded word.
+func (s *Segment) flush() {
+	if len(s.tail) == 0 {
+		return
+	}
+	var w MachineWord
+	for i, c := range s.tail {
+		w |= MachineWord(c) << (8 * i)
+	}
+	s.Words = append(s.Words, w)
+	s.tail = s.tail[:0]
+}
+
+// mark returns the current write position, for since.
+func (m *MemoryImage) mark() (*Segment, int) {
+	cur := m.current()
+	return cur, len(cur.Data)
+}
+
+// since returns the bytes written after mark, or nil if a new segment was
+// started in between.
+func (m *MemoryImage) since(s *Segment, n int) []byte {
+	if m.current() != s {
+		return nil
+	}
+	return s.Data[n:len(s.Data):len(s.Data)]
+}
+
+// finish completes the last word and rejects overlapping segments.
+func (m *MemoryImage) finish() error {
+	m.current().flush()
+	for i, s := range m.Segments {
+		for _, prev := range m.Segments[:i] {
+			if len(s.Data) == 0 || len(prev.Data) == 0 {
+				continue
+			}
+			if s.Addr < prev.End(m.Unit) && prev.Addr < s.End(m.Unit) {
+				return fmt.Errorf("line %d writes 0x%X..0x%X, which overlaps 0x%X..0x%X written from line %d",
+					s.Line, s.Addr, s.End(m.Unit)-1, prev.Addr, prev.End(m.Unit)-1, prev.Line)
+			}
+		}
+	}
+	return nil
+}
+
+// sorted returns the non-empty segments by address.
+func (m *MemoryImage) sorted() []*Segment {
+	var out []*Segment
+	for _, s := range m.Segments {
+		if len(s.Data) > 0 {
+			out = append(out, s)
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Addr < out[b].Addr })
+	return out
+}
+
+// Base returns the lowest written address.
+func (m *MemoryImage) Base() Addr {
+	if segs := m.sorted(); len(segs) > 0 {
+		return segs[0].Addr
+	}
+	return 0
+}
+
+// fillBytes returns the byte form of one address unit holding fill.
+func (m *MemoryImage) fillBytes(fill int64) []byte {
+	switch m.Unit {
+	case UnitWord:
+		b := byte(fill)
+		return []byte{b, b, b, b}
+	case UnitTritWord:
+		var buf [InstrSlotBytes]byte
+		binary.LittleEndian.PutUint32(buf[:], uint32(int32(fill)))
+		return buf[:]
+	}
+	return []byte{byte(fill)}
+}
+
+// fillWord returns the word form of a word holding fill.
+func (m *MemoryImage) fillWord(fill int64) MachineWord {
+	if m.Unit == UnitTritWord {
+		return tritWord(fill)
+	}
+	b := MachineWord(byte(fill))
+	return b | b<<8 | b<<16 | b<<24
+}
+
+// Bytes flattens the image from its lowest address.
+func (m *MemoryImage) Bytes() []byte {
+	segs := m.sorted()
+	var out []byte
+	for _, s := range segs {
+		for off := (s.Addr - segs[0].Addr) * Addr(m.Unit.unitBytes()); Addr(len(out)) < off; {
+			out = append(out, m.fillBytes(s.Fill)...)
+		}
+		out = append(out, s.Data...)
+	}
+	return out
+}
+
+// Words flattens the word image from the lowest address. It fails when a
+// word would not start on a word boundary.
+func (m *MemoryImage) Words() ([]MachineWord, error) {
+	if m.wordErr != nil {
+		return nil, m.wordErr
+	}
+	segs := m.sorted()
+	var out []MachineWord
+	for _, s := range segs {
+		if int(s.Addr)*m.Unit.unitBytes()%InstrSlotBytes != 0 {
+			return nil, fmt.Errorf("the segment at 0x%X (line %d) does not start on a word boundary", s.Addr, s.Line)
+		}
+		for len(out) < m.wordIndex(s) {
+			out = append(out, m.fillWord(s.Fill))
+		}
+		out = append(out, s.Words...)
+	}
+	return out, nil
+}
+
+// wordAddr returns the word address of the first word of s.
+func (m *MemoryImage) wordAddr(s *Segment) int {
+	return int(s.Addr) * m.Unit.unitBytes() / InstrSlotBytes
+}
+
+// wordIndex returns the index in Words of the first word of s.
+func (m *MemoryImage) wordIndex(s *Segment) int {
+	return m.wordAddr(s) - m.wordAddr(m.sorted()[0])
+}
+
+// UnitStarts returns the indices of the words of Words that must begin a
+// 108-bit unit: the first word of every segment and of every bundle.
+func (m *MemoryImage) UnitStarts() []int {
+	if m == nil {
+		return nil
+	}
+	var starts []int
+	for _, s := range m.sorted() {
+		first := m.wordIndex(s)
+		starts = append(starts, first)
+		for _, b := range s.Bundles {
+			if b > 0 {
+				starts = append(starts, first+b)
+			}
+		}
+	}
+	return starts
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemorySegments(t *testing.T) {
+	cg, err := assembleSource(t, ".ORG 0x10\nHALT\n.FILL 0xFF\n.ORG 0x20\n.DB 1, 2\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Memory.sorted()) != 2 || cg.Memory.Base() != 0x10 {
+		t.Fatalf("got %d segments from 0x%X, want 2 from 0x10", len(cg.Memory.sorted()), cg.Memory.Base())
+	}
+	if len(cg.Output) != 18 || cg.Output[4] != 0xFF || cg.Output[15] != 0xFF || cg.Output[16] != 1 {
+		t.Errorf("flattened image = % X", cg.Output)
+	}
+	if l := cg.Listing[len(cg.Listing)-1]; l.Addr != 0x20 || string(l.Code) != "\x01\x02" {
+		t.Errorf("listing of .DB = 0x%X % X, want 0x20 01 02", l.Addr, l.Code)
+	}
+
+	_, err = assembleSource(t, "HALT\nHALT\n.ORG 4\nNOP\n")
+	if err == nil || !strings.Contains(err.Error(), "line 4 writes 0x4..0x7, which overlaps 0x0..0x7 written from line 1") {
+		t.Errorf("overlap error = %v", err)
+	}
+
+	ctx := parseSource(t, ".ORG 2\nHALT\n.FILL 7\n.ORG 5\nHALT\n")
+	cg = NewCodeGenerator(ctx.SymbolTable)
+	cg.AddrUnit = UnitWord
+	if err := cg.Generate(ctx.AST); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Image) != 4 || cg.Image[1] != 0x07070707 || cg.Image[3] != cg.Image[0] {
+		t.Errorf("word image = %X, want HALT, two fill words, HALT", cg.Image)
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	cg, err := assembleSource(t, ".ORG 0x10\n.DB 1, 2\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got := formatAsHex(hexSegments(cg.Memory)); got != ":020010000102EB\n:00000001FF\n" {
+		t.Errorf("hex = %q", got)
+	}
+
+	// Word containers keep the segments at their word addresses.
+	cg, err = assembleSource(t, ".ORG 0x30\nHALT\n[ADD T0, T0, 1] [NOP]\n.ORG 0x60\n.DW 5\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	blocks := wordHexSegments(cg.Memory, cg.Image, pack36BitWords)
+	if len(blocks) != 2 || blocks[0].Addr != 5*12 || len(blocks[0].Data) != 5*4 || blocks[1].Addr != 5*24 || len(blocks[1].Data) != 5 {
+		t.Errorf("36-bit hex blocks = %v, want 4 words at word 12 and 1 at word 24", blocks)
+	}
+	packed, units := pack108BitWords(cg.Image, cg.Memory.UnitStarts())
+	blocks = unitHexSegments(cg.Memory, packed, units)
+	// Units count from word 12, unit 4; the bundle and the fill words after
+	// it push the data segment to the sixth unit.
+	if len(blocks) != 2 || blocks[0].Addr != 14*4 || len(blocks[0].Data) != 14*2 || blocks[1].Addr != 14*9 || len(blocks[1].Data) != 14 {
+		t.Errorf("108-bit hex blocks = %v, want 2 units at unit 4 and 1 at unit 9", blocks)
+	}
+
+	got := formatAsHex([]hexBlock{{Addr: 0x1FFFF, Data: []byte{0xAA, 0xBB}}})
+	want := ":020000040001F9\n:01FFFF00AA57\n:020000040002F8\n:01000000BB44\n:00000001FF\n"
+	if got != want {
+		t.Errorf("hex across 64K = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The Par field of a slot tells the issue logic which units the operation
+// runs alongside. The assembler derives it from the other slots of the
+// bundle: an operation alone (or with only NOPs) is serial, an operation
+// whose companions all use one unit class is parallel with that class, and
+// an operation whose companions use several classes is full parallel.
+// Standalone instructions are serial.
+//
+// The value can be overridden per slot with a pragma on the same line,
+// one argument per slot in source order; "auto" keeps the derived value:
+//
+//	[ADD T0, T1, T2] [LD T3, [TB]]   ; @par serial, auto
+
+// parClass returns the unit class of a slot (ParALU, ParMemory or
+// ParControl), or ParSerial for a NOP, which occupies no unit.
+func parClass(s bundleSlot) uint8 {
+	switch {
+	case s.desc.Mnemonic == "NOP":
+		return ParSerial
+	case isControlOp(s.desc, s.writes):
+		return ParControl
+	case isMemoryOp(s.desc):
+		return ParMemory
+	}
+	return ParALU
+}
+
+// companions returns the set of unit classes used by the slots other than
+// slot i, as a bit mask indexed by class.
+func companions(slots []bundleSlot, i int) uint8 {
+	var set uint8
+	for j, s := range slots {
+		if c := parClass(s); j != i && c != ParSerial {
+			set |= 1 << c
+		}
+	}
+	return set
+}
+
+// deriveParFlags computes the Par value of every slot of a bundle.
+func deriveParFlags(slots []bundleSlot) []uint8 {
+	flags := make([]uint8, len(slots))
+	for i := range slots {
+		switch set := companions(slots, i); {
+		case set == 0:
+			flags[i] = ParSerial
+		case set&(set-1) == 0: // one class
+			for c := uint8(ParALU); c <= ParControl; c++ {
+				if set == 1<<c {
+					flags[i] = c
+				}
+			}
+		default:
+			flags[i] = ParFull
+		}
+	}
+	return flags
+}
+
+// parseParPragma returns the explicit Par values of an @par pragma, -1
+// standing for "auto". Values are names (serial, alu, mem, ctrl, full) or
+// numbers; reserved numbers are rejected.
+func parseParPragma(p pragma) ([]int, error) {
+	if len(p.Args) == 0 {
+		return nil, fmt.Errorf("@par at line %d needs one value per slot", p.Line)
+	}
+	values := make([]int, len(p.Args))
+	for i, a := range p.Args {
+		values[i] = -1
+		if a == "auto" || a == "-" {
+			continue
+		}
+		v, err := strconv.ParseUint(a, 10, 8)
+		if err != nil {
+			found := false
+			for n, name := range parNames {
+				if strings.EqualFold(a, name) {
+					v, found = uint64(n), true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("@par at line %d: unknown value %q (use serial, alu, mem, ctrl, full, 0-4 or auto)", p.Line, a)
+			}
+		}
+		switch {
+		case v > parMask:
+			return nil, fmt.Errorf("@par at line %d: %d does not fit the 3-bit Par field", p.Line, v)
+		case v > parMaxUsed:
+			return nil, fmt.Errorf("@par at line %d: Par value %03b is reserved", p.Line, v)
+		}
+		values[i] = int(v)
+	}
+	return values, nil
+}
+
+// applyParOverrides replaces derived Par values with the explicit ones,
+// rejecting values that contradict the bundle. For a standalone
+// instruction slots has a single entry and only serial is compatible.
+func applyParOverrides(flags []uint8, slots []bundleSlot, values []int, line int) error {
+	if len(values) > len(slots) {
+		return fmt.Errorf("@par at line %d gives %d values for %d slot(s)", line, len(values), len(slots))
+	}
+	for i, v := range values {
+		if v < 0 {
+			continue
+		}
+		set := companions(slots, i)
+		what := fmt.Sprintf("@par at line %d: %s cannot be %s", line, slotText(i, slots[i]), parNames[v])
+		switch {
+		case v == ParFull && set == 0:
+			return fmt.Errorf("%s, no other slot runs alongside it", what)
+		case v != ParSerial && v != ParFull && set&(1<<v) == 0:
+			return fmt.Errorf("%s, no other slot of the bundle uses that unit", what)
+		}
+		flags[i] = uint8(v)
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Software pipelining of marked loops.
+//
+// A loop is marked with a .PIPELINE directive (or an @pipeline pragma) on the
+// line before its label or on the label line itself:
+//
+//	        .PIPELINE min=16, unroll=2, noalias
+//	copy:
+//	        LD  T3, [T0]
+//	        ST  T3, [T1]
+//	        ADD T0, T0, 1
+//	        ADD T1, T1, 1
+//	        SUB T2, T2, 1
+//	        BNE T2, 0, copy
+//
+// The loop must be a single block of plain instructions closed by a
+// conditional branch back to the label, and must run at least once
+// (a do-while loop). min gives the smallest trip count the loop is ever
+// entered with; unroll=k repeats the body k times, dropping the closing branch
+// of all but the last copy, and requires the trip count to be a multiple of k.
+// noalias states that no load reads memory that a store of the loop writes
+// (in any iteration), so loads may move ahead of stores; without it memory
+// operations keep their order.
+//
+// The body is modulo scheduled: every iteration follows the same schedule and
+// a new iteration starts every II cycles. Operations are placed so that all
+// register and memory dependencies, including those between iterations, keep
+// their latencies, and no cycle uses more units than a bundle provides. The
+// branch and the operations it depends on (the loop counter) are kept in the
+// first stage and the branch in the last cycle of the kernel, so the kernel
+// runs while another iteration remains to be started. With S stages, the
+// prologue starts the first S-1 iterations and the epilogue finishes the last
+// S-1 ones, which needs at least S (unrolled) iterations; S is therefore
+// limited to min/k, and to 1 when min is not given.
+//
+// The loop label keeps pointing at the start of the loop (the prologue); the
+// kernel gets the label <label>@kernel.
+
+const (
+	// pipelineMaxOps bounds the size of the unrolled loop body.
+	pipelineMaxOps = 64
+	// pipelineMaxUnroll is the largest accepted unroll factor.
+	pipelineMaxUnroll = 8
+	// kernelSuffix is appended to the loop label to name the kernel.
+	kernelSuffix = "@kernel"
+)
+
+// PipelineStats reports the schedule found for one loop.
+type PipelineStats struct {
+	Line     int
+	Label    string
+	Unroll   int
+	Ops      int // Operations per kernel iteration, after unrolling
+	II       int // Initiation interval: issue cycles per kernel iteration
+	Stages   int
+	Prologue int // Issue cycles before the kernel
+	Epilogue int // Issue cycles after the kernel
+}
+
+func (s PipelineStats) String() string {
+	return fmt.Sprintf("line %d: loop %s unrolled x%d, %d operations in %d cycles per kernel iteration (was %d), %d stage(s), prologue %d, epilogue %d cycles",
+		s.Line, s.Label, s.Unroll, s.Ops, s.II, s.Ops, s.Stages, s.Prologue, s.Epilogue)
+}
+
+// loopOp is one operation of a loop body.
+type loopOp struct {
+	slot   bundleSlot
+	lat    int
+	branch bool // the loop-closing branch
+	slice  bool // the branch or an operation it depends on, kept in stage 0
+}
+
+// depEdge requires t(to) + II*dist - t(from) >= delay.
+type depEdge struct {
+	from, to, delay, dist int
+}
+
+// opLatency is the number of cycles after which the result of an operation
+// can be used by another one.
+func opLatency(desc *InstrDesc) int {
+	if desc.Cycles < 1 {
+		return 1
+	}
+	return desc.Cycles
+}
+
+// isLoad reports whether a memory operation only reads memory.
+func isLoad(desc *InstrDesc) bool {
+	switch desc.Mnemonic {
+	case "LD", "VLD", "FLD", "LEA":
+		return true
+	}
+	return false
+}
+
+// loopOptions are the arguments of a pipeline marker.
+type loopOptions struct {
+	minTrips int
+	unroll   int
+	noAlias  bool
+}
+
+// pipelineOptions reads the min=, unroll= and noalias arguments of a
+// pipeline marker.
+func pipelineOptions(p pragma) (opts loopOptions, err error) {
+	opts.unroll = 1
+	for _, a := range p.Args {
+		if strings.EqualFold(a, "noalias") {
+			opts.noAlias = true
+			continue
+		}
+		key, val, ok := strings.Cut(a, "=")
+		n, convErr := strconv.Atoi(strings.TrimSpace(val))
+		if !ok || convErr != nil || n < 1 {
+			return opts, fmt.Errorf("@pipeline at line %d: expected min=<trips>, unroll=<factor> or noalias, got %q", p.Line, a)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "min":
+			opts.minTrips = n
+		case "unroll":
+			if n > pipelineMaxUnroll {
+				return opts, fmt.Errorf("@pipeline at line %d: unroll factor %d exceeds %d", p.Line, n, pipelineMaxUnroll)
+			}
+			opts.unroll = n
+		default:
+			return opts, fmt.Errorf("@pipeline at line %d: unknown option %q", p.Line, key)
+		}
+	}
+	if opts.minTrips != 0 && opts.minTrips < opts.unroll {
+		return opts, fmt.Errorf("@pipeline at line %d: min=%d is smaller than unroll=%d", p.Line, opts.minTrips, opts.unroll)
+	}
+	return opts, nil
+}
+
+// pipelineLoops returns a copy of ast in which every marked loop is replaced
+// by its software-pipelined form. The result of every loop is recorded in
+// cg.Pipelines.
+func (cg *CodeGenerator) pipelineLoops(ast *AST) (*AST, error) {
+	cg.Pipelines = nil
+	out := &AST{Program: &ProgramNode{}}
+	lines := ast.Program.Lines
+	var marker *pragma
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		p, isPragma := parsePragma(line)
+		if isPragma && p.Name == "pipeline" {
+			if marker != nil {
+				return nil, fmt.Errorf("@pipeline at line %d is not followed by a loop label", marker.Line)
+			}
+			marker = &p
+			if line.Label == nil {
+				out.Program.Lines = append(out.Program.Lines, line)
+				continue
+			}
+		}
+		if marker == nil {
+			out.Program.Lines = append(out.Program.Lines, line)
+			continue
+		}
+		if line.Label == nil {
+			if line.Statement == nil && !isPragma {
+				out.Program.Lines = append(out.Program.Lines, line) // comment between marker and label
+				continue
+			}
+			return nil, fmt.Errorf("@pipeline at line %d is not followed by a loop label", marker.Line)
+		}
+		loop, end, err := cg.pipelineLoop(lines, i, *marker)
+		if err != nil {
+			return nil, err
+		}
+		out.Program.Lines = append(out.Program.Lines, loop...)
+		marker = nil
+		i = end
+	}
+	if marker != nil {
+		return nil, fmt.Errorf("@pipeline at line %d is not followed by a loop label", marker.Line)
+	}
+	return out, nil
+}
+
+// pipelineLoop schedules the loop whose label is on lines[start]. It returns
+// the replacement lines and the index of the loop's closing branch.
+func (cg *CodeGenerator) pipelineLoop(lines []*LineNode, start int, marker pragma) ([]*LineNode, int, error) {
+	label := lines[start].Label.Name
+	opts, err := pipelineOptions(marker)
+	if err != nil {
+		return nil, 0, err
+	}
+	where := fmt.Sprintf("pipelined loop %s at line %d", label, lines[start].Line)
+	var body []loopOp
+	end := -1
+	for i := start + 1; i < len(lines) && end < 0; i++ {
+		line := lines[i]
+		if line.Label != nil {
+			return nil, 0, fmt.Errorf("%s: label %s at line %d inside the loop body, the body must be a single block", where, line.Label.Name, line.Line)
+		}
+		if line.Statement == nil {
+			continue
+		}
+		instr, ok := line.Statement.(*InstructionNode)
+		if !ok {
+			return nil, 0, fmt.Errorf("%s: line %d is not a plain instruction, the body may not contain directives or bundles", where, line.Line)
+		}
+		desc, known := LookupInstr(instr.Mnemonic)
+		if !known || len(instr.Operands) != len(desc.Operands) {
+			return nil, 0, fmt.Errorf("%s: cannot schedule %s at line %d", where, instr.Mnemonic, line.Line)
+		}
+		reads, writes := registerEffects(instr, desc)
+		op := loopOp{slot: bundleSlot{instr: instr, desc: desc, reads: reads, writes: writes}, lat: opLatency(desc)}
+		if isControlOp(desc, writes) {
+			var target *IdentifierNode
+			if _, cond := invertedBranch[desc.Mnemonic]; cond {
+				target, _ = instr.Operands[len(instr.Operands)-1].(*IdentifierNode)
+			}
+			if target == nil || target.Name != label {
+				return nil, 0, fmt.Errorf("%s: %s at line %d changes control flow, only the closing branch back to %s may", where, desc.Mnemonic, line.Line, label)
+			}
+			op.branch = true
+			end = i
+		}
+		body = append(body, op)
+	}
+	if end < 0 {
+		return nil, 0, fmt.Errorf("%s: no conditional branch back to %s closes the loop", where, label)
+	}
+	if len(body)*opts.unroll > pipelineMaxOps {
+		return nil, 0, fmt.Errorf("%s: %d operations after unrolling, at most %d can be scheduled", where, len(body)*opts.unroll, pipelineMaxOps)
+	}
+
+	ops := unrollBody(body, opts.unroll)
+	markBranchSlice(ops)
+	edges := loopDependencies(ops, opts.noAlias)
+	maxStages := 1
+	if opts.minTrips > 0 {
+		maxStages = opts.minTrips / opts.unroll
+	}
+	times, ii := moduloSchedule(ops, edges, maxStages)
+	if times == nil {
+		return nil, 0, fmt.Errorf("%s: no schedule found", where)
+	}
+
+	stages := 0
+	for _, t := range times {
+		if s := t/ii + 1; s > stages {
+			stages = s
+		}
+	}
+	kernelLabel := label
+	out := []*LineNode{lines[start]}
+	var prologue, kernel, epilogue [][]int
+	for k := 0; k < stages-1; k++ {
+		prologue = append(prologue, scheduleRows(ops, times, ii, func(op, stage int) bool { return stage <= k && !ops[op].branch })...)
+	}
+	kernel = scheduleRows(ops, times, ii, func(int, int) bool { return true })
+	for k := 1; k < stages; k++ {
+		epilogue = append(epilogue, scheduleRows(ops, times, ii, func(_, stage int) bool { return stage >= k })...)
+	}
+	for len(epilogue) > 0 && len(epilogue[len(epilogue)-1]) == 0 {
+		epilogue = epilogue[:len(epilogue)-1]
+	}
+	if stages > 1 {
+		kernelLabel = label + kernelSuffix
+	}
+	emit := func(rows [][]int) error {
+		for _, row := range rows {
+			l, err := rowLine(ops, row, lines[start].Line, kernelLabel)
+			if err != nil {
+				return fmt.Errorf("%s: %v", where, err)
+			}
+			out = append(out, l)
+		}
+		return nil
+	}
+	if err := emit(prologue); err != nil {
+		return nil, 0, err
+	}
+	if stages > 1 {
+		out = append(out, &LineNode{Label: &LabelNode{Name: kernelLabel, Line: lines[start].Line}, Line: lines[start].Line})
+	}
+	if err := emit(kernel); err != nil {
+		return nil, 0, err
+	}
+	if err := emit(epilogue); err != nil {
+		return nil, 0, err
+	}
+	cg.Pipelines = append(cg.Pipelines, PipelineStats{
+		Line: lines[start].Line, Label: label, Unroll: opts.unroll, Ops: len(ops),
+		II: ii, Stages: stages, Prologue: len(prologue), Epilogue: len(epilogue),
+	})
+	return out, end, nil
+}
+
+// unrollBody repeats the body k times. Only the last copy keeps the branch.
+func unrollBody(body []loopOp, k int) []loopOp {
+	var ops []loopOp
+	for c := 0; c < k; c++ {
+		for _, op := range body {
+			if op.branch && c < k-1 {
+				continue
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// markBranchSlice marks the branch and, transitively, the operations of the
+// same iteration that produce a register it reads.
+func markBranchSlice(ops []loopOp) {
+	b := len(ops) - 1
+	ops[b].slice = true
+	for i := b; i >= 0; i-- {
+		if !ops[i].slice {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if overlaps(ops[i].slot.reads, ops[j].slot.writes) {
+				ops[j].slice = true
+			}
+		}
+	}
+}
+
+// dependencyDelay returns the minimum distance in cycles between an earlier
+// instance of a and a later instance of b, and whether they depend at all.
+// With noAlias only stores are ordered among themselves.
+func dependencyDelay(a, b loopOp, noAlias bool) (int, bool) {
+	delay, dep := 0, false
+	if overlaps(b.slot.reads, a.slot.writes) { // read after write
+		delay, dep = max(delay, a.lat), true
+	}
+	if overlaps(b.slot.writes, a.slot.reads) { // write after read: same bundle is fine
+		dep = true
+	}
+	if overlaps(b.slot.writes, a.slot.writes) { // write after write
+		delay, dep = max(delay, a.lat-b.lat+1, 1), true
+	}
+	if isMemoryOp(a.slot.desc) && isMemoryOp(b.slot.desc) && !isLoad(a.slot.desc) && !isLoad(b.slot.desc) ||
+		!noAlias && isMemoryOp(a.slot.desc) && isMemoryOp(b.slot.desc) && !(isLoad(a.slot.desc) && isLoad(b.slot.desc)) {
+		delay, dep = max(delay, 1), true
+	}
+	return delay, dep
+}
+
+// loopDependencies builds the dependence edges within an iteration
+// (distance 0) and to the next iteration (distance 1). Longer distances
+// follow from these through the self dependencies of every writer.
+func loopDependencies(ops []loopOp, noAlias bool) []depEdge {
+	var edges []depEdge
+	for a := range ops {
+		for b := range ops {
+			d, ok := dependencyDelay(ops[a], ops[b], noAlias)
+			if !ok {
+				continue
+			}
+			if a < b {
+				edges = append(edges, depEdge{a, b, d, 0})
+			}
+			edges = append(edges, depEdge{a, b, d, 1})
+		}
+	}
+	return edges
+}
+
+// rowUse counts the units used in one cycle of the kernel.
+type rowUse struct {
+	ops, mem, ctrl, ucode int
+}
+
+func (u *rowUse) fits(op loopOp) bool {
+	return u.ops < VLIWSlots &&
+		(u.mem == 0 || !isMemoryOp(op.slot.desc)) &&
+		(u.ctrl == 0 || !isControlOp(op.slot.desc, op.slot.writes)) &&
+		(u.ucode == 0 || op.slot.desc.Type != OpTypeUCODE)
+}
+
+func (u *rowUse) add(op loopOp) {
+	u.ops++
+	if isMemoryOp(op.slot.desc) {
+		u.mem++
+	}
+	if isControlOp(op.slot.desc, op.slot.writes) {
+		u.ctrl++
+	}
+	if op.slot.desc.Type == OpTypeUCODE {
+		u.ucode++
+	}
+}
+
+// moduloSchedule finds the smallest initiation interval for which every
+// operation can be placed with at most maxStages stages. It returns the
+// start cycle of every operation and the interval.
+func moduloSchedule(ops []loopOp, edges []depEdge, maxStages int) ([]int, int) {
+	mem, ucode, limit := 0, 0, 0
+	for _, op := range ops {
+		if isMemoryOp(op.slot.desc) {
+			mem++
+		}
+		if op.slot.desc.Type == OpTypeUCODE {
+			ucode++
+		}
+		limit += op.lat + 1
+	}
+	ii := max((len(ops)+VLIWSlots-1)/VLIWSlots, mem, ucode, 1)
+	for ; ii <= limit; ii++ {
+		if times := scheduleII(ops, edges, ii); times != nil {
+			stages := 0
+			for _, t := range times {
+				stages = max(stages, t/ii+1)
+			}
+			if stages <= maxStages {
+				return times, ii
+			}
+		}
+	}
+	return nil, 0
+}
+
+// scheduleII places the operations for one initiation interval, the branch
+// first in the last cycle of the kernel and the others in program order,
+// each in the earliest cycle its dependencies and the free units allow.
+func scheduleII(ops []loopOp, edges []depEdge, ii int) []int {
+	times := make([]int, len(ops))
+	for i := range times {
+		times[i] = -1
+	}
+	rows := make([]rowUse, ii)
+	place := func(op int) bool {
+		lo, hi := 0, int(^uint(0)>>1)
+		if ops[op].slice {
+			hi = ii - 1
+		}
+		for _, e := range edges {
+			switch {
+			case e.from == op && e.to == op:
+				if ii*e.dist < e.delay {
+					return false
+				}
+			case e.to == op && times[e.from] >= 0:
+				lo = max(lo, times[e.from]+e.delay-ii*e.dist)
+			case e.from == op && times[e.to] >= 0:
+				hi = min(hi, times[e.to]+ii*e.dist-e.delay)
+			}
+		}
+		if ops[op].branch {
+			lo = max(lo, ii-1)
+		}
+		for t := lo; t <= hi && t < lo+ii; t++ {
+			if rows[t%ii].fits(ops[op]) {
+				rows[t%ii].add(ops[op])
+				times[op] = t
+				return true
+			}
+		}
+		return false
+	}
+	branch := len(ops) - 1
+	if !place(branch) || times[branch] != ii-1 {
+		return nil
+	}
+	for op := 0; op < branch; op++ {
+		if !place(op) {
+			return nil
+		}
+	}
+	return times
+}
+
+// scheduleRows returns, for each cycle of one pass over the kernel, the
+// operations selected by include. Within a cycle, operations of older
+// iterations (later stages) come first and the branch last, so that every
+// slot reads its operands before a later slot overwrites them.
+func scheduleRows(ops []loopOp, times []int, ii int, include func(op, stage int) bool) [][]int {
+	rows := make([][]int, ii)
+	for op, t := range times {
+		if include(op, t/ii) {
+			rows[t%ii] = append(rows[t%ii], op)
+		}
+	}
+	for _, row := range rows {
+		sort.SliceStable(row, func(a, b int) bool {
+			oa, ob := row[a], row[b]
+			if ops[oa].branch != ops[ob].branch {
+				return ops[ob].branch
+			}
+			if sa, sb := times[oa]/ii, times[ob]/ii; sa != sb {
+				return sa > sb
+			}
+			return oa < ob
+		})
+	}
+	return rows
+}
+
+// rowLine builds the line for one cycle: a NOP, a plain instruction or a
+// bundle. The branch is retargeted to the kernel.
+func rowLine(ops []loopOp, row []int, line int, kernelLabel string) (*LineNode, error) {
+	if len(row) == 0 {
+		return &LineNode{Statement: &InstructionNode{Mnemonic: "NOP", Line: line}, Line: line}, nil
+	}
+	instrs := make([]*InstructionNode, len(row))
+	slots := make([]bundleSlot, len(row))
+	for i, op := range row {
+		instr := *ops[op].slot.instr
+		if ops[op].branch {
+			instr.Operands = append([]OperandNode(nil), instr.Operands...)
+			instr.Operands[len(instr.Operands)-1] = &IdentifierNode{Name: kernelLabel, Line: instr.Line}
+		}
+		instrs[i] = &instr
+		slots[i] = ops[op].slot
+	}
+	first := instrs[0]
+	if len(instrs) == 1 {
+		return &LineNode{Statement: first, Line: first.Line, Column: first.Column}, nil
+	}
+	vliw := &VLIWInstructionNode{Instructions: instrs, Line: first.Line, Column: first.Column}
+	if err := checkBundle(vliw, slots); err != nil {
+		return nil, fmt.Errorf("internal error: scheduled an illegal bundle: %v", err)
+	}
+	return &LineNode{Statement: vliw, Line: first.Line, Column: first.Column}, nil
+}
+
+// formatPipelines renders the pipelining results for verbose output and listings.
+func formatPipelines(stats []PipelineStats) string {
+	var sb strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&sb, "  %s\n", s)
+	}
+	return sb.String()
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// machine is a functional model of the few instructions the pipelining tests
+// use. A bundle reads all its operands before any slot writes a result.
+type machine struct {
+	regs map[string]int64
+	mem  map[int64]int64
+}
+
+// run executes the program assembled by cg from address 0 until HALT.
+func (m *machine) run(t *testing.T, cg *CodeGenerator) {
+	t.Helper()
+	entries := map[Addr]ListingLine{}
+	for _, l := range cg.Listing {
+		if len(l.Code) > 0 {
+			entries[l.Addr] = l
+		}
+	}
+	pc := Addr(0)
+	for steps := 0; steps < 10000; steps++ {
+		l, ok := entries[pc]
+		if !ok {
+			t.Fatalf("no instruction at %#x", pc)
+		}
+		next := pc + Addr(len(l.Code))
+		type write struct {
+			reg string
+			val int64
+		}
+		var writes []write
+		var stores [][2]int64
+		for _, w := range slotWords(l.Code) {
+			text, err := Disassemble(w)
+			if err != nil {
+				t.Fatalf("%#x: %v", pc, err)
+			}
+			mn, rest, _ := strings.Cut(text, " ")
+			var args []string
+			for _, a := range strings.Split(rest, ", ") {
+				args = append(args, strings.TrimSpace(a))
+			}
+			val := func(a string) int64 {
+				if n, err := strconv.ParseInt(a, 10, 64); err == nil {
+					return n
+				}
+				return m.regs[a]
+			}
+			addr := func(a string) int64 {
+				base, disp, ok := strings.Cut(strings.Trim(a, "[]"), "+")
+				if !ok {
+					return m.regs[base]
+				}
+				return m.regs[base] + val(disp)
+			}
+			switch mn {
+			case "NOP":
+			case "HALT":
+				return
+			case "LD":
+				writes = append(writes, write{args[0], m.mem[addr(args[1])]})
+			case "ST":
+				stores = append(stores, [2]int64{addr(args[1]), m.regs[args[0]]})
+			case "ADD":
+				writes = append(writes, write{args[0], val(args[1]) + val(args[2])})
+			case "SUB":
+				writes = append(writes, write{args[0], val(args[1]) - val(args[2])})
+			case "MUL":
+				writes = append(writes, write{args[0], val(args[1]) * val(args[2])})
+			case "BNE":
+				if val(args[0]) != val(args[1]) {
+					off, _ := strconv.Atoi(args[2])
+					next = pc + Addr(off*InstrSlotBytes)
+				}
+			default:
+				t.Fatalf("%#x: %s is not modelled", pc, text)
+			}
+		}
+		for _, w := range writes {
+			m.regs[w.reg] = w.val
+		}
+		for _, s := range stores {
+			m.mem[s[0]] = s[1]
+		}
+		pc = next
+	}
+	t.Fatalf("program did not halt")
+}
+
+// simulate assembles src and runs it with the given counter in T2 and an
+// array of 16 words at address 100.
+func simulate(t *testing.T, src string, trips int64) (*machine, *CodeGenerator) {
+	t.Helper()
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	m := &machine{regs: map[string]int64{"T0": 100, "T1": 200, "T2": trips}, mem: map[int64]int64{}}
+	for i := int64(0); i < 16; i++ {
+		m.mem[100+i] = 3*i + 1
+	}
+	m.run(t, cg)
+	return m, cg
+}
+
+func TestPipelineEquivalence(t *testing.T) {
+	copyLoop := `copy:
+        LD  T3, [T0]
+        ST  T3, [T1]
+        ADD T0, T0, 1
+        ADD T1, T1, 1
+        SUB T2, T2, 1
+        BNE T2, 0, copy
+        HALT
+`
+	sumLoop := `sum:
+        LD  T3, [T0]
+        MUL T4, T3, T3
+        ADD T5, T5, T4
+        ADD T0, T0, 1
+        SUB T2, T2, 1
+        BNE T2, 0, sum
+        HALT
+`
+	for _, c := range []struct {
+		name, marker, loop string
+		trips              int64
+		stages             int
+	}{
+		{"copy", ".PIPELINE", copyLoop, 5, 1},
+		{"copy unrolled", ".PIPELINE unroll=2", copyLoop, 8, 1},
+		{"copy unrolled noalias", ".PIPELINE min=4, unroll=2, noalias", copyLoop, 6, 0},
+		{"sum", ".PIPELINE min=4", sumLoop, 4, 2},
+		{"sum long", "; @pipeline min=2, noalias", sumLoop, 11, 2},
+		{"sum unrolled", ".PIPELINE min=6, unroll=3", sumLoop, 12, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			want, _ := simulate(t, c.loop, c.trips)
+			got, cg := simulate(t, c.marker+"\n"+c.loop, c.trips)
+			for _, r := range []string{"T0", "T1", "T2", "T5"} {
+				if got.regs[r] != want.regs[r] {
+					t.Errorf("%s = %d, want %d", r, got.regs[r], want.regs[r])
+				}
+			}
+			for a, v := range want.mem {
+				if got.mem[a] != v {
+					t.Errorf("mem[%d] = %d, want %d", a, got.mem[a], v)
+				}
+			}
+			if len(cg.Pipelines) != 1 {
+				t.Fatalf("got %d pipelined loops, want 1", len(cg.Pipelines))
+			}
+			s := cg.Pipelines[0]
+			if c.stages != 0 && s.Stages != c.stages {
+				t.Errorf("stages = %d, want %d (%s)", s.Stages, c.stages, s)
+			}
+			if s.II > s.Ops {
+				t.Errorf("II %d exceeds the %d operations of the loop", s.II, s.Ops)
+			}
+			if _, ok := cg.SymbolTable.Lookup("copy" + kernelSuffix); ok != (s.Stages > 1 && s.Label == "copy") {
+				t.Errorf("kernel label defined = %v with %d stages", ok, s.Stages)
+			}
+		})
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	for _, c := range []struct{ src, wantErr string }{
+		{".PIPELINE\nl:\n ADD T0, T0, 1\nm:\n SUB T2, T2, 1\n BNE T2, 0, l\n", "label m at line 4 inside the loop body"},
+		{".PIPELINE\nl:\n ADD T0, T0, 1\n JMP l\n", "JMP at line 4 changes control flow"},
+		{".PIPELINE\nl:\n SUB T2, T2, 1\n BNE T2, 0, other\nother:\n HALT\n", "BNE at line 4 changes control flow"},
+		{".PIPELINE\nl:\n ADD T0, T0, 1\n HALT\n", "HALT at line 4 changes control flow"},
+		{".PIPELINE\nl:\n ADD T0, T0, 1\n", "no conditional branch back to l closes the loop"},
+		{".PIPELINE\nl:\n [ADD T0, T0, 1] [SUB T2, T2, 1]\n BNE T2, 0, l\n", "line 3 is not a plain instruction"},
+		{".PIPELINE speed=2\nl:\n SUB T2, T2, 1\n BNE T2, 0, l\n", `unknown option "speed"`},
+		{".PIPELINE unroll=0\nl:\n SUB T2, T2, 1\n BNE T2, 0, l\n", `expected min=<trips>, unroll=<factor> or noalias, got "unroll=0"`},
+		{".PIPELINE unroll=9\nl:\n SUB T2, T2, 1\n BNE T2, 0, l\n", "unroll factor 9 exceeds 8"},
+		{".PIPELINE min=2, unroll=4\nl:\n SUB T2, T2, 1\n BNE T2, 0, l\n", "min=2 is smaller than unroll=4"},
+		{".PIPELINE\n ADD T0, T0, 1\n", "@pipeline at line 1 is not followed by a loop label"},
+		{"NOP\n.PIPELINE\n", "@pipeline at line 2 is not followed by a loop label"},
+	} {
+		_, err := assembleSource(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
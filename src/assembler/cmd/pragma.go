@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"strings"
+)
+
+// Pragmas are assembler hints written as a comment, so they need no grammar
+// support and other tools read them as ordinary comments:
+//
+//	[ADD T0, T1, T2] [LD T3, [TB]]   ; @par serial, auto
+//
+// A pragma comment starts with "@" and the name of a known pragma, followed
+// by a comma-separated argument list. Any other comment, including one whose
+// first word merely starts with "@", is an ordinary comment.
+type pragma struct {
+	Name string
+	Args []string
+	Line int
+}
+
+// knownPragmas lists the pragma names the assembler understands.
+var knownPragmas = map[string]bool{
+	"par":       true,
+	"autopack":  true,
+	"endpack":   true,
+	"pipeline":  true,
+	"loopbound": true,
+	"cycles":    true,
+	"fill":      true,
+}
+
+// pragmaDirectives are directives the grammar does not know which the
+// assembler implements as pragmas. rewritePragmaDirectives turns them into
+// pragma comments before parsing, keeping line numbers unchanged.
+var pragmaDirectives = map[string]string{
+	".AUTOPACK":  "autopack",
+	".ENDPACK":   "endpack",
+	".PIPELINE":  "pipeline",
+	".LOOPBOUND": "loopbound",
+	".FILL":      "fill",
+}
+
+// rewritePragmaDirectives replaces every line that starts with a pragma
+// directive by the equivalent pragma comment.
+func rewritePragmaDirectives(src string) string {
+	lines := strings.Split(src, "\n")
+	for i, l := range lines {
+		fields := strings.Fields(strings.SplitN(l, ";", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		name, ok := pragmaDirectives[strings.ToUpper(fields[0])]
+		if !ok {
+			continue
+		}
+		text := "; @" + name
+		if len(fields) > 1 {
+			text += " " + strings.Join(fields[1:], " ")
+		}
+		if strings.HasSuffix(l, "\r") {
+			text += "\r"
+		}
+		lines[i] = text
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parsePragma extracts the pragma of a line comment. ok is false for an
+// ordinary comment, which includes one naming an unknown pragma.
+func parsePragma(line *LineNode) (p pragma, ok bool) {
+	text := strings.TrimSpace(strings.TrimPrefix(line.Comment, ";"))
+	if !strings.HasPrefix(text, "@") {
+		return pragma{}, false
+	}
+	name, rest, _ := strings.Cut(text[1:], " ")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !knownPragmas[name] {
+		return pragma{}, false
+	}
+	p = pragma{Name: name, Line: line.Line}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		for _, a := range strings.Split(rest, ",") {
+			p.Args = append(p.Args, strings.TrimSpace(a))
+		}
+	}
+	return p, true
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kvany/vtx1/assembler/pkg/ternary"
+)
+
+// valueRange is the set of values an encoding field or data unit accepts.
+type valueRange struct {
+	Min, Max int64
+	Desc     string
+}
+
+func (r valueRange) contains(v int64) bool { return v >= r.Min && v <= r.Max }
+
+// Ranges of the instruction fields (binary, two's complement) and of the
+// data units and addresses (balanced ternary words). Data units accept both
+// the signed and the unsigned reading of their bits.
+var (
+	imm11Range      = valueRange{-1 << 10, 1<<10 - 1, "11-bit signed immediate"}
+	memDispRange    = valueRange{memDispMin, memDispMax, "10-bit signed displacement"}
+	memAbsRange     = valueRange{0, memAbsMax, "absolute address field"}
+	ctrlOffsetRange = valueRange{ctrlOffsetMin, ctrlOffsetMax, "11-bit signed slot offset"}
+	cmpImmRange     = valueRange{cmpImmMin, cmpImmMax, "3-bit signed comparand"}
+	shiftRange      = valueRange{0, ternary.WordTrits - 1, "shift count of an 18-trit word"}
+	byteRange       = valueRange{-1 << 7, 1<<8 - 1, "8-bit .DB unit"}
+	halfRange       = valueRange{-1 << 15, 1<<16 - 1, "16-bit .DW unit"}
+	wordRange       = valueRange{-ternary.WordMax, ternary.WordMax, "18-trit word"}
+	addrRange       = valueRange{0, ternary.WordMax, "18-trit address space"}
+	alignRange      = valueRange{1, ternary.WordMax, ".ALIGN boundary"}
+)
+
+// checkRange reports an error naming the value, the allowed range and the
+// source position when v does not fit r. what describes the operand, for
+// example "LD offset" or ".DB value".
+func checkRange(what string, op OperandNode, v int64, r valueRange, line int) error {
+	if r.contains(v) {
+		return nil
+	}
+	return fmt.Errorf("%s %s is out of range for the %s (%d..%d) at %s", what, valueText(op, v), r.Desc, r.Min, r.Max, sourcePos(op, line))
+}
+
+// valueText renders v for diagnostics, keeping the literal as written when it
+// was not decimal, e.g. "0t+--0 (15)" or "0x1000 (4096)".
+func valueText(op OperandNode, v int64) string {
+	switch n := op.(type) {
+	case *ImmediateNode:
+		lit := strings.ToLower(n.Value)
+		if strings.HasPrefix(lit, "0x") || strings.HasPrefix(lit, "0b") || strings.HasPrefix(lit, "0t") {
+			return fmt.Sprintf("%s (%d)", n.Value, v)
+		}
+	case *IdentifierNode:
+		return fmt.Sprintf("%s = %d", n.Name, v)
+	case *ExprNode:
+		return fmt.Sprintf("%s = %d", n.Text, v)
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+// operandText returns an address operand as written.
+func operandText(op OperandNode) string {
+	switch n := op.(type) {
+	case *ImmediateNode:
+		return n.Value
+	case *IdentifierNode:
+		return n.Name
+	case *ExprNode:
+		return n.Text
+	}
+	return "?"
+}
+
+// sourcePos formats the position of op, falling back to the statement line.
+func sourcePos(op OperandNode, line int) string {
+	l, c := 0, 0
+	switch n := op.(type) {
+	case *ImmediateNode:
+		l, c = n.Line, n.Column
+	case *IdentifierNode:
+		l, c = n.Line, n.Column
+	case *ExprNode:
+		l, c = n.Line, n.Column
+	case *MemoryOperandNode:
+		l, c = n.Line, n.Column
+	case *RegisterNode:
+		l, c = n.Line, n.Column
+	}
+	if l == 0 {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("line %d, column %d", l, c+1)
+}
+
+// operandValue evaluates an immediate or symbol operand.
+func (cg *CodeGenerator) operandValue(op OperandNode, line int) (int64, error) {
+	switch v := op.(type) {
+	case *ImmediateNode:
+		n, err := parseImmediateOperand(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %s at %s", v.Value, sourcePos(op, line))
+		}
+		return n, nil
+	case *IdentifierNode:
+		if n, ok := cg.symbolValue(v.Name); ok {
+			return n, nil
+		}
+		return 0, fmt.Errorf("undefined symbol %s at %s", v.Name, sourcePos(op, line))
+	case *ExprNode:
+		e, err := v.parsed()
+		if err != nil {
+			return 0, err
+		}
+		n, err := cg.fold(v, e, line)
+		if err != nil {
+			return 0, fmt.Errorf("%v in %s at %s", err, v.Text, sourcePos(op, line))
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected a number or symbol at line %d", line)
+}
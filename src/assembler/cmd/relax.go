@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Branch relaxation.
+//
+// A jump or branch whose target lies outside the reach of its offset field is
+// rewritten into a long form that loads the target address into TC from a
+// literal word placed directly after the instruction:
+//
+//	JMP far          ->  LD TC, [TC+4]
+//	                     .word far
+//
+//	BEQ T1, T2, far  ->  BNE T1, T2, +3   ; skip the long jump
+//	                     LD TC, [TC+4]
+//	                     .word far
+//
+// A memory access to a label or address outside the reach of both the
+// PC-relative displacement and the absolute address field (0..1023) is
+// rewritten the same way into a far access, which loads the address from a
+// literal into a T register and jumps over the literal. Loads and LEA use
+// their own destination; the other accesses borrow a T register
+// on the stack and end with a NOP, so the restored register is ready for the
+// next instruction:
+//
+//	LD  T1, far      ->  LD T1, [TC+8]
+//	                     JMP +2
+//	                     .word far
+//	                     LD T1, [T1]
+//
+//	ST  T2, far      ->  PUSH T0
+//	                     LD T0, [TC+8]
+//	                     JMP +2
+//	                     .word far
+//	                     ST T2, [T0]
+//	                     POP T0
+//	                     NOP
+//
+// Relaxing an instruction moves everything after it, which can push other
+// branches and accesses out of range, so layout is repeated until nothing new
+// needs relaxing. Instructions only ever grow, which guarantees termination.
+
+// maxRelaxPasses bounds the layout iteration; every pass relaxes at least one
+// more instruction, so this is only reached on very large inputs.
+const maxRelaxPasses = 64
+
+// longJumpSlots is the size of the LD TC + literal sequence in slots.
+const longJumpSlots = 2
+
+// invertedBranch maps each conditional branch to the branch with the opposite condition.
+var invertedBranch = map[string]string{
+	"BEQ":  "BNE",
+	"BNE":  "BEQ",
+	"BLT":  "BGE",
+	"BGE":  "BLT",
+	"BLTU": "BGEU",
+	"BGEU": "BLTU",
+	"BGT":  "BLE",
+	"BLE":  "BGT",
+}
+
+// Relaxation records one branch or memory access that was emitted in its
+// long form.
+type Relaxation struct {
+	Line     int
+	Addr     Addr
+	Mnemonic string
+	Target   Addr
+	Offset   int64 // Distance in slots, or in addresses for a far access, that did not fit the short form
+	Slots    int   // Size of the long form in slots
+	Far      bool  // A memory access rather than a branch
+}
+
+func (r Relaxation) String() string {
+	if r.Far {
+		return fmt.Sprintf("line %d: %s at 0x%X to 0x%X (%+d addresses) relaxed to a %d-slot far access",
+			r.Line, r.Mnemonic, r.Addr, r.Target, r.Offset, r.Slots)
+	}
+	return fmt.Sprintf("line %d: %s at 0x%X to 0x%X (%+d slots) relaxed to a %d-slot long branch",
+		r.Line, r.Mnemonic, r.Addr, r.Target, r.Offset, r.Slots)
+}
+
+// isRelaxable reports whether instr may be rewritten into a long branch or a
+// far access.
+func isRelaxable(instr *InstructionNode) bool {
+	m := strings.ToUpper(instr.Mnemonic)
+	_, cond := invertedBranch[m]
+	return cond || m == "JMP" || isFarCandidate(instr)
+}
+
+// isFarCandidate reports whether instr is a memory access to a label or
+// address whose data register allows a far access. Special data registers
+// are left to the encoder to diagnose.
+func isFarCandidate(instr *InstructionNode) bool {
+	desc, ok := LookupInstr(instr.Mnemonic)
+	if !ok || len(desc.Operands) != 2 || desc.Operands[1].Kind != KindMem || len(instr.Operands) != 2 {
+		return false
+	}
+	if _, isMem := instr.Operands[1].(*MemoryOperandNode); isMem {
+		return false
+	}
+	reg, ok := instr.Operands[0].(*RegisterNode)
+	if !ok {
+		return false
+	}
+	kind, code, ok := registerClass(reg.Name)
+	return ok && (kind != KindGPR || code < RegSpecial)
+}
+
+// relaxFits reports whether the short form of a relaxable instruction at
+// addr reaches its target.
+func (cg *CodeGenerator) relaxFits(instr *InstructionNode, addr Addr) bool {
+	if isFarCandidate(instr) {
+		return cg.memFits(instr, addr)
+	}
+	return cg.branchFits(instr, addr)
+}
+
+// memFits reports whether a memory access at addr reaches its address, either
+// through the PC-relative displacement or the absolute address field. Addresses that cannot be evaluated or are out of
+// the address space are left for the encoder to diagnose.
+func (cg *CodeGenerator) memFits(instr *InstructionNode, addr Addr) bool {
+	v, err := cg.operandValue(instr.Operands[1], instr.Line)
+	if err != nil || !addrRange.contains(v) {
+		return true
+	}
+	return memAbsRange.contains(v) || memDispRange.contains(v-int64(addr))
+}
+
+// instrSize returns the number of addresses a single instruction occupies in
+// the current layout.
+func (cg *CodeGenerator) instrSize(instr *InstructionNode) Addr {
+	if !cg.relaxed[instr] {
+		return cg.AddrUnit.slotSize()
+	}
+	if isFarCandidate(instr) {
+		return Addr(len(cg.farSteps(instr, 0))) * cg.AddrUnit.slotSize()
+	}
+	if strings.EqualFold(instr.Mnemonic, "JMP") {
+		return longJumpSlots * cg.AddrUnit.slotSize()
+	}
+	return (1 + longJumpSlots) * cg.AddrUnit.slotSize()
+}
+
+// branchFits reports whether the short form of a branch at addr reaches its
+// target. Branches whose target cannot be resolved or is misaligned are left
+// for the encoder to diagnose.
+func (cg *CodeGenerator) branchFits(instr *InstructionNode, addr Addr) bool {
+	desc, ok := LookupInstr(instr.Mnemonic)
+	if !ok || len(instr.Operands) != len(desc.Operands) {
+		return true
+	}
+	target, ok := cg.targetAddr(instr.Operands[len(instr.Operands)-1])
+	if !ok {
+		return true
+	}
+	delta := target - addr
+	if delta%cg.AddrUnit.slotSize() != 0 {
+		return true
+	}
+	return ctrlOffsetRange.contains(int64(delta / cg.AddrUnit.slotSize()))
+}
+
+// targetAddr resolves a label or numeric jump target.
+func (cg *CodeGenerator) targetAddr(op OperandNode) (Addr, bool) {
+	switch v := op.(type) {
+	case *IdentifierNode:
+		cg.reference(v.Name)
+		if a, ok := cg.Labels[v.Name]; ok {
+			return a, true
+		}
+		a, ok := cg.Equs[v.Name]
+		return Addr(a), ok
+	case *ImmediateNode:
+		return cg.resolveOperandAddr(v), true
+	case *ExprNode:
+		a, err := cg.operandValue(v, v.Line)
+		return Addr(a), err == nil
+	}
+	return 0, false
+}
+
+// emitLongBranch emits the relaxed form of a jump or conditional branch.
+func (cg *CodeGenerator) emitLongBranch(instr *InstructionNode) error {
+	start := cg.CurrentAddr
+	mnemonic := strings.ToUpper(instr.Mnemonic)
+	target, ok := cg.targetAddr(instr.Operands[len(instr.Operands)-1])
+	if !ok {
+		return fmt.Errorf("%s: undefined branch target at line %d", mnemonic, instr.Line)
+	}
+	slots := longJumpSlots
+	if inv, cond := invertedBranch[mnemonic]; cond {
+		skip := &InstructionNode{
+			Mnemonic: inv,
+			Operands: []OperandNode{
+				instr.Operands[0],
+				instr.Operands[1],
+				&ImmediateNode{Value: strconv.FormatInt(int64(start+(1+longJumpSlots)*cg.AddrUnit.slotSize()), 10)},
+			},
+			Line:   instr.Line,
+			Column: instr.Column,
+		}
+		w, _, err := cg.encodeInstruction(skip)
+		if err != nil {
+			return err
+		}
+		cg.appendSlot(w)
+		slots++
+	}
+	jump, _, err := cg.encodeInstruction(&InstructionNode{
+		Mnemonic: "LD",
+		Operands: []OperandNode{
+			&RegisterNode{Name: "TC"},
+			&ImmediateNode{Value: strconv.FormatInt(int64(cg.CurrentAddr+cg.AddrUnit.slotSize()), 10)},
+		},
+		Line:   instr.Line,
+		Column: instr.Column,
+	})
+	if err != nil {
+		return err
+	}
+	cg.appendSlot(jump)
+	cg.appendLiteral(target)
+
+	cg.Relaxations = append(cg.Relaxations, Relaxation{
+		Line:     instr.Line,
+		Addr:     start,
+		Mnemonic: mnemonic,
+		Target:   target,
+		Offset:   int64((target - start) / cg.AddrUnit.slotSize()),
+		Slots:    slots,
+	})
+	return nil
+}
+
+// farSteps returns the far form of a memory access at start, one instruction
+// per slot; the nil entry is the literal word holding the address.
+func (cg *CodeGenerator) farSteps(instr *InstructionNode, start Addr) []*InstructionNode {
+	slot := cg.AddrUnit.slotSize()
+	at := func(n int) OperandNode {
+		return &ImmediateNode{Value: strconv.FormatInt(int64(start+Addr(n)*slot), 10)}
+	}
+	step := func(mnemonic string, ops ...OperandNode) *InstructionNode {
+		return &InstructionNode{Mnemonic: mnemonic, Operands: ops, Line: instr.Line, Column: instr.Column}
+	}
+	data := instr.Operands[0].(*RegisterNode)
+	mnemonic := strings.ToUpper(instr.Mnemonic)
+	if kind, _, _ := registerClass(data.Name); kind == KindGPR && (mnemonic == "LD" || mnemonic == "LEA") {
+		steps := []*InstructionNode{step("LD", data, at(2)), step("JMP", at(3)), nil}
+		if mnemonic == "LD" {
+			steps = append(steps, step("LD", data, &MemoryOperandNode{Base: data.Name}))
+		}
+		return steps
+	}
+	scratch := &RegisterNode{Name: "T0"}
+	if strings.EqualFold(data.Name, "T0") {
+		scratch = &RegisterNode{Name: "T1"}
+	}
+	return []*InstructionNode{
+		step("PUSH", scratch),
+		step("LD", scratch, at(3)),
+		step("JMP", at(4)),
+		nil,
+		step(mnemonic, data, &MemoryOperandNode{Base: scratch.Name}),
+		step("POP", scratch),
+		step("NOP"),
+	}
+}
+
+// emitFarAccess emits the far form of a memory access.
+func (cg *CodeGenerator) emitFarAccess(instr *InstructionNode) error {
+	start := cg.CurrentAddr
+	v, err := cg.operandValue(instr.Operands[1], instr.Line)
+	if err != nil {
+		return err
+	}
+	steps := cg.farSteps(instr, start)
+	for _, s := range steps {
+		if s == nil {
+			cg.appendLiteral(Addr(v))
+			continue
+		}
+		w, _, err := cg.encodeInstruction(s)
+		if err != nil {
+			return err
+		}
+		cg.appendSlot(w)
+	}
+	cg.Relaxations = append(cg.Relaxations, Relaxation{
+		Line:     instr.Line,
+		Addr:     start,
+		Mnemonic: strings.ToUpper(instr.Mnemonic),
+		Target:   Addr(v),
+		Offset:   v - int64(start),
+		Slots:    len(steps),
+		Far:      true,
+	})
+	return nil
+}
+
+// farCost returns the cycles the far form of a memory access takes.
+func (cg *CodeGenerator) farCost(instr *InstructionNode) int64 {
+	var n int64
+	for _, s := range cg.farSteps(instr, 0) {
+		if s == nil {
+			continue
+		}
+		if desc, ok := LookupInstr(s.Mnemonic); ok {
+			n += int64(opLatency(desc))
+		}
+	}
+	return n
+}
+
+// appendLiteral appends an address as a literal word. The long form loads
+// it as a 32-bit address, so the word image holds the same 32 bits as the
+// byte stream, like an instruction slot.
+func (cg *CodeGenerator) appendLiteral(v Addr) {
+	var lit [InstrSlotBytes]byte
+	binary.LittleEndian.PutUint32(lit[:], uint32(v))
+	cg.Memory.writeWord(lit[:], MachineWord(uint32(v)))
+	cg.CurrentAddr += cg.AddrUnit.slotSize()
+}
+
+// appendSlot appends one encoded instruction slot to the output.
+func (cg *CodeGenerator) appendSlot(w InstrWord) {
+	enc := w.Bytes()
+	cg.Memory.writeWord(enc[:], MachineWord(w.Pack()))
+	cg.CurrentAddr += cg.AddrUnit.slotSize()
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelaxOutOfRangeBranch(t *testing.T) {
+	src := `        BEQ T1, T2, far
+        JMP far
+        .SPACE 8192
+far:
+        NOP
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 2 {
+		t.Fatalf("got %d relaxations, want 2: %v", len(cg.Relaxations), cg.Relaxations)
+	}
+	far := cg.Labels["far"]
+	if far != 5*InstrSlotBytes+8192 {
+		t.Errorf("far = 0x%X, want 0x%X", far, 5*InstrSlotBytes+8192)
+	}
+	words := slotWords(cg.Output[:5*InstrSlotBytes])
+	if words[0].Opcode != 0x05 || words[0].Rs1 != 1 || words[0].Rs2 != 2 || words[0].Imm != 3 {
+		t.Errorf("inverted branch = %+v, want BNE T1, T2, +3", words[0])
+	}
+	for _, i := range []int{1, 3} {
+		w := words[i]
+		if w.Type != OpTypeMEM || w.Opcode != 0x00 || w.Rd != RegSpecial || w.Rs1 != RegSpecial || w.Imm != InstrSlotBytes {
+			t.Errorf("slot %d = %+v, want LD TC, [TC+4]", i, w)
+		}
+		if lit := binary.LittleEndian.Uint32(cg.Output[(i+1)*InstrSlotBytes:]); Addr(lit) != far {
+			t.Errorf("literal after slot %d = 0x%X, want 0x%X", i, lit, far)
+		}
+	}
+}
+
+func TestRelaxFarAccess(t *testing.T) {
+	src := `        LD T1, far
+        LEA T3, far
+        ST T0, far
+        .SPACE 1024
+far:    .DW 7
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 3 {
+		t.Fatalf("got %d relaxations, want 3: %v", len(cg.Relaxations), cg.Relaxations)
+	}
+	for i, slots := range []int{4, 3, 7} {
+		if r := cg.Relaxations[i]; !r.Far || r.Slots != slots {
+			t.Errorf("relaxation %d = %v, want a %d-slot far access", i, r, slots)
+		}
+	}
+	far := cg.Labels["far"]
+	if far != 14*InstrSlotBytes+1024 {
+		t.Errorf("far = 0x%X, want 0x%X", far, 14*InstrSlotBytes+1024)
+	}
+	var text []string
+	for i, w := range slotWords(cg.Output[:14*InstrSlotBytes]) {
+		if i == 2 || i == 6 || i == 10 {
+			if lit := binary.LittleEndian.Uint32(cg.Output[i*InstrSlotBytes:]); Addr(lit) != far {
+				t.Errorf("literal in slot %d = 0x%X, want 0x%X", i, lit, far)
+			}
+			// The 36-bit words hold the same address the load reads.
+			word := pack36BitWords(cg.Image[i : i+1])
+			if string(word[:InstrSlotBytes]) != string(cg.Output[i*InstrSlotBytes:(i+1)*InstrSlotBytes]) || word[4] != 0 {
+				t.Errorf("36-bit literal in slot %d = % X, want the bytes % X", i, word, cg.Output[i*InstrSlotBytes:(i+1)*InstrSlotBytes])
+			}
+			text = append(text, ".word")
+			continue
+		}
+		s, err := Disassemble(w)
+		if err != nil {
+			t.Fatalf("slot %d: %v", i, err)
+		}
+		text = append(text, s)
+	}
+	want := []string{
+		"LD T1, [TC+8]", "JMP +2", ".word", "LD T1, [T1]",
+		"LD T3, [TC+8]", "JMP +2", ".word",
+		"PUSH T1", "LD T1, [TC+8]", "JMP +2", ".word", "ST T0, [T1]", "POP T1", "NOP",
+	}
+	if strings.Join(text, "; ") != strings.Join(want, "; ") {
+		t.Errorf("far accesses =\n%s\nwant\n%s", strings.Join(text, "; "), strings.Join(want, "; "))
+	}
+
+	if _, err := assembleSource(t, "        LD TC, far\n        .SPACE 1024\nfar:    .DT 0\n"); err == nil || !strings.Contains(err.Error(), "out of range for the 10-bit signed displacement") {
+		t.Errorf("LD TC to a far address: error %v, want the displacement range", err)
+	}
+}
+
+func TestRelaxCascades(t *testing.T) {
+	// BEQ reaches next (1023 slots) until relaxing the JMP moves it one slot further.
+	src := `        BEQ T1, T2, next
+        .SPACE 4084
+        JMP far
+next:
+        NOP
+        .SPACE 8192
+far:
+        NOP
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 2 || cg.Relaxations[0].Mnemonic != "BEQ" {
+		t.Fatalf("got relaxations %v, want BEQ and JMP", cg.Relaxations)
+	}
+}
+
+func TestRelaxInRangeUnchanged(t *testing.T) {
+	cg, err := assembleSource(t, "loop:\n        BNE T1, T2, loop\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 0 || len(cg.Output) != InstrSlotBytes {
+		t.Errorf("in-range branch was relaxed: %v", cg.Relaxations)
+	}
+}
+
+func TestSmallConstantAddressUnchanged(t *testing.T) {
+	// Out of reach of TC, but within the absolute address field.
+	cg, err := assembleSource(t, "        .ORG 0x1000\n        LEA T0, 1\n        ST T0, 0x10\n        LD T1, 1023\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 0 {
+		t.Fatalf("small constant addresses were relaxed: %v", cg.Relaxations)
+	}
+	words := slotWords(cg.Output)
+	want := []string{"LEA T0, 1", "ST T0, 16", "LD T1, 1023"}
+	if len(words) != len(want) {
+		t.Fatalf("got %d slots, want %d", len(words), len(want))
+	}
+	for i, w := range words {
+		if s, err := Disassemble(w); err != nil || s != want[i] {
+			t.Errorf("slot %d = %q (%v), want %q", i, s, err, want[i])
+		}
+	}
+
+	cg, err = assembleSource(t, "        .ORG 0x1000\n        LEA T0, 1024\n")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(cg.Relaxations) != 1 {
+		t.Errorf("LEA of 1024 from 0x1000: relaxations %v, want a far access", cg.Relaxations)
+	}
+}
+
+func TestListingReportsRelaxation(t *testing.T) {
+	src := "        BLT T1, T2, far\n        .SPACE 8192\nfar:\n        HALT\n"
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	ctx := &CompilationContext{SourceFile: "test.asm", Listing: cg.Listing, Relaxations: cg.Relaxations}
+	path := filepath.Join(t.TempDir(), "out.lst")
+	if err := generateListing([]byte(src), ctx, path); err != nil {
+		t.Fatalf("generateListing: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := string(data)
+	for _, want := range []string{"BLT T1, T2, far", "Relaxation:", "BLT at 0x0 to 0x200C", "3-slot long branch"} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("listing does not contain %q:\n%s", want, listing)
+		}
+	}
+}
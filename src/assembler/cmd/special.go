@@ -0,0 +1,199 @@
+package cmd
+
+import "fmt"
+
+// Special register context encoding.
+//
+// A register field holding RegSpecial (111) selects a special register; the
+// 3-bit context selector that names it is stored in a part of the slot the
+// instruction does not otherwise use. Candidate places, in order:
+//
+//  1. register fields (Rd, Rs1, Rs2) that carry no operand,
+//  2. imm[2:0], imm[5:3] and imm[8:6] when the immediate field is unused
+//     (or, for indexed memory operands, only imm[10] is used).
+//
+// The n-th special register field takes the n-th place. When an instruction
+// names more special registers than there are places, they must all be the
+// same register (e.g. ADD TA, TA, 5) and share the first place.
+
+// ctxSlot is a place that can hold a context selector.
+type ctxSlot struct {
+	field Field // FieldRd, FieldRs1, FieldRs2 or FieldImm
+	shift uint  // bit position within the immediate for FieldImm
+}
+
+// immCtxShifts are the immediate bit positions used for context selectors.
+var immCtxShifts = [...]uint{0, 3, 6}
+
+// contextSlots returns the places available for context selectors in w.
+func contextSlots(desc *InstrDesc, w InstrWord) []ctxSlot {
+	var used [3]bool
+	immUsed := false
+	for _, op := range desc.Operands {
+		switch op.Kind {
+		case KindGPR, KindVec, KindFP:
+			used[op.Field] = true
+		case KindImm, KindTarget:
+			immUsed = true
+		case KindMem:
+			if desc.immForm(w) {
+				immUsed = true
+				break
+			}
+			used[FieldRs1] = true
+			if w.Imm&memIndexedBit != 0 {
+				used[FieldRs2] = true
+			} else {
+				immUsed = true
+			}
+		case KindCmp:
+			used[FieldRs2] = true
+		case KindSrc, KindShift:
+			if desc.immForm(w) {
+				immUsed = true
+			} else {
+				used[FieldRs2] = true
+			}
+		}
+	}
+	var slots []ctxSlot
+	for f := FieldRd; f <= FieldRs2; f++ {
+		if !used[f] {
+			slots = append(slots, ctxSlot{field: f})
+		}
+	}
+	if !immUsed {
+		for _, sh := range immCtxShifts {
+			slots = append(slots, ctxSlot{field: FieldImm, shift: sh})
+		}
+	}
+	return slots
+}
+
+// specialFields returns the register fields of w that select a special
+// register. The comparand of a branch is never a special register.
+func specialFields(desc *InstrDesc, w InstrWord) []Field {
+	var special [3]bool
+	for _, op := range desc.Operands {
+		switch op.Kind {
+		case KindGPR, KindSrc, KindShift:
+			if op.Kind != KindGPR && desc.immForm(w) {
+				continue
+			}
+			special[op.Field] = w.reg(op.Field) == RegSpecial
+		case KindMem:
+			special[FieldRs1] = !desc.immForm(w) && w.Rs1 == RegSpecial
+		}
+	}
+	var fields []Field
+	for f := FieldRd; f <= FieldRs2; f++ {
+		if special[f] {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// placeContexts stores the pending context selectors of w.
+func placeContexts(w *InstrWord, desc *InstrDesc) error {
+	pending := w.ctx
+	w.ctx = [3]uint8{}
+	var fields []Field
+	for f, c := range pending {
+		if c != 0 {
+			fields = append(fields, Field(f))
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	slots := contextSlots(desc, *w)
+	if len(fields) > len(slots) {
+		for _, f := range fields[1:] {
+			if pending[f] != pending[fields[0]] {
+				return fmt.Errorf("%s cannot name %d different special registers, only %d context selector(s) fit", desc.Mnemonic, len(fields), len(slots))
+			}
+		}
+		if len(slots) == 0 {
+			return fmt.Errorf("%s has no room for a special register context selector", desc.Mnemonic)
+		}
+		fields = fields[:1]
+	}
+	for i, f := range fields {
+		w.setCtx(slots[i], pending[f]-1)
+	}
+	return nil
+}
+
+// decodeContexts returns the context selector of every special register field.
+func decodeContexts(desc *InstrDesc, w InstrWord) map[Field]uint8 {
+	fields := specialFields(desc, w)
+	if len(fields) == 0 {
+		return nil
+	}
+	slots := contextSlots(desc, w)
+	ctx := make(map[Field]uint8, len(fields))
+	for i, f := range fields {
+		switch {
+		case i < len(slots) && len(fields) <= len(slots):
+			ctx[f] = w.getCtx(slots[i])
+		case len(slots) > 0:
+			ctx[f] = w.getCtx(slots[0])
+		}
+	}
+	return ctx
+}
+
+// checkSpecialWrite rejects destinations the hardware does not let an
+// instruction write.
+func checkSpecialWrite(desc *InstrDesc, name string, ctx uint8) error {
+	switch ctx {
+	case CtxTA, CtxTB:
+		return nil
+	case CtxTC:
+		if desc.Mnemonic == "LD" {
+			return nil // long jump: LD TC, [addr]
+		}
+		return fmt.Errorf("%s cannot write TC, the program counter is changed only by jumps, branches and LD TC", desc.Mnemonic)
+	case CtxTS:
+		return fmt.Errorf("%s cannot write TS, the status register is set by the hardware", desc.Mnemonic)
+	case CtxTI:
+		return fmt.Errorf("%s cannot write TI, the instruction register is read-only", desc.Mnemonic)
+	}
+	return fmt.Errorf("%s cannot write %s through a general register field, use a vector instruction", desc.Mnemonic, name)
+}
+
+func (w *InstrWord) setCtx(s ctxSlot, ctx uint8) {
+	if s.field == FieldImm {
+		w.Imm |= int32(ctx&regMask) << s.shift
+		return
+	}
+	switch s.field {
+	case FieldRd:
+		w.Rd = ctx
+	case FieldRs1:
+		w.Rs1 = ctx
+	case FieldRs2:
+		w.Rs2 = ctx
+	}
+}
+
+func (w InstrWord) getCtx(s ctxSlot) uint8 {
+	if s.field == FieldImm {
+		return uint8(uint32(w.Imm)>>s.shift) & regMask
+	}
+	return w.reg(s.field)
+}
+
+// reg returns the contents of a register field.
+func (w InstrWord) reg(f Field) uint8 {
+	switch f {
+	case FieldRd:
+		return w.Rd
+	case FieldRs1:
+		return w.Rs1
+	case FieldRs2:
+		return w.Rs2
+	}
+	return 0
+}
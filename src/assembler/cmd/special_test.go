@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpecialRegisterContexts(t *testing.T) {
+	src := `ADD TA, T1, T2
+ADD TA, TA, 5
+INC T0, TS
+LD TC, [T1+4]
+ADD T0, VA, T1
+ST TA, 0x10
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	want := []InstrWord{
+		// Rd=111, all register fields taken: selector in imm[2:0].
+		{Opcode: 0x01, Rd: RegSpecial, Rs1: 1, Rs2: 2, Imm: CtxTA, Type: OpTypeALU},
+		// Two TA references share the only free place.
+		{Opcode: 0x21, Rd: RegSpecial, Rs1: RegSpecial, Imm: 5, Type: OpTypeALU},
+		// Rs2 is unused by INC and holds the selector.
+		{Opcode: 0x0E, Rd: 0, Rs1: RegSpecial, Rs2: CtxTS, Type: OpTypeALU},
+		// The long-jump form: TC as the destination of LD.
+		{Opcode: 0x00, Rd: RegSpecial, Rs1: 1, Rs2: CtxTC, Imm: 4, Type: OpTypeMEM},
+		{Opcode: 0x01, Rd: 0, Rs1: RegSpecial, Rs2: 1, Imm: CtxVA, Type: OpTypeALU},
+		// An absolute address leaves Rs1 free for the selector.
+		{Opcode: 0x21, Rd: CtxTA, Rs2: RegSpecial, Imm: 0x10, Type: OpTypeMEM},
+	}
+	if len(words) != len(want) {
+		t.Fatalf("got %d slots, want %d", len(words), len(want))
+	}
+	for i, w := range want {
+		if words[i] != w {
+			t.Errorf("slot %d encoded as %+v, want %+v", i, words[i], w)
+		}
+	}
+
+	for _, c := range []struct{ src, wantErr string }{
+		{"ADD TC, T1, T2\n", "ADD cannot write TC"},
+		{"INC TS, T1\n", "INC cannot write TS"},
+		{"SUB TI, T1, T2\n", "SUB cannot write TI"},
+		{"NEG VA, T1\n", "NEG cannot write VA"},
+		{"LD TA, [TB+4]\n", "LD cannot name 2 different special registers"},
+		{"ADD TA, TB, 5\n", "ADD cannot name 2 different special registers"},
+		{".ORG 0x800\nLD TB, data\ndata: .DW 1\n", "LD TB, data: TB and the PC-relative address each need a special register context selector and only one fits, go through a T register (LEA T0, data then LD TB, [T0]) at line 2, column 8"},
+		{".ORG 0x800\nST TA, 0x810\n", "ST TA, 0x810: TA and the PC-relative address"},
+	} {
+		if _, err := assembleSource(t, c.src); err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	// Jump and branch targets are absolute in the source and disassemble as
+	// slot offsets from the instruction.
+	lines := []string{
+		"ADD T3, T1, T2",
+		"ADD TA, T1, T2",
+		"ADD TA, TA, 5",
+		"SUB T2, TB, TS",
+		"SHL T4, T4, 17",
+		"INC T0, TS",
+		"LD T1, [TB]",
+		"LD T1, [TB+12]",
+		"LD T1, [T2+8]",
+		"LD T1, [TB+T3]",
+		"ST T1, [TB+4]",
+		"PUSH TA",
+		"JMP +2",
+		"BEQ T3, 0, +1",
+		"BNE T1, T2, +0",
+		"HALT",
+	}
+	src := strings.Join(lines[:len(lines)-4], "\n") + "\nJMP 56\nBEQ T3, 0, 56\nBNE T1, T2, 56\nHALT\n"
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	words := slotWords(cg.Output)
+	if len(words) != len(lines) {
+		t.Fatalf("got %d slots, want %d", len(words), len(lines))
+	}
+	for i, w := range words {
+		got, err := Disassemble(w)
+		if err != nil {
+			t.Errorf("slot %d: %v", i, err)
+			continue
+		}
+		if got != lines[i] {
+			t.Errorf("slot %d disassembled as %q, want %q", i, got, lines[i])
+		}
+	}
+	if _, err := Disassemble(InstrWord{Opcode: 0x3F, Type: OpTypeSYS}); err == nil {
+		t.Errorf("unknown opcode disassembled without error")
+	}
+}
@@ -7,8 +7,10 @@ import (
 // Symbol represents an entry in the symbol table, such as a label or a constant.
 type Symbol struct {
 	Name    string
-	Address uint32
+	Address Addr
 	Defined bool
+	// Referenced is set when an operand or expression uses the symbol
+	Referenced bool
 	// Location of the symbol's definition
 	File   string
 	Line   int
@@ -36,7 +38,7 @@ func (st *SymbolTable) AttachWarnings(w *[]error) {
 
 // Define adds a new symbol to the table or updates its address if already present.
 // It marks the symbol as defined and records its location.
-func (st *SymbolTable) Define(name string, address uint32, file string, line, column int) (*Symbol, error) {
+func (st *SymbolTable) Define(name string, address Addr, file string, line, column int) (*Symbol, error) {
 	if s, exists := st.symbols[name]; exists {
 		if s.Defined {
 			// Report as error, but also add a warning for shadowing
@@ -65,16 +67,19 @@ func (st *SymbolTable) Define(name string, address uint32, file string, line, co
 	return newSymbol, nil
 }
 
-// Reference looks up a symbol. If it doesn't exist, it creates an undefined entry
-// to be resolved later. This is key for handling forward references.
+// Reference looks up a symbol and marks it as used. If it doesn't exist, it
+// creates an undefined entry to be resolved later. This is key for handling
+// forward references.
 func (st *SymbolTable) Reference(name string) *Symbol {
 	if s, exists := st.symbols[name]; exists {
+		s.Referenced = true
 		return s
 	}
 
 	newSymbol := &Symbol{
-		Name:    name,
-		Defined: false,
+		Name:       name,
+		Defined:    false,
+		Referenced: true,
 	}
 	st.symbols[name] = newSymbol
 	return newSymbol
@@ -109,8 +114,8 @@ func (st *SymbolTable) UnusedLabels() []*Symbol {
 	return unused
 }
 
-// isReferenced checks if a symbol was referenced (stub: always false for now)
+// isReferenced checks if a symbol was referenced.
 func (st *SymbolTable) isReferenced(name string) bool {
-	// TODO: Implement real reference tracking
-	return false
+	s, exists := st.symbols[name]
+	return exists && s.Referenced
 }
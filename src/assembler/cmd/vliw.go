@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VLIW packing rules (docs/vliw_encoding.adoc, "Instruction Packing Rules").
+// Slots are numbered from 1 in diagnostics, in source order.
+const (
+	ruleSlotCount = 1 // at most VLIWSlots operations
+	ruleMemory    = 2 // at most one memory operation
+	ruleControl   = 3 // at most one control operation
+	ruleRegisters = 4 // no two writes to a register, no read of a register written in the bundle
+	ruleHazards   = 5 // no structural hazards between operations
+)
+
+// bundleSlot is one operation of a bundle together with its effects.
+type bundleSlot struct {
+	instr  *InstructionNode
+	desc   *InstrDesc
+	reads  []string
+	writes []string
+}
+
+// isMemoryOp reports whether the instruction uses the memory port. CALL and
+// RET push and pop the return address.
+func isMemoryOp(desc *InstrDesc) bool {
+	switch desc.Mnemonic {
+	case "CACHE", "FLUSH", "MEMBAR", "CALL", "RET":
+		return true
+	}
+	return desc.Type == OpTypeMEM
+}
+
+// isControlOp reports whether the instruction changes the flow of control.
+func isControlOp(desc *InstrDesc, writes []string) bool {
+	switch desc.Mnemonic {
+	case "HALT", "SYSCALL", "BREAK":
+		return true
+	}
+	for _, r := range writes {
+		if r == "TC" {
+			return true // LD TC, [addr]
+		}
+	}
+	return desc.Type == OpTypeCTRL
+}
+
+// implicitEffects lists registers an instruction reads or writes without
+// naming them: the stack pointer, the link register and the status register.
+var implicitEffects = map[string]struct{ reads, writes []string }{
+	"PUSH": {reads: []string{"TB"}, writes: []string{"TB"}},
+	"POP":  {reads: []string{"TB"}, writes: []string{"TB"}},
+	"JAL":  {writes: []string{"T3"}},
+	"JALR": {writes: []string{"T3"}},
+	"CALL": {reads: []string{"TB"}, writes: []string{"TB"}},
+	"RET":  {reads: []string{"TB"}, writes: []string{"TB"}},
+	"CMP":  {writes: []string{"TS"}},
+	"TEST": {writes: []string{"TS"}},
+	"FCMP": {writes: []string{"TS"}},
+}
+
+// registerEffects returns the registers instr reads and writes.
+func registerEffects(instr *InstructionNode, desc *InstrDesc) (reads, writes []string) {
+	dest := desc.Writes()
+	for i, op := range instr.Operands {
+		switch v := op.(type) {
+		case *RegisterNode:
+			name := strings.ToUpper(v.Name)
+			if i == dest {
+				writes = append(writes, name)
+			} else {
+				reads = append(reads, name)
+			}
+		case *MemoryOperandNode:
+			for _, r := range []string{v.Base, v.Index} {
+				if r != "" {
+					reads = append(reads, strings.ToUpper(r))
+				}
+			}
+		}
+	}
+	if eff, ok := implicitEffects[desc.Mnemonic]; ok {
+		reads = append(reads, eff.reads...)
+		writes = append(writes, eff.writes...)
+	}
+	return reads, writes
+}
+
+// slotText names a slot for diagnostics, e.g. "slot 2 (LD)".
+func slotText(i int, s bundleSlot) string {
+	return fmt.Sprintf("slot %d (%s)", i+1, s.desc.Mnemonic)
+}
+
+// checkBundle enforces the packing rules on the operations of one bundle.
+func checkBundle(vliw *VLIWInstructionNode, slots []bundleSlot) error {
+	where := fmt.Sprintf("VLIW bundle at line %d", vliw.Line)
+	if len(slots) > VLIWSlots {
+		return fmt.Errorf("%s: %d operations, a bundle holds at most %d (packing rule %d)", where, len(slots), VLIWSlots, ruleSlotCount)
+	}
+	// pair returns the first two slots satisfying pred.
+	pair := func(pred func(bundleSlot) bool) (int, int) {
+		first := -1
+		for i, s := range slots {
+			if !pred(s) {
+				continue
+			}
+			if first >= 0 {
+				return first, i
+			}
+			first = i
+		}
+		return -1, -1
+	}
+	if i, j := pair(func(s bundleSlot) bool { return isMemoryOp(s.desc) }); i >= 0 {
+		return fmt.Errorf("%s: %s and %s both access memory, a bundle may contain at most one memory operation (packing rule %d)",
+			where, slotText(i, slots[i]), slotText(j, slots[j]), ruleMemory)
+	}
+	if i, j := pair(func(s bundleSlot) bool { return isControlOp(s.desc, s.writes) }); i >= 0 {
+		return fmt.Errorf("%s: %s and %s both change control flow, a bundle may contain at most one control operation (packing rule %d)",
+			where, slotText(i, slots[i]), slotText(j, slots[j]), ruleControl)
+	}
+	writer := make(map[string]int)
+	for i, s := range slots {
+		for _, r := range s.writes {
+			if j, ok := writer[r]; ok {
+				return fmt.Errorf("%s: %s and %s both write %s, the result would be undefined (packing rule %d, write-after-write)",
+					where, slotText(j, slots[j]), slotText(i, s), r, ruleRegisters)
+			}
+			writer[r] = i
+		}
+	}
+	for i, s := range slots {
+		for _, r := range s.reads {
+			if j, ok := writer[r]; ok && j < i {
+				return fmt.Errorf("%s: %s reads %s, which %s writes; slots of a bundle read their operands before any result is written, move the read to a later bundle (packing rule %d, read-after-write)",
+					where, slotText(i, s), r, slotText(j, slots[j]), ruleRegisters)
+			}
+		}
+	}
+	if i, j := pair(func(s bundleSlot) bool { return s.desc.Type == OpTypeUCODE }); i >= 0 {
+		return fmt.Errorf("%s: %s and %s both need the microcode sequencer, which runs one operation at a time (packing rule %d, structural hazard)",
+			where, slotText(i, slots[i]), slotText(j, slots[j]), ruleHazards)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVLIWPackingRules(t *testing.T) {
+	for _, src := range []string{
+		"[ADD T0, T1, T2] [LD T3, [TB+4]] [JMP 0]\n",
+		"[ADD T0, T0, 1] [ADD T1, T1, 1] [ADD T2, T2, 1]\n",
+		"[ADD T0, T1, T2] [SUB T1, T2, T3]\n", // reading a register written later in the bundle is fine
+		"[DIV T0, T1, T2] [ADD T3, T4, T5] [ST T6, [TB]]\n",
+	} {
+		if _, err := assembleSource(t, src); err != nil {
+			t.Errorf("%q: unexpected error %v", src, err)
+		}
+	}
+
+	for _, c := range []struct{ src, wantErr string }{
+		{"[LD T0, [TB]] [ST T1, [TB+4]]\n", "slot 1 (LD) and slot 2 (ST) both access memory"},
+		{"[ADD T0, T1, T2] [PUSH T3] [MEMBAR]\n", "slot 2 (PUSH) and slot 3 (MEMBAR) both access memory, a bundle may contain at most one memory operation (packing rule 2)"},
+		{"[JMP 0] [NOP] [BEQ T0, T1, 0]\n", "slot 1 (JMP) and slot 3 (BEQ) both change control flow"},
+		{"[JR T1] [HALT]\n", "slot 1 (JR) and slot 2 (HALT) both change control flow"},
+		{"[ADD T0, T1, T2] [SUB T0, T3, T4]\n", "slot 1 (ADD) and slot 2 (SUB) both write T0, the result would be undefined (packing rule 4, write-after-write)"},
+		{"[CMP T0, T1] [TEST T2, 1]\n", "slot 1 (CMP) and slot 2 (TEST) both write TS"},
+		{"[ADD T0, T1, T2] [SUB T3, T0, T4]\n", "slot 2 (SUB) reads T0, which slot 1 (ADD) writes"},
+		{"[ADD TB, TB, 4] [NOP] [LD T1, [TB]]\n", "slot 3 (LD) reads TB, which slot 1 (ADD) writes"},
+		{"[JAL 0] [ADD T0, T3, 1]\n", "slot 2 (ADD) reads T3, which slot 1 (JAL) writes"},
+		{"[PUSH T1] [CALL 0]\n", "slot 1 (PUSH) and slot 2 (CALL) both access memory"},
+		{"[ADD TB, TB, 4] [RET]\n", "slot 1 (ADD) and slot 2 (RET) both write TB"},
+		{"[DIV T0, T1, T2] [SQRT T3, T4]\n", "slot 1 (DIV) and slot 2 (SQRT) both need the microcode sequencer"},
+	} {
+		_, err := assembleSource(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
+
+func TestParFlags(t *testing.T) {
+	src := `ADD T0, T1, T2
+[ADD T0, T1, T2] [NOP] [NOP]
+[ADD T0, T1, T2] [SUB T3, T4, T5]
+[ADD T0, T1, T2] [LD T3, [TB]] [JMP 0]
+[LD T3, [TB]] [ADD T0, T1, T2] [NOP]
+[ADD T0, T1, T2] [LD T3, [TB]] [JMP 0]   ; @par serial, auto, 4
+ADD T0, T1, T2   ; @par 0
+`
+	cg, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var got []uint8
+	for _, w := range slotWords(cg.Output) {
+		got = append(got, w.Par)
+	}
+	want := []uint8{
+		ParSerial,
+		ParSerial, ParALU, ParALU,
+		ParALU, ParALU, ParALU,
+		ParFull, ParFull, ParFull,
+		ParALU, ParMemory, ParFull,
+		ParSerial, ParFull, ParFull,
+		ParSerial,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d slots, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("slot %d Par = %d, want %d", i, got[i], want[i])
+		}
+	}
+
+	// Comments that only look like pragmas are ordinary comments.
+	cg, err = assembleSource(t, "NOP   ; @note this is a comment\n; @parallel 1\nADD T0, T1, T2\n")
+	if err != nil {
+		t.Errorf("@ comments: unexpected error %v", err)
+	} else if w := slotWords(cg.Output); len(w) != 2 || w[1].Par != ParSerial {
+		t.Errorf("@ comments: got %+v, want NOP and a serial ADD", w)
+	}
+
+	for _, c := range []struct{ src, wantErr string }{
+		{"[ADD T0, T1, T2] [NOP]   ; @par 5\n", "Par value 101 is reserved"},
+		{"[ADD T0, T1, T2] [NOP]   ; @par 9\n", "9 does not fit the 3-bit Par field"},
+		{"[ADD T0, T1, T2] [NOP]   ; @par fast\n", `unknown value "fast"`},
+		{"[ADD T0, T1, T2] [SUB T3, T4, T5]   ; @par mem\n", "slot 1 (ADD) cannot be mem, no other slot of the bundle uses that unit"},
+		{"[ADD T0, T1, T2] [NOP] [NOP]   ; @par full\n", "slot 1 (ADD) cannot be full, no other slot runs alongside it"},
+		{"ADD T0, T1, T2   ; @par alu\n", "slot 1 (ADD) cannot be alu"},
+		{"[ADD T0, T1, T2]   ; @par auto, auto, auto, auto\n", "gives 4 values for 3 slot(s)"},
+	} {
+		_, err := assembleSource(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
@@ -0,0 +1,664 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Static worst-case execution time (WCET) analysis.
+//
+// The assembled program is turned into a control-flow graph with one node per
+// instruction or bundle. A node costs the largest cycle count of its slots
+// (the "Cycles" column of the instruction tables), which assumes no overlap
+// between successive issue groups and therefore bounds the real time from
+// above. A relaxed branch also costs its long jump, and a far memory access
+// the cycles of its whole sequence. Operations with a variable cost, such as
+// SYSCALL, need their worst case on the same line:
+//
+//	        SYSCALL            ; @cycles 40
+//
+// Every loop needs a bound, the largest number of times its header (the
+// labelled first instruction) runs per entry into the loop, given by a
+// .LOOPBOUND directive (or a @loopbound pragma) before the label or on the
+// label line. The bound of a software-pipelined loop carries over to its
+// kernel.
+//
+//	        .LOOPBOUND 16
+//	copy:
+//	        ...
+//	        BNE T2, 0, copy
+//
+// Loops are collapsed from the innermost outwards: a loop run n times costs
+// n-1 times its most expensive iteration plus the most expensive way out of it.
+// A call costs the WCET of the called routine. A path ends at RET, HALT, JR T3
+// (the return of a routine entered by JAL or JALR, which leave the return
+// address in T3) or the end of the program. Other indirect jumps and calls
+// (JR, JALR, LD TC) cannot be followed, so routines that reach one have no
+// bound; so do recursive routines, routines entered by CALL that return with
+// JR T3, and loops that are entered other than through their header.
+//
+// The analysis is run for every routine, that is every label in the code that
+// no jump or branch targets (subroutines, interrupt handlers, the program
+// entry), and reports the cycle count and the worst path.
+
+// RoutineTiming is the result of the WCET analysis for one label.
+type RoutineTiming struct {
+	Label  string
+	Line   int
+	Addr   Addr
+	Cycles int64
+	Path   []string // Worst path: source lines, loops and calls
+	Err    error    // Why no bound exists
+}
+
+func (r RoutineTiming) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s (line %d, 0x%X): no bound, %v", r.Label, r.Line, r.Addr, r.Err)
+	}
+	return fmt.Sprintf("%s (line %d, 0x%X): %d cycles, worst path %s", r.Label, r.Line, r.Addr, r.Cycles, strings.Join(r.Path, ", "))
+}
+
+// cfgNode is one issue group of the program.
+type cfgNode struct {
+	line  int
+	label string // A label naming the node, for diagnostics
+	cost  int64  // Cycles of the node itself, calls excluded
+	succ  []int
+	call  int  // Node called by the group, or -1
+	exit  bool // Execution leaves the routine (RET, HALT, JR T3)
+	link  bool // JR T3: returns to the address left in T3 by JAL or JALR
+	jump  bool // A jump or branch targets the node by address
+	bound int  // Loop bound of a loop headed by the node, 0 if none
+	err   error
+}
+
+// loopSummary describes a collapsed loop.
+type loopSummary struct {
+	bound int
+	cost  int64
+	exit  bool  // A path leaves the routine from inside the loop
+	succ  []int // Nodes reached when leaving the loop
+}
+
+// timingAnalysis holds the control-flow graph and the per-routine results.
+type timingAnalysis struct {
+	nodes  []cfgNode
+	jumped map[string]bool // Labels named by a jump or branch
+	called map[int]bool    // Nodes entered by CALL, which returns through the stack
+	done   map[int]*RoutineTiming
+	active map[int]bool
+}
+
+// parseCount reads the single positive argument of a @loopbound or @cycles pragma.
+func parseCount(p pragma) (int, error) {
+	if len(p.Args) == 1 {
+		if n, err := strconv.Atoi(p.Args[0]); err == nil && n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("@%s at line %d needs one positive count", p.Name, p.Line)
+}
+
+// analyzeTiming builds the control-flow graph of the laid-out program and
+// computes the WCET of every code label.
+func (cg *CodeGenerator) analyzeTiming(ast *AST) ([]RoutineTiming, error) {
+	ta := &timingAnalysis{jumped: map[string]bool{}, called: map[int]bool{}, done: map[int]*RoutineTiming{}, active: map[int]bool{}}
+	lines := ast.Program.Lines
+	nodeOf := make([]int, len(lines)) // node of each line, -1 for lines that issue nothing
+	addrNode := map[Addr]int{}
+	labelBound := map[string]int{}
+	labelLine := map[string]int{}
+	var pending *pragma
+	for i, line := range lines {
+		nodeOf[i] = -1
+		p, isPragma := parsePragma(line)
+		if isPragma && p.Name == "loopbound" {
+			if _, err := parseCount(p); err != nil {
+				return nil, err
+			}
+			pending = &p
+		}
+		if line.Label != nil {
+			labelLine[line.Label.Name] = line.Line
+		}
+		if line.Label != nil && pending != nil {
+			labelBound[line.Label.Name], _ = parseCount(*pending)
+			pending = nil
+		}
+		if pending != nil && line.Statement != nil {
+			return nil, fmt.Errorf("@loopbound at line %d is not followed by a loop label", pending.Line)
+		}
+		switch line.Statement.(type) {
+		case *InstructionNode, *VLIWInstructionNode:
+			nodeOf[i] = len(ta.nodes)
+			if _, seen := addrNode[cg.Layout[i].Addr]; !seen {
+				addrNode[cg.Layout[i].Addr] = len(ta.nodes)
+			}
+			ta.nodes = append(ta.nodes, cfgNode{line: line.Line, call: -1})
+		}
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("@loopbound at line %d is not followed by a loop label", pending.Line)
+	}
+	// The kernel of a pipelined loop runs at most once per unrolled iteration.
+	for _, p := range cg.Pipelines {
+		if b := labelBound[p.Label]; b > 0 {
+			kernel := p.Label
+			if p.Stages > 1 {
+				kernel += kernelSuffix
+			}
+			labelBound[kernel] = (b + p.Unroll - 1) / p.Unroll
+		}
+	}
+	for name, addr := range cg.Labels {
+		if n, ok := addrNode[addr]; ok {
+			if ta.nodes[n].bound == 0 && (ta.nodes[n].label == "" || name < ta.nodes[n].label) {
+				ta.nodes[n].label = name
+			}
+			if b := labelBound[name]; b > 0 {
+				ta.nodes[n].bound, ta.nodes[n].label = b, name
+			}
+		}
+	}
+
+	for i, line := range lines {
+		n := nodeOf[i]
+		if n < 0 {
+			continue
+		}
+		next := -1
+		for j := i + 1; j < len(lines) && next < 0; j++ {
+			next = nodeOf[j]
+		}
+		if err := cg.buildNode(ta, n, line, next, addrNode); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []RoutineTiming
+	for name, addr := range cg.Labels {
+		n, ok := addrNode[addr]
+		if !ok || ta.nodes[n].jump || ta.jumped[name] {
+			continue // data label or a label inside a routine
+		}
+		r := *ta.routine(n)
+		r.Label, r.Addr, r.Line = name, addr, labelLine[name]
+		out = append(out, r)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Addr != out[b].Addr {
+			return out[a].Addr < out[b].Addr
+		}
+		return out[a].Label < out[b].Label
+	})
+	return out, nil
+}
+
+// buildNode fills in the cost and successors of node n for line. next is
+// the node that follows in program order, or -1.
+func (cg *CodeGenerator) buildNode(ta *timingAnalysis, n int, line *LineNode, next int, addrNode map[Addr]int) error {
+	node := &ta.nodes[n]
+	ops := groupOps(line.Statement)
+	if len(ops) == 0 {
+		node.err = fmt.Errorf("line %d cannot be analysed", line.Line)
+		return nil
+	}
+	var override int
+	if p, ok := parsePragma(line); ok && p.Name == "cycles" {
+		n, err := parseCount(p)
+		if err != nil {
+			return err
+		}
+		override = n
+	}
+	var ctrl *loopOp
+	for k, op := range ops {
+		if op.slot.desc.Variable && override == 0 {
+			node.err = fmt.Errorf("%s at line %d takes a variable number of cycles, give its worst case with @cycles", op.slot.desc.Mnemonic, line.Line)
+		}
+		node.cost = max(node.cost, int64(opLatency(op.slot.desc)))
+		if isControlOp(op.slot.desc, op.slot.writes) {
+			ctrl = &ops[k]
+		}
+	}
+	if override > 0 {
+		node.cost = int64(override)
+	}
+	if instr, ok := line.Statement.(*InstructionNode); ok && cg.relaxed[instr] {
+		if isFarCandidate(instr) {
+			node.cost = cg.farCost(instr)
+		} else {
+			ld, _ := LookupInstr("LD")
+			node.cost += int64(ld.Cycles)
+		}
+	}
+	fallThrough := func() {
+		if next >= 0 {
+			node.succ = append(node.succ, next)
+		} else {
+			node.exit = true
+		}
+	}
+	target := func() (int, bool) {
+		t, ok := cg.targetAddr(ctrl.slot.instr.Operands[len(ctrl.slot.instr.Operands)-1])
+		if !ok {
+			node.err = fmt.Errorf("%s at line %d: target cannot be resolved", ctrl.slot.desc.Mnemonic, line.Line)
+			return -1, false
+		}
+		tn, ok := addrNode[t]
+		if !ok {
+			node.err = fmt.Errorf("%s at line %d: target 0x%X is not an instruction", ctrl.slot.desc.Mnemonic, line.Line, t)
+		}
+		return tn, ok
+	}
+	if ctrl == nil {
+		fallThrough()
+		return nil
+	}
+	m := ctrl.slot.desc.Mnemonic
+	_, cond := invertedBranch[m]
+	switch {
+	case cond || m == "JMP":
+		if cond {
+			fallThrough()
+		}
+		if t, ok := target(); ok {
+			node.succ = append(node.succ, t)
+			if id, isLabel := ctrl.slot.instr.Operands[len(ctrl.slot.instr.Operands)-1].(*IdentifierNode); isLabel {
+				ta.jumped[id.Name] = true
+			} else {
+				ta.nodes[t].jump = true
+			}
+		}
+	case m == "CALL" || m == "JAL":
+		if t, ok := target(); ok {
+			node.call = t
+			ta.called[t] = ta.called[t] || m == "CALL"
+		}
+		fallThrough()
+	case m == "RET" || m == "HALT":
+		node.exit = true
+	case m == "JR" && isLinkRegister(ctrl.slot.instr.Operands[0]):
+		node.exit, node.link = true, true
+	case m == "SYSCALL" || m == "BREAK":
+		fallThrough()
+	default: // JR, JALR, LD TC
+		node.err = fmt.Errorf("%s at line %d is an indirect jump whose targets are unknown", m, line.Line)
+	}
+	return nil
+}
+
+// isLinkRegister reports whether op names T3, the link register of JAL and JALR.
+func isLinkRegister(op OperandNode) bool {
+	reg, ok := op.(*RegisterNode)
+	return ok && strings.EqualFold(reg.Name, "T3")
+}
+
+// routine returns the WCET of the routine entered at node entry.
+func (ta *timingAnalysis) routine(entry int) *RoutineTiming {
+	if r, ok := ta.done[entry]; ok {
+		return r
+	}
+	r := &RoutineTiming{}
+	if ta.active[entry] {
+		r.Err = fmt.Errorf("recursive call to the routine at line %d", ta.nodes[entry].line)
+		return r
+	}
+	ta.active[entry] = true
+	r.Cycles, r.Path, r.Err = ta.worstPath(entry)
+	delete(ta.active, entry)
+	ta.done[entry] = r
+	return r
+}
+
+// worstPath computes the WCET of the routine entered at entry.
+func (ta *timingAnalysis) worstPath(entry int) (int64, []string, error) {
+	// Nodes of the routine, in depth-first order.
+	var order []int
+	seen := map[int]bool{entry: true}
+	for stack := []int{entry}; len(stack) > 0; {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		order = append(order, n)
+		for _, s := range ta.nodes[n].succ {
+			if !seen[s] {
+				seen[s] = true
+				stack = append(stack, s)
+			}
+		}
+	}
+	sort.Ints(order)
+	for _, n := range order {
+		if err := ta.nodes[n].err; err != nil {
+			return 0, nil, err
+		}
+		if ta.nodes[n].link && ta.called[entry] {
+			return 0, nil, fmt.Errorf("JR T3 at line %d returns through T3, but the routine is entered by CALL, which keeps the return address on the stack", ta.nodes[n].line)
+		}
+	}
+
+	loops, err := ta.findLoops(entry, order)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// rep maps every node to the outermost collapsed loop containing it.
+	rep := map[int]int{}
+	for _, n := range order {
+		rep[n] = n
+	}
+	summaries := map[int]*loopSummary{}
+	var callErr error
+	succ := func(r int) []int {
+		raw := ta.nodes[r].succ
+		if s, ok := summaries[r]; ok {
+			raw = s.succ
+		}
+		var out []int
+		for _, x := range raw {
+			if x := rep[x]; x != r && !containsInt(out, x) {
+				out = append(out, x)
+			}
+		}
+		return out
+	}
+	cost := func(r int) int64 {
+		if s, ok := summaries[r]; ok {
+			return s.cost
+		}
+		c := ta.nodes[r].cost
+		if callee := ta.nodes[r].call; callee >= 0 {
+			sub := ta.routine(callee)
+			if sub.Err != nil && callErr == nil {
+				callErr = fmt.Errorf("call at line %d: %v", ta.nodes[r].line, sub.Err)
+			}
+			c += sub.Cycles
+		}
+		return c
+	}
+	exits := func(r int) bool {
+		if s, ok := summaries[r]; ok {
+			return s.exit
+		}
+		return ta.nodes[r].exit
+	}
+
+	for _, l := range loops {
+		h := l.header
+		body := map[int]bool{}
+		for _, n := range l.body {
+			body[rep[n]] = true
+		}
+		inBody := func(r int) []int {
+			var out []int
+			for _, s := range succ(r) {
+				if body[s] && s != h {
+					out = append(out, s)
+				}
+			}
+			return out
+		}
+		dist, _, err := longestPaths(h, inBody, cost)
+		if err != nil {
+			return 0, nil, fmt.Errorf("loop at line %d: %v", ta.nodes[h].line, err)
+		}
+		sum := &loopSummary{bound: ta.nodes[h].bound}
+		var iter, out int64 = 0, -1
+		for r, d := range dist {
+			for _, s := range succ(r) {
+				switch {
+				case s == h:
+					iter = max(iter, d)
+				case !body[s]:
+					out = max(out, d)
+					if !containsInt(sum.succ, s) {
+						sum.succ = append(sum.succ, s)
+					}
+				}
+			}
+			if exits(r) {
+				out, sum.exit = max(out, d), true
+			}
+		}
+		if out < 0 {
+			return 0, nil, fmt.Errorf("the loop at line %d (%s) never exits", ta.nodes[h].line, ta.nodes[h].label)
+		}
+		sort.Ints(sum.succ)
+		sum.cost = int64(sum.bound-1)*iter + out
+		for _, n := range order {
+			if body[rep[n]] {
+				rep[n] = h
+			}
+		}
+		summaries[h] = sum
+	}
+
+	dist, pred, err := longestPaths(entry, succ, cost)
+	if err != nil {
+		return 0, nil, err
+	}
+	if callErr != nil {
+		return 0, nil, callErr
+	}
+	best, end := int64(-1), -1
+	for r, d := range dist {
+		if (exits(r) || len(succ(r)) == 0) && (d > best || d == best && r < end) {
+			best, end = d, r
+		}
+	}
+	if end < 0 {
+		return 0, nil, fmt.Errorf("no path leaves the routine")
+	}
+	var nodes []int
+	for r := end; ; r = pred[r] {
+		nodes = append([]int{r}, nodes...)
+		if r == entry {
+			break
+		}
+	}
+	return best, ta.describePath(nodes, summaries), nil
+}
+
+// naturalLoop is a loop of the routine.
+type naturalLoop struct {
+	header int
+	body   []int
+}
+
+// findLoops returns the loops of the routine, innermost first. Every loop
+// must be reducible and carry a bound.
+func (ta *timingAnalysis) findLoops(entry int, order []int) ([]naturalLoop, error) {
+	preds := map[int][]int{}
+	for _, n := range order {
+		for _, s := range ta.nodes[n].succ {
+			preds[s] = append(preds[s], n)
+		}
+	}
+	// Iterative dominator sets; routines are small enough.
+	dom := map[int]map[int]bool{}
+	all := map[int]bool{}
+	for _, n := range order {
+		all[n] = true
+	}
+	for _, n := range order {
+		if n == entry {
+			dom[n] = map[int]bool{n: true}
+		} else {
+			dom[n] = all
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, n := range order {
+			if n == entry {
+				continue
+			}
+			var d map[int]bool
+			for _, p := range preds[n] {
+				if d == nil {
+					d = map[int]bool{}
+					for x := range dom[p] {
+						d[x] = true
+					}
+					continue
+				}
+				for x := range d {
+					if !dom[p][x] {
+						delete(d, x)
+					}
+				}
+			}
+			if d == nil {
+				d = map[int]bool{}
+			}
+			d[n] = true
+			if len(d) != len(dom[n]) {
+				dom[n], changed = d, true
+			}
+		}
+	}
+
+	bodies := map[int]map[int]bool{}
+	var headers []int
+	// Retreating edges found by a depth-first search must be back edges.
+	state := map[int]int{} // 1 on the stack, 2 finished
+	var visit func(n int) error
+	visit = func(n int) error {
+		state[n] = 1
+		for _, s := range ta.nodes[n].succ {
+			switch state[s] {
+			case 0:
+				if err := visit(s); err != nil {
+					return err
+				}
+			case 1:
+				if !dom[n][s] {
+					return fmt.Errorf("the loop through line %d is entered other than through its header", ta.nodes[s].line)
+				}
+				if bodies[s] == nil {
+					bodies[s] = map[int]bool{s: true}
+					headers = append(headers, s)
+				}
+				for work := []int{n}; len(work) > 0; {
+					x := work[len(work)-1]
+					work = work[:len(work)-1]
+					if bodies[s][x] {
+						continue
+					}
+					bodies[s][x] = true
+					work = append(work, preds[x]...)
+				}
+			}
+		}
+		state[n] = 2
+		return nil
+	}
+	if err := visit(entry); err != nil {
+		return nil, err
+	}
+	var loops []naturalLoop
+	for _, h := range headers {
+		if ta.nodes[h].bound == 0 {
+			name := ta.nodes[h].label
+			if name == "" {
+				name = "unlabelled"
+			}
+			return nil, fmt.Errorf("the loop at line %d (%s) has no bound, add .LOOPBOUND before its label", ta.nodes[h].line, name)
+		}
+		l := naturalLoop{header: h}
+		for n := range bodies[h] {
+			l.body = append(l.body, n)
+		}
+		sort.Ints(l.body)
+		loops = append(loops, l)
+	}
+	sort.SliceStable(loops, func(a, b int) bool { return len(loops[a].body) < len(loops[b].body) })
+	return loops, nil
+}
+
+// longestPaths returns, for every node reachable from start in the acyclic
+// graph given by succ, the cost of the most expensive path from start that
+// ends with it, and its predecessor on that path.
+func longestPaths(start int, succ func(int) []int, cost func(int) int64) (map[int]int64, map[int]int, error) {
+	var topo []int
+	state := map[int]int{}
+	var visit func(n int) error
+	visit = func(n int) error {
+		state[n] = 1
+		for _, s := range succ(n) {
+			switch state[s] {
+			case 0:
+				if err := visit(s); err != nil {
+					return err
+				}
+			case 1:
+				return fmt.Errorf("irreducible control flow")
+			}
+		}
+		state[n] = 2
+		topo = append(topo, n)
+		return nil
+	}
+	if err := visit(start); err != nil {
+		return nil, nil, err
+	}
+	dist := map[int]int64{start: cost(start)}
+	pred := map[int]int{}
+	for i := len(topo) - 1; i >= 0; i-- {
+		n := topo[i]
+		for _, s := range succ(n) {
+			if d := dist[n] + cost(s); d > dist[s] {
+				dist[s], pred[s] = d, n
+			}
+		}
+	}
+	return dist, pred, nil
+}
+
+// describePath renders the nodes of a worst path: runs of consecutive
+// instructions as line ranges, loops with their bound and calls by target.
+func (ta *timingAnalysis) describePath(nodes []int, loops map[int]*loopSummary) []string {
+	var out []string
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		node := ta.nodes[n]
+		if l, ok := loops[n]; ok {
+			out = append(out, fmt.Sprintf("loop %s x%d (%d cycles)", node.label, l.bound, l.cost))
+			continue
+		}
+		j := i
+		for j+1 < len(nodes) && nodes[j+1] == nodes[j]+1 && loops[nodes[j+1]] == nil && ta.nodes[nodes[j]].call < 0 {
+			j++
+		}
+		step := fmt.Sprintf("line %d", node.line)
+		if last := ta.nodes[nodes[j]].line; last != node.line {
+			step = fmt.Sprintf("lines %d-%d", node.line, last)
+		}
+		if c := ta.nodes[nodes[j]].call; c >= 0 {
+			step += fmt.Sprintf(" (call %s, %d cycles)", ta.nodes[c].label, ta.routine(c).Cycles)
+		}
+		out = append(out, step)
+		i = j
+	}
+	return out
+}
+
+func containsInt(s []int, x int) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTiming renders the WCET report for the console and listings.
+func formatTiming(timing []RoutineTiming) string {
+	var sb strings.Builder
+	for _, r := range timing {
+		fmt.Fprintf(&sb, "  %s\n", r)
+	}
+	return sb.String()
+}
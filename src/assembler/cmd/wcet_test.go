@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+// timing assembles src with the WCET analysis enabled.
+func timing(t *testing.T, src string) ([]RoutineTiming, error) {
+	t.Helper()
+	ctx := parseSource(t, src)
+	cg := NewCodeGenerator(ctx.SymbolTable)
+	cg.WCET = true
+	err := cg.Generate(ctx.AST)
+	return cg.Timing, err
+}
+
+func TestWCET(t *testing.T) {
+	src := `main:
+        CALL sum
+        HALT
+sum:
+        ADD T2, T0, 8
+.LOOPBOUND 8
+loop:
+        LD  T3, [T0]
+        ADD T5, T5, T3
+        ADD T0, T0, 1
+        BNE T0, T2, loop
+        RET
+irq:
+        PUSH T0
+        DIV T0, T1, T2
+        BEQ T0, 0, done
+        SYSCALL            ; @cycles 40
+done:
+        POP T0
+        RET
+nested:
+        ADD T1, T1, 0
+        ; @loopbound 4
+outer:
+        ADD T2, T2, 0
+inner:  ; @loopbound 3
+        SUB T2, T2, 1
+        BNE T2, 0, inner
+        SUB T1, T1, 1
+        BNE T1, 0, outer
+        RET
+`
+	got, err := timing(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]int64{
+		"main":   3 + 43 + 1,        // CALL, sum, HALT
+		"sum":    1 + (7*5 + 5) + 2, // ADD, 8 loop passes of 5 cycles, RET
+		"irq":    2 + 12 + 1 + 40 + 2 + 2,
+		"nested": 1 + (3*(1+6+2) + 9) + 2, // the inner loop costs 2*2+2
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d routines %v, want %d", len(got), got, len(want))
+	}
+	for _, r := range got {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Label, r.Err)
+			continue
+		}
+		if r.Cycles != want[r.Label] {
+			t.Errorf("%s: %d cycles, want %d (%s)", r.Label, r.Cycles, want[r.Label], r)
+		}
+	}
+	if s := got[1].String(); s != "sum (line 4, 0x8): 43 cycles, worst path line 5, loop loop x8 (40 cycles), line 12" {
+		t.Errorf("report = %q", s)
+	}
+	if s := got[0].String(); !strings.Contains(s, "line 2 (call sum, 43 cycles), line 3") {
+		t.Errorf("report = %q", s)
+	}
+}
+
+func TestWCETPipelinedLoop(t *testing.T) {
+	src := `copy:
+        ADD T2, T0, 0
+.LOOPBOUND 8
+.PIPELINE min=4
+cl:
+        LD  T3, [T0]
+        MUL T4, T3, T3
+        ADD T5, T5, T4
+        ADD T0, T0, 1
+        SUB T2, T2, 1
+        BNE T2, 0, cl
+        RET
+`
+	got, err := timing(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(got) == 0 || got[0].Err != nil || !strings.Contains(got[0].String(), "loop cl@kernel x8 (") {
+		t.Errorf("got %v, want a bound through the kernel loop", got)
+	}
+}
+
+func TestWCETLinkedLeaf(t *testing.T) {
+	src := `main:
+        JAL leaf
+        HALT
+leaf:
+        ADD T0, T0, 1
+        JR T3
+`
+	got, err := timing(t, src)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := map[string]int64{
+		"main": 2 + 2 + 1, // JAL, leaf, HALT
+		"leaf": 1 + 1,     // ADD, JR T3
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d routines %v, want %d", len(got), got, len(want))
+	}
+	for _, r := range got {
+		if r.Err != nil || r.Cycles != want[r.Label] {
+			t.Errorf("%s: %d cycles (%v), want %d", r.Label, r.Cycles, r.Err, want[r.Label])
+		}
+	}
+}
+
+func TestWCETUnbounded(t *testing.T) {
+	for _, c := range []struct{ src, wantErr string }{
+		{"f:\n SUB T0, T0, 1\nl:\n SUB T1, T1, 1\n BNE T1, 0, l\n RET\n", "the loop at line 4 (l) has no bound, add .LOOPBOUND before its label"},
+		{"f:\n SYSCALL\n RET\n", "SYSCALL at line 2 takes a variable number of cycles"},
+		{"f:\n JR T2\n", "JR at line 2 is an indirect jump"},
+		{"f:\n CALL g\n RET\ng:\n JR T3\n", "call at line 2: JR T3 at line 5 returns through T3, but the routine is entered by CALL"},
+		{"f:\n CALL g\n RET\ng:\n CALL f\n RET\n", "recursive call"},
+		{"f:\n.LOOPBOUND 2\nl:\n ADD T0, T0, 1\n JMP l\n", "the loop at line 4 (l) never exits"},
+		{"f:\n CALL g\n RET\ng:\n JR T1\n", "call at line 2: JR at line 5 is an indirect jump"},
+	} {
+		got, err := timing(t, c.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.src, err)
+			continue
+		}
+		if len(got) == 0 || got[0].Err == nil || !strings.Contains(got[0].Err.Error(), c.wantErr) {
+			t.Errorf("%q: got %v, want error %q", c.src, got, c.wantErr)
+		}
+	}
+
+	for _, c := range []struct{ src, wantErr string }{
+		{".LOOPBOUND 0\nl:\n JMP l\n", "@loopbound at line 1 needs one positive count"},
+		{".LOOPBOUND 4\n NOP\n", "@loopbound at line 1 is not followed by a loop label"},
+		{"f:\n SYSCALL ; @cycles many\n", "@cycles at line 2 needs one positive count"},
+	} {
+		_, err := timing(t, c.src)
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%q: error = %v, want %q", c.src, err, c.wantErr)
+		}
+	}
+}
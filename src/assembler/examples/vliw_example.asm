@@ -12,12 +12,13 @@
 ;===============================================================================
 main:
         ; Initialize array data
-        LD TB, array_data    ; Base pointer to array
+        LEA T6, array_data   ; Address of the array (TB cannot be used
+        ADD TB, T6, 0        ; with a PC-relative address): base pointer
         LD T0, array_length  ; Number of elements
-        LD T1, 0             ; Initialize sum to 0
-        LD T2, 0             ; Initialize index to 0
-        LD T3, 0             ; Initialize max to 0
-        LD T4, 0             ; Initialize min to 0
+        SUB T1, T1, T1       ; Initialize sum to 0
+        SUB T2, T2, T2       ; Initialize index to 0
+        SUB T3, T3, T3       ; Initialize max to 0
+        SUB T4, T4, T4       ; Initialize min to 0
 
         ; Set initial min value (first array element)
         LD T4, [TB]
@@ -32,8 +33,8 @@ loop:
         ; Add to sum
         ADD T1, T1, T5      ; sum += array[i]
 
-        ; VLIW operation: Update max if needed while checking for end of array
-        [CMP T6, T5, T3] [ADD T2, T2, 1] [CMP T7, T2, T0]
+        ; VLIW operation: Compare with max while advancing the index
+        [SUB T6, T5, T3] [ADD T2, T2, 1] [NOP]
 
         ; Branch if element > max
         BGT T6, 0, update_max
@@ -47,7 +48,7 @@ update_max:
 
 check_min:
         ; VLIW operation: Compare with min and branch check
-        [CMP T6, T5, T4] [NOP] [NOP]
+        [SUB T6, T5, T4] [NOP] [NOP]
 
         ; Branch if element < min
         BLT T6, 0, update_min
@@ -66,15 +67,17 @@ check_loop:
 ;===============================================================================
 ; Store results with parallel operations
 ;===============================================================================
-        ; Store all results in one VLIW instruction (parallel stores)
-        [ST T1, result_sum] [ST T3, result_max] [ST T4, result_min]
+        ; Store the results (a bundle has a single memory port, so one store each)
+        ST T1, result_sum
+        ST T3, result_max
+        ST T4, result_min
 
         ; Calculate and store average
         DIV T5, T1, T0      ; average = sum / length
         ST T5, result_avg
 
         ; Signal completion
-        LD T0, 1
+        LEA T0, 1            ; LEA of a constant address loads the constant
         ST T0, 0x2000
 
         ; End program
@@ -2,8 +2,9 @@ module github.com/kvany/vtx1/assembler
 
 go 1.24
 
+require github.com/antlr4-go/antlr/v4 v4.13.1
+
 require (
 	github.com/alecthomas/participle v0.7.1 // indirect
-	github.com/antlr4-go/antlr/v4 v4.13.1 // indirect
 	golang.org/x/exp v0.0.0-20250606033433-dcc06ee1d476 // indirect
 )
@@ -32,8 +32,19 @@ func main() {
 	showHelp := flag.Bool("h", false, "Show help information")
 	flag.BoolVar(showHelp, "help", false, "Show help information")
 
-	wordSize := flag.String("wordsize", "8", "Output word size/format: 8, 36, 108, ternary")
-	flag.StringVar(wordSize, "w", "8", "Output word size/format: 8, 36, 108, ternary")
+	wordSize := flag.String("wordsize", "8", "Output word size/format: 8, 36, 36be, 108")
+	flag.StringVar(wordSize, "w", "8", "Output word size/format: 8, 36, 36be, 108")
+
+	autoPack := flag.Bool("autopack", false, "Pack sequential instructions into VLIW bundles")
+	hazards := flag.String("hazards", "warn", "Handling of pipeline hazards: warn, nop, or error")
+	wcet := flag.Bool("wcet", false, "Report the worst-case execution time of every routine")
+	addrUnit := flag.String("addrunit", "byte", "What one address names: byte, word, or tritword")
+	arith := flag.String("arith", "binary", "Arithmetic of constant expressions: binary or ternary")
+	var includePaths stringList
+	flag.Var(&includePaths, "I", "Add a directory to search for .INCLUDE files (repeatable)")
+	depsFile := flag.String("deps", "", "Write the include dependencies of the output as a make rule to this file")
+	var defineList stringList
+	flag.Var(&defineList, "D", "Predefine a constant, NAME or NAME=value, for conditional assembly (repeatable)")
 
 	flag.Parse()
 	fmt.Printf("[DEBUG] flag.Args(): %v\n", flag.Args())
@@ -57,7 +68,35 @@ func main() {
 
 	inputFile := args[0]
 
-	err := cmd.RunAssembler(inputFile, *outputFile, *listingFile, *format, *verbose, *errorsFile, *wordSize)
+	hazardMode, err := cmd.ParseHazardMode(*hazards)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(cmd.ExitError)
+	}
+
+	unit, err := cmd.ParseAddrUnit(*addrUnit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(cmd.ExitError)
+	}
+
+	arithMode, err := cmd.ParseArithMode(*arith)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(cmd.ExitError)
+	}
+
+	defines := make(map[string]int64)
+	for _, d := range defineList {
+		name, v, err := cmd.ParseDefine(d)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(cmd.ExitError)
+		}
+		defines[name] = v
+	}
+
+	err = cmd.RunAssembler(inputFile, *outputFile, *listingFile, *format, *verbose, *errorsFile, *wordSize, cmd.Options{AutoPack: *autoPack, Hazards: hazardMode, WCET: *wcet, AddrUnit: unit, Arith: arithMode, IncludePaths: includePaths, DepsFile: *depsFile, Defines: defines})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(cmd.ExitError)
@@ -69,3 +108,13 @@ func main() {
 
 	os.Exit(cmd.ExitSuccess)
 }
+
+// stringList is a flag that can be given any number of times.
+type stringList []string
+
+func (l *stringList) String() string { return fmt.Sprint(*l) }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package ternary implements the balanced-ternary number system of the VTX1
+// architecture: single trits, 9-trit trytes and 18-trit words, conversion to
+// and from int64 and trit strings, balanced arithmetic with overflow
+// detection and the Kleene logic used by the hardware
+// (src/common/ternary_arithmetic.v, src/common/ternary_logic.v).
+//
+// Trit strings are written most significant trit first using '+', '0' and
+// '-' (for example "+-0" is 9 - 3 + 0 = 6), as in the assembler's 0t literals.
+package ternary
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Trit is a balanced ternary digit with value -1, 0 or +1.
+type Trit int8
+
+const (
+	Neg  Trit = -1
+	Zero Trit = 0
+	Pos  Trit = 1
+)
+
+// Two-bit hardware encoding of a trit (src/common/ternary_constants.v).
+const (
+	BitsNeg   = 0b00
+	BitsZero  = 0b01
+	BitsPos   = 0b10
+	BitsUndef = 0b11
+)
+
+var (
+	// ErrOverflow is returned when a value does not fit the target width.
+	ErrOverflow = errors.New("ternary: value out of range")
+	// ErrSyntax is returned for malformed trit strings or encodings.
+	ErrSyntax = errors.New("ternary: invalid trit")
+	// ErrDivideByZero is returned when dividing by a zero word.
+	ErrDivideByZero = errors.New("ternary: division by zero")
+)
+
+// ParseTrit converts one of '+', '0' or '-' to a trit.
+func ParseTrit(c byte) (Trit, error) {
+	switch c {
+	case '+':
+		return Pos, nil
+	case '0':
+		return Zero, nil
+	case '-':
+		return Neg, nil
+	}
+	return Zero, fmt.Errorf("%w: %q", ErrSyntax, c)
+}
+
+// Byte returns the character used for t in trit strings.
+func (t Trit) Byte() byte {
+	switch {
+	case t > 0:
+		return '+'
+	case t < 0:
+		return '-'
+	}
+	return '0'
+}
+
+func (t Trit) String() string { return string(t.Byte()) }
+
+// Bits returns the two-bit hardware encoding of t.
+func (t Trit) Bits() uint8 {
+	switch {
+	case t > 0:
+		return BitsPos
+	case t < 0:
+		return BitsNeg
+	}
+	return BitsZero
+}
+
+// TritFromBits decodes a two-bit hardware encoding; 0b11 is rejected.
+func TritFromBits(b uint8) (Trit, error) {
+	switch b & 0b11 {
+	case BitsNeg:
+		return Neg, nil
+	case BitsZero:
+		return Zero, nil
+	case BitsPos:
+		return Pos, nil
+	}
+	return Zero, fmt.Errorf("%w: undefined encoding 0b11", ErrSyntax)
+}
+
+// Not is Kleene negation (-t).
+func (t Trit) Not() Trit { return -t }
+
+// And is Kleene conjunction, the minimum of a and b.
+func And(a, b Trit) Trit {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Or is Kleene disjunction, the maximum of a and b.
+func Or(a, b Trit) Trit {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// addTrits adds two trits and a carry, returning the balanced sum digit and carry out.
+func addTrits(a, b, carry Trit) (sum, out Trit) {
+	s := int(a) + int(b) + int(carry)
+	switch {
+	case s > 1:
+		return Trit(s - 3), Pos
+	case s < -1:
+		return Trit(s + 3), Neg
+	}
+	return Trit(s), Zero
+}
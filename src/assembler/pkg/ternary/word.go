@@ -0,0 +1,344 @@
+package ternary
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// TryteTrits is the number of trits in a tryte.
+	TryteTrits = 9
+	// WordTrits is the number of trits in a machine word (and an address).
+	WordTrits = 18
+
+	// TryteMax is the largest value of a tryte, (3^9-1)/2; the smallest is -TryteMax.
+	TryteMax int64 = 9841
+	// WordMax is the largest value of a word, (3^18-1)/2; the smallest is -WordMax.
+	WordMax int64 = 193710244
+)
+
+// Tryte is a 9-trit balanced ternary value; index 0 is the least significant trit.
+type Tryte [TryteTrits]Trit
+
+// Word is an 18-trit balanced ternary value; index 0 is the least significant trit.
+type Word [WordTrits]Trit
+
+// TryteFromInt64 converts v to a tryte, failing with ErrOverflow if |v| > TryteMax.
+func TryteFromInt64(v int64) (Tryte, error) {
+	var t Tryte
+	return t, fromInt64(t[:], v)
+}
+
+// WordFromInt64 converts v to a word, failing with ErrOverflow if |v| > WordMax.
+func WordFromInt64(v int64) (Word, error) {
+	var w Word
+	return w, fromInt64(w[:], v)
+}
+
+// WrapTryte reduces v modulo 3^9 into the tryte range, as the hardware does on overflow.
+func WrapTryte(v int64) Tryte {
+	t, _ := TryteFromInt64(wrap(v, TryteMax))
+	return t
+}
+
+// WrapWord reduces v modulo 3^18 into the word range, as the hardware does on overflow.
+func WrapWord(v int64) Word {
+	w, _ := WordFromInt64(wrap(v, WordMax))
+	return w
+}
+
+// ParseTryte parses a trit string of at most 9 significant trits.
+func ParseTryte(s string) (Tryte, error) {
+	var t Tryte
+	return t, parse(t[:], s)
+}
+
+// ParseWord parses a trit string of at most 18 significant trits.
+func ParseWord(s string) (Word, error) {
+	var w Word
+	return w, parse(w[:], s)
+}
+
+// ParseInt parses a trit string of any width that fits in an int64.
+func ParseInt(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("%w: empty trit string", ErrSyntax)
+	}
+	var v int64
+	for i := 0; i < len(s); i++ {
+		t, err := ParseTrit(s[i])
+		if err != nil {
+			return 0, err
+		}
+		if v > (math.MaxInt64-1)/3 || v < (math.MinInt64+1)/3 {
+			return 0, fmt.Errorf("%w: %s does not fit in 64 bits", ErrOverflow, s)
+		}
+		v = v*3 + int64(t)
+	}
+	return v, nil
+}
+
+// FormatInt returns the shortest trit string for v ("0" for zero).
+func FormatInt(v int64) string {
+	if v == 0 {
+		return "0"
+	}
+	var digits []byte
+	for v != 0 {
+		r := v % 3
+		v /= 3
+		switch r {
+		case 2:
+			r, v = -1, v+1
+		case -2:
+			r, v = 1, v-1
+		}
+		digits = append(digits, Trit(r).Byte())
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
+
+// Int64 returns the value of t.
+func (t Tryte) Int64() int64 { return toInt64(t[:]) }
+
+// Int64 returns the value of w.
+func (w Word) Int64() int64 { return toInt64(w[:]) }
+
+// String returns all 9 trits, most significant first.
+func (t Tryte) String() string { return format(t[:]) }
+
+// String returns all 18 trits, most significant first.
+func (w Word) String() string { return format(w[:]) }
+
+// Add returns t+o wrapped to 9 trits and whether the sum overflowed.
+func (t Tryte) Add(o Tryte) (Tryte, bool) {
+	var r Tryte
+	return r, add(r[:], t[:], o[:]) != Zero
+}
+
+// Add returns w+o wrapped to 18 trits and whether the sum overflowed.
+func (w Word) Add(o Word) (Word, bool) {
+	var r Word
+	return r, add(r[:], w[:], o[:]) != Zero
+}
+
+// Sub returns t-o wrapped to 9 trits and whether the difference overflowed.
+func (t Tryte) Sub(o Tryte) (Tryte, bool) { return t.Add(o.Neg()) }
+
+// Sub returns w-o wrapped to 18 trits and whether the difference overflowed.
+func (w Word) Sub(o Word) (Word, bool) { return w.Add(o.Neg()) }
+
+// Mul returns w*o wrapped to 18 trits and whether the product overflowed.
+func (w Word) Mul(o Word) (Word, bool) {
+	p := w.Int64() * o.Int64() // |p| <= WordMax^2 fits in an int64
+	return WrapWord(p), p > WordMax || p < -WordMax
+}
+
+// DivMod returns the quotient of w/o rounded to the nearest integer and the
+// remainder w - q*o, which lies within -|o|/2..|o|/2 (for o = 3 a single trit,
+// -1..+1). Halves round toward zero, as dropping the fractional trits does.
+// The quotient is never larger than w, so it cannot overflow.
+func (w Word) DivMod(o Word) (q, r Word, err error) {
+	x, y := w.Int64(), o.Int64()
+	if y == 0 {
+		return q, r, ErrDivideByZero
+	}
+	qv, rv := x/y, x%y
+	if 2*abs(rv) > abs(y) {
+		if (rv < 0) == (y < 0) {
+			qv, rv = qv+1, rv-y
+		} else {
+			qv, rv = qv-1, rv+y
+		}
+	}
+	q, _ = WordFromInt64(qv)
+	r, _ = WordFromInt64(rv)
+	return q, r, nil
+}
+
+// Neg returns -t. Balanced ternary negation is exact and never overflows.
+func (t Tryte) Neg() Tryte {
+	for i := range t {
+		t[i] = -t[i]
+	}
+	return t
+}
+
+// Neg returns -w, the tritwise Kleene NOT. It never overflows.
+func (w Word) Neg() Word {
+	for i := range w {
+		w[i] = -w[i]
+	}
+	return w
+}
+
+// Min returns the tritwise Kleene AND (minimum) of t and o.
+func (t Tryte) Min(o Tryte) Tryte {
+	for i := range t {
+		t[i] = And(t[i], o[i])
+	}
+	return t
+}
+
+// Max returns the tritwise Kleene OR (maximum) of t and o.
+func (t Tryte) Max(o Tryte) Tryte {
+	for i := range t {
+		t[i] = Or(t[i], o[i])
+	}
+	return t
+}
+
+// Min returns the tritwise Kleene AND (minimum) of w and o.
+func (w Word) Min(o Word) Word {
+	for i := range w {
+		w[i] = And(w[i], o[i])
+	}
+	return w
+}
+
+// Max returns the tritwise Kleene OR (maximum) of w and o.
+func (w Word) Max(o Word) Word {
+	for i := range w {
+		w[i] = Or(w[i], o[i])
+	}
+	return w
+}
+
+// Trytes splits w into its low and high trytes.
+func (w Word) Trytes() (lo, hi Tryte) {
+	copy(lo[:], w[:TryteTrits])
+	copy(hi[:], w[TryteTrits:])
+	return lo, hi
+}
+
+// WordFromTrytes joins a low and a high tryte into a word.
+func WordFromTrytes(lo, hi Tryte) Word {
+	var w Word
+	copy(w[:TryteTrits], lo[:])
+	copy(w[TryteTrits:], hi[:])
+	return w
+}
+
+// Bits returns the 18-bit hardware encoding of t, trit i in bits 2i+1:2i.
+func (t Tryte) Bits() uint32 { return uint32(bits(t[:])) }
+
+// Bits returns the 36-bit hardware encoding of w, trit i in bits 2i+1:2i.
+func (w Word) Bits() uint64 { return bits(w[:]) }
+
+// TryteFromBits decodes an 18-bit hardware encoding.
+func TryteFromBits(b uint32) (Tryte, error) {
+	var t Tryte
+	return t, fromBits(t[:], uint64(b))
+}
+
+// WordFromBits decodes a 36-bit hardware encoding.
+func WordFromBits(b uint64) (Word, error) {
+	var w Word
+	return w, fromBits(w[:], b)
+}
+
+func fromInt64(dst []Trit, v int64) error {
+	orig := v
+	for i := range dst {
+		r := v % 3
+		v /= 3
+		switch r {
+		case 2:
+			r, v = -1, v+1
+		case -2:
+			r, v = 1, v-1
+		}
+		dst[i] = Trit(r)
+	}
+	if v != 0 {
+		return fmt.Errorf("%w: %d does not fit in %d trits", ErrOverflow, orig, len(dst))
+	}
+	return nil
+}
+
+// wrap reduces v into -max..max modulo 2*max+1.
+func wrap(v, max int64) int64 {
+	m := 2*max + 1
+	v = (v + max) % m
+	if v < 0 {
+		v += m
+	}
+	return v - max
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func toInt64(src []Trit) int64 {
+	var v int64
+	for i := len(src) - 1; i >= 0; i-- {
+		v = v*3 + int64(src[i])
+	}
+	return v
+}
+
+func format(src []Trit) string {
+	var sb strings.Builder
+	for i := len(src) - 1; i >= 0; i-- {
+		sb.WriteByte(src[i].Byte())
+	}
+	return sb.String()
+}
+
+func parse(dst []Trit, s string) error {
+	for i := range dst {
+		dst[i] = Zero
+	}
+	if s == "" {
+		return fmt.Errorf("%w: empty trit string", ErrSyntax)
+	}
+	for i := 0; i < len(s); i++ {
+		t, err := ParseTrit(s[len(s)-1-i])
+		if err != nil {
+			return err
+		}
+		if i >= len(dst) {
+			if t != Zero {
+				return fmt.Errorf("%w: %s has more than %d trits", ErrOverflow, s, len(dst))
+			}
+			continue
+		}
+		dst[i] = t
+	}
+	return nil
+}
+
+func add(dst, a, b []Trit) Trit {
+	carry := Zero
+	for i := range dst {
+		dst[i], carry = addTrits(a[i], b[i], carry)
+	}
+	return carry
+}
+
+func bits(src []Trit) uint64 {
+	var b uint64
+	for i, t := range src {
+		b |= uint64(t.Bits()) << (2 * i)
+	}
+	return b
+}
+
+func fromBits(dst []Trit, b uint64) error {
+	for i := range dst {
+		t, err := TritFromBits(uint8(b >> (2 * i)))
+		if err != nil {
+			return fmt.Errorf("trit %d: %w", i, err)
+		}
+		dst[i] = t
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ternary
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWordInt64RoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 2, -2, 6, 13, -13, 9841, -9842, WordMax, -WordMax} {
+		w, err := WordFromInt64(v)
+		if err != nil {
+			t.Fatalf("WordFromInt64(%d): %v", v, err)
+		}
+		if got := w.Int64(); got != v {
+			t.Errorf("WordFromInt64(%d).Int64() = %d", v, got)
+		}
+	}
+	for _, v := range []int64{WordMax + 1, -WordMax - 1} {
+		if _, err := WordFromInt64(v); !errors.Is(err, ErrOverflow) {
+			t.Errorf("WordFromInt64(%d) error = %v, want ErrOverflow", v, err)
+		}
+	}
+	if _, err := TryteFromInt64(TryteMax + 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("TryteFromInt64(%d) error = %v, want ErrOverflow", TryteMax+1, err)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	cases := []struct {
+		s string
+		v int64
+	}{
+		{"0", 0}, {"+", 1}, {"-", -1}, {"+-", 2}, {"+-0", 6}, {"+++", 13}, {"--0+", -35},
+	}
+	for _, c := range cases {
+		if got, err := ParseInt(c.s); err != nil || got != c.v {
+			t.Errorf("ParseInt(%q) = %d, %v; want %d", c.s, got, err, c.v)
+		}
+		if got := FormatInt(c.v); got != c.s {
+			t.Errorf("FormatInt(%d) = %q, want %q", c.v, got, c.s)
+		}
+		w, err := ParseWord(c.s)
+		if err != nil || w.Int64() != c.v {
+			t.Errorf("ParseWord(%q) = %v, %v; want %d", c.s, w, err, c.v)
+		}
+	}
+	if w, _ := WordFromInt64(6); w.String() != "000000000000000+-0" {
+		t.Errorf("Word(6).String() = %q", w.String())
+	}
+	if _, err := ParseWord("+0000000000000000000"); !errors.Is(err, ErrOverflow) {
+		t.Errorf("ParseWord(19 trits) error = %v, want ErrOverflow", err)
+	}
+	if _, err := ParseInt("+2"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("ParseInt(\"+2\") error = %v, want ErrSyntax", err)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	word := func(v int64) Word {
+		w, err := WordFromInt64(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	if s, ovf := word(40).Add(word(-55)); s.Int64() != -15 || ovf {
+		t.Errorf("40 + -55 = %d (overflow %v)", s.Int64(), ovf)
+	}
+	if s, ovf := word(WordMax).Add(word(1)); s.Int64() != -WordMax || !ovf {
+		t.Errorf("WordMax + 1 = %d (overflow %v), want -WordMax with overflow", s.Int64(), ovf)
+	}
+	if d, ovf := word(-WordMax).Sub(word(2)); d.Int64() != WordMax-1 || !ovf {
+		t.Errorf("-WordMax - 2 = %d (overflow %v)", d.Int64(), ovf)
+	}
+	if p, ovf := word(-123).Mul(word(45)); p.Int64() != -5535 || ovf {
+		t.Errorf("-123 * 45 = %d (overflow %v)", p.Int64(), ovf)
+	}
+	if _, ovf := word(100000).Mul(word(100000)); !ovf {
+		t.Errorf("100000 * 100000 did not overflow")
+	}
+	for _, c := range []struct{ x, y, q, r int64 }{
+		{7, 3, 2, 1},
+		{8, 3, 3, -1},
+		{-8, 3, -3, 1},
+		{8, -3, -3, -1},
+		{-7, -3, 2, -1},
+		{5, 2, 2, 1},
+		{-5, 2, -2, -1},
+		{WordMax, 1, WordMax, 0},
+	} {
+		q, r, err := word(c.x).DivMod(word(c.y))
+		if err != nil || q.Int64() != c.q || r.Int64() != c.r {
+			t.Errorf("%d divmod %d = %d, %d (%v), want %d, %d", c.x, c.y, q.Int64(), r.Int64(), err, c.q, c.r)
+		}
+	}
+	if _, _, err := word(1).DivMod(Word{}); err != ErrDivideByZero {
+		t.Errorf("1 divmod 0: error %v, want ErrDivideByZero", err)
+	}
+	if n := word(WordMax).Neg(); n.Int64() != -WordMax {
+		t.Errorf("-WordMax = %d", n.Int64())
+	}
+	if got := WrapWord(WordMax + 5).Int64(); got != -WordMax+4 {
+		t.Errorf("WrapWord(WordMax+5) = %d", got)
+	}
+	if got := WrapTryte(-TryteMax - 1).Int64(); got != TryteMax {
+		t.Errorf("WrapTryte(-TryteMax-1) = %d", got)
+	}
+}
+
+func TestKleeneLogic(t *testing.T) {
+	all := []Trit{Neg, Zero, Pos}
+	for _, a := range all {
+		for _, b := range all {
+			if And(a, b) != min(a, b) || Or(a, b) != max(a, b) {
+				t.Errorf("And/Or(%v, %v) = %v/%v", a, b, And(a, b), Or(a, b))
+			}
+		}
+		if a.Not() != -a {
+			t.Errorf("Not(%v) = %v", a, a.Not())
+		}
+	}
+	a, _ := ParseWord("+0-+")
+	b, _ := ParseWord("0-++")
+	if got := a.Min(b).String()[WordTrits-4:]; got != "0--+" {
+		t.Errorf("Min = %s, want 0--+", got)
+	}
+	if got := a.Max(b).String()[WordTrits-4:]; got != "+0++" {
+		t.Errorf("Max = %s, want +0++", got)
+	}
+}
+
+func TestBitsAndTrytes(t *testing.T) {
+	w, _ := WordFromInt64(-1234567)
+	back, err := WordFromBits(w.Bits())
+	if err != nil || back != w {
+		t.Errorf("WordFromBits(Bits()) = %v, %v; want %v", back, err, w)
+	}
+	if z := (Word{}).Bits(); z != 0x555555555 {
+		t.Errorf("zero word bits = %#x, want 0x555555555", z)
+	}
+	if _, err := WordFromBits(0xFFFFFFFFF); !errors.Is(err, ErrSyntax) {
+		t.Errorf("WordFromBits(all ones) error = %v, want ErrSyntax", err)
+	}
+	lo, hi := w.Trytes()
+	if lo.Int64()+hi.Int64()*19683 != w.Int64() || WordFromTrytes(lo, hi) != w {
+		t.Errorf("Trytes() = %d, %d do not rebuild %d", lo.Int64(), hi.Int64(), w.Int64())
+	}
+}